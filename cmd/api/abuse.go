@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// listSuspectedAbuseHandler отмечает пользователей с подозрительными операциями за последние days дней:
+// rapid_cycles - списания вскоре после начисления (в пределах cycle_window_minutes, не меньше min_cycles раз),
+// frequent_multiplies - не меньше min_multiplies бонусов multiply_percent в пределах multiply_window_minutes,
+// transfer_cycles - переводы, по которым баллы вернулись к отправителю через не больше max_cycle_length участников
+func (app *application) listSuspectedAbuseHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	days := app.readInt(qs, "days", 7, v)
+	cycleWindow := app.readInt(qs, "cycle_window_minutes", 10, v)
+	minCycles := app.readInt(qs, "min_cycles", 3, v)
+	minMultiplies := app.readInt(qs, "min_multiplies", 5, v)
+	multiplyWindow := app.readInt(qs, "multiply_window_minutes", 60, v)
+	maxCycleLength := app.readInt(qs, "max_cycle_length", 4, v)
+	v.Check(days > 0, "days", "must be positive")
+	v.Check(days <= 366, "days", "must not be more than 366")
+	v.Check(cycleWindow > 0, "cycle_window_minutes", "must be positive")
+	v.Check(minCycles > 0, "min_cycles", "must be positive")
+	v.Check(minMultiplies > 0, "min_multiplies", "must be positive")
+	v.Check(multiplyWindow > 0, "multiply_window_minutes", "must be positive")
+	v.Check(maxCycleLength >= 2 && maxCycleLength <= 6, "max_cycle_length", "must be between 2 and 6")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+
+	cycles, err := app.models.Transactions.GetRapidCycles(r.Context(),
+		app.types.withBase(typeDeposit),
+		app.types.withBase(typeWithdrawal),
+		time.Duration(cycleWindow)*time.Minute,
+		minCycles,
+		since,
+	)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	multiplies, err := app.models.Transactions.GetOperationBursts(r.Context(),
+		app.types.withBase(typeMultiplyPercent),
+		time.Duration(multiplyWindow)*time.Minute,
+		minMultiplies,
+		since,
+	)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	transferCycles, err := app.models.Transactions.GetTransferCycles(r.Context(), app.types.withBase(typeTransfer), maxCycleLength, since)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := map[string]any{
+		"days":                days,
+		"rapid_cycles":        cycles,
+		"frequent_multiplies": multiplies,
+		"transfer_cycles":     transferCycles,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
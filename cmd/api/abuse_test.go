@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestSuspectedAbuse(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	abuser, honest, multiplier, spread := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	start := time.Now().Add(-24 * time.Hour)
+	for i := range 3 {
+		at := start.Add(time.Duration(i) * time.Hour)
+		// Списание через 2 минуты после начисления - быстрый цикл
+		logTransaction(t, app, abuser, "deposit", 50, at)
+		logTransaction(t, app, abuser, "withdrawal", -50, at.Add(2*time.Minute))
+		// Списание через 2 часа - обычное поведение
+		logTransaction(t, app, honest, "deposit", 50, at.Add(-3*time.Hour))
+		logTransaction(t, app, honest, "withdrawal", -50, at.Add(-time.Hour))
+	}
+	for i := range 5 {
+		logTransaction(t, app, multiplier, "multiply_percent", 10, start.Add(time.Duration(i)*time.Minute))
+		// Столько же бонусов, но раз в два часа - ни одно часовое окно не набирает пяти
+		logTransaction(t, app, spread, "multiply_percent", 10, start.Add(time.Duration(i)*2*time.Hour))
+	}
+	// Еще два бонуса через сутки не попадают в самое загруженное окно
+	for i := range 2 {
+		logTransaction(t, app, multiplier, "multiply_percent", 10, start.Add(20*time.Hour+time.Duration(i)*time.Minute))
+	}
+
+	var response struct {
+		RapidCycles        []data.SuspectedUser `json:"rapid_cycles"`
+		FrequentMultiplies []data.SuspectedUser `json:"frequent_multiplies"`
+	}
+	ts.mustGet(t, "/v1/admin/abuse", &response)
+
+	if len(response.RapidCycles) != 1 {
+		t.Fatalf("got rapid cycles %+v; want only the abuser", response.RapidCycles)
+	}
+	if got := response.RapidCycles[0]; got.UserId != abuser || got.Count != 3 || got.Amount != 150 {
+		t.Errorf("got rapid cycles %+v; want %s with 3 cycles of 150 points", got, abuser)
+	}
+
+	if len(response.FrequentMultiplies) != 1 {
+		t.Fatalf("got frequent multiplies %+v; want only the multiplier", response.FrequentMultiplies)
+	}
+	if got := response.FrequentMultiplies[0]; got.UserId != multiplier || got.Count != 5 || got.Amount != 50 {
+		t.Errorf("got frequent multiplies %+v; want %s with 5 multiplies of 50 points in one window", got, multiplier)
+	}
+
+	// Все бонусы spread попадают в одно окно длиной в сутки
+	ts.mustGet(t, "/v1/admin/abuse?multiply_window_minutes=1440", &response)
+	flagged := map[uuid.UUID]int{}
+	for _, user := range response.FrequentMultiplies {
+		flagged[user.UserId] = user.Count
+	}
+	if flagged[spread] != 5 || flagged[multiplier] != 7 {
+		t.Errorf("got frequent multiplies %v in a day window; want %s with 5 and %s with 7", flagged, spread, multiplier)
+	}
+}
+
+func TestTransferCycles(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	users := make([]uuid.UUID, 7)
+	for i := range users {
+		users[i] = uuid.New()
+		deposit(t, ts, users[i], 100)
+	}
+	a, b, c, d, e, f, g := users[0], users[1], users[2], users[3], users[4], users[5], users[6]
+
+	transfer := func(from, to uuid.UUID, amount int) {
+		t.Helper()
+
+		ts.mustPost(t, "/v1/transactions", map[string]any{
+			"user_id":    from,
+			"to_user_id": to,
+			"amount":     amount,
+			"type":       "transfer",
+		}, nil)
+	}
+
+	// Цикл из трех участников: баллы возвращаются к a
+	transfer(a, b, 30)
+	transfer(b, c, 20)
+	transfer(c, a, 10)
+	// Цикл из двух участников
+	transfer(d, e, 5)
+	transfer(e, d, 5)
+	// Цепочка без возврата
+	transfer(f, g, 40)
+
+	var response struct {
+		TransferCycles []data.TransferCycle `json:"transfer_cycles"`
+	}
+	ts.mustGet(t, "/v1/admin/abuse", &response)
+
+	// rotate поворачивает цикл так, чтобы он начинался с участника с наименьшим id, как в отчете
+	rotate := func(cycle ...uuid.UUID) []uuid.UUID {
+		first := 0
+		for i, user := range cycle {
+			if bytes.Compare(user[:], cycle[first][:]) < 0 {
+				first = i
+			}
+		}
+		return append(cycle[first:], cycle[:first]...)
+	}
+
+	tests := []struct {
+		name      string
+		users     []uuid.UUID
+		transfers int
+		amount    data.Points
+	}{
+		{name: "three users", users: rotate(a, b, c), transfers: 3, amount: 60},
+		{name: "two users", users: rotate(d, e), transfers: 2, amount: 10},
+	}
+
+	if len(response.TransferCycles) != len(tests) {
+		t.Fatalf("got %d transfer cycles; want %d: %+v", len(response.TransferCycles), len(tests), response.TransferCycles)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cycle := range response.TransferCycles {
+				if !slices.Equal(cycle.Users, tt.users) {
+					continue
+				}
+				if cycle.Transfers != tt.transfers || cycle.Amount != tt.amount {
+					t.Errorf("got %d transfers of %d points; want %d of %d", cycle.Transfers, cycle.Amount, tt.transfers, tt.amount)
+				}
+				return
+			}
+			t.Errorf("got cycles %+v; want %v", response.TransferCycles, tt.users)
+		})
+	}
+
+	// Цикл из трех участников не укладывается в max_cycle_length=2
+	ts.mustGet(t, "/v1/admin/abuse?max_cycle_length=2", &response)
+	if len(response.TransferCycles) != 1 || !slices.Equal(response.TransferCycles[0].Users, rotate(d, e)) {
+		t.Errorf("got cycles %+v with max_cycle_length=2; want only %v", response.TransferCycles, rotate(d, e))
+	}
+}
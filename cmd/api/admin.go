@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+type userComparison struct {
+	UserId         uuid.UUID   `json:"user_id"`
+	Balance        data.Points `json:"balance"`
+	ActiveEntries  int         `json:"active_entries"`
+	LastActivity   *time.Time  `json:"last_activity"`
+	LifetimeEarned data.Points `json:"lifetime_earned"`
+}
+
+// adminUserReportsHandler обслуживает отчеты /v1/admin/users/fragmented, /v1/admin/users/compare
+// и /v1/admin/users/old-grants.
+// httprouter не позволяет статическому сегменту и параметру :id делить один уровень пути
+// с /v1/admin/users/:id/settings, поэтому отчет выбирается по значению параметра
+func (app *application) adminUserReportsHandler(w http.ResponseWriter, r *http.Request) {
+	switch httprouter.ParamsFromContext(r.Context()).ByName("id") {
+	case "fragmented":
+		app.limitReports(app.listFragmentedUsersHandler)(w, r)
+	case "compare":
+		app.compareUsersHandler(w, r)
+	case "old-grants":
+		app.limitReports(app.listUsersWithOldGrantsHandler)(w, r)
+	case "dormant":
+		app.limitReports(app.listDormantUsersHandler)(w, r)
+	default:
+		app.notFoundResponse(w, r)
+	}
+}
+
+// listFragmentedUsersHandler возвращает пользователей с наибольшим числом активных записей,
+// чтобы найти кандидатов на консолидацию
+func (app *application) listFragmentedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	minEntries := app.readInt(qs, "min_entries", 100, v)
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(minEntries >= 0, "min_entries", "must not be negative")
+	v.Check(limit > 0, "limit", "must be positive")
+	v.Check(limit <= 500, "limit", "must not be more than 500")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.models.BonusEntries.GetFragmentedUsers(r.Context(), minEntries, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"users": users}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUsersWithOldGrantsHandler возвращает пользователей, чье самое старое активное начисление
+// старше min_age_days дней, начиная с самых старых. Такие баллы - давнее обязательство программы
+// и признак неактивного пользователя
+func (app *application) listUsersWithOldGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	minAgeDays := app.readInt(qs, "min_age_days", 180, v)
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(minAgeDays >= 0, "min_age_days", "must not be negative")
+	v.Check(limit > 0, "limit", "must be positive")
+	v.Check(limit <= 500, "limit", "must not be more than 500")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.models.BonusEntries.GetUsersWithOldGrants(r.Context(), minAgeDays, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"users": users}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listDormantUsersHandler возвращает пользователей, которые держат баллы, но не совершали операций
+// дольше days дней, начиная с наибольшего баланса - кандидатов для возвращения в программу
+func (app *application) listDormantUsersHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	days := app.readInt(qs, "days", 90, v)
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(days >= 0, "days", "must not be negative")
+	v.Check(limit > 0, "limit", "must be positive")
+	v.Check(limit <= 500, "limit", "must not be more than 500")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.models.Transactions.GetDormantUsers(r.Context(), days, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"users": users}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// compareUsersHandler показывает состояние двух пользователей рядом, чтобы выбрать,
+// в какой аккаунт переносить баллы при объединении
+func (app *application) compareUsersHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	a, errA := uuid.Parse(qs.Get("a"))
+	b, errB := uuid.Parse(qs.Get("b"))
+
+	v := validator.New()
+	v.Check(errA == nil, "a", "must be uuid")
+	v.Check(errB == nil, "b", "must be uuid")
+	v.Check(errA != nil || errB != nil || a != b, "b", "must differ from a")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users := make([]userComparison, 0, 2)
+	for _, userId := range []uuid.UUID{a, b} {
+		balance, activeEntries, err := app.models.BonusEntries.GetActiveStats(r.Context(), userId)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		lastActivity, lifetimeEarned, err := app.models.Transactions.GetActivityStats(r.Context(), userId)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		users = append(users, userComparison{
+			UserId:         userId,
+			Balance:        data.Points(balance),
+			ActiveEntries:  activeEntries,
+			LastActivity:   lastActivity,
+			LifetimeEarned: data.Points(lifetimeEarned),
+		})
+	}
+
+	response := map[string]any{
+		"a": users[0],
+		"b": users[1],
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	settings, err := app.models.UserSettings.Get(r.Context(), userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"settings": settings}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserSettingsHandler задает персональные настройки пользователя.
+// default_lifetime_days: null убирает персональный срок жизни баллов
+func (app *application) updateUserSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		DefaultLifetimeDays *int `json:"default_lifetime_days"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.DefaultLifetimeDays != nil {
+		v.Check(*input.DefaultLifetimeDays > 0, "default_lifetime_days", "must be positive")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	settings := &data.UserSettings{
+		UserId:              userId,
+		DefaultLifetimeDays: input.DefaultLifetimeDays,
+	}
+	if err = app.models.UserSettings.Upsert(r.Context(), settings); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"settings": settings}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// extendBatchSize - число записей, продлеваемых в одной транзакции
+const extendBatchSize = 500
+
+// extendLifetimesHandler продлевает срок жизни активных начислений всех пользователей
+// (или только user_ids) на days дней, но не дальше -max-lifetime-days от даты начисления.
+// Записи обрабатываются пачками в отдельных транзакциях, чтобы не держать блокировки
+// на всей таблице. Для каждого пользователя в пачке в журнал пишется операция lifetime_extension
+func (app *application) extendLifetimesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserIds []string `json:"user_ids"`
+		Days    int      `json:"days"`
+		Filter  struct {
+			ExpiringWithinDays int `json:"expiring_within_days"`
+		} `json:"filter"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Days > 0, "days", "must be positive")
+	v.Check(input.Days <= app.config.limits.maxExtensionDays, "days", fmt.Sprintf("must not be more than %d", app.config.limits.maxExtensionDays))
+	v.Check(input.Filter.ExpiringWithinDays >= 0, "filter.expiring_within_days", "must not be negative")
+
+	filter := data.ExtendFilter{ExpiringWithinDays: input.Filter.ExpiringWithinDays}
+	for _, s := range input.UserIds {
+		userId, err := uuid.Parse(s)
+		if err != nil {
+			v.AddError("user_ids", "must contain only uuids")
+			break
+		}
+		filter.UserIds = append(filter.UserIds, userId)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	summary, err := app.extendAll(r.Context(), filter, input.Days)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, summary, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// extendSourceHandler продлевает срок жизни активных начислений из одного источника у всех
+// пользователей, например при продлении всех реферальных баллов. Работает так же, как /v1/admin/extend
+func (app *application) extendSourceHandler(w http.ResponseWriter, r *http.Request) {
+	source := httprouter.ParamsFromContext(r.Context()).ByName("source")
+
+	var input struct {
+		Days int `json:"days"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Days > 0, "days", "must be positive")
+	v.Check(input.Days <= app.config.limits.maxExtensionDays, "days", fmt.Sprintf("must not be more than %d", app.config.limits.maxExtensionDays))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	summary, err := app.extendAll(r.Context(), data.ExtendFilter{Source: source}, input.Days)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	summary["source"] = source
+
+	app.logger.PrintInfo("lifetimes extended for source", map[string]string{
+		"source":           source,
+		"days":             strconv.Itoa(input.Days),
+		"extended_entries": fmt.Sprint(summary["extended_entries"]),
+		"correlation_id":   fmt.Sprint(summary["correlation_id"]),
+	})
+
+	if err = app.writeJSON(w, http.StatusOK, summary, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// extendAll продлевает все подходящие под filter записи пачками и возвращает итог продления
+func (app *application) extendAll(ctx context.Context, filter data.ExtendFilter, days int) (map[string]any, error) {
+	var (
+		after     uuid.UUID
+		batches   int
+		entries   int
+		points    int64
+		usersSeen = make(map[uuid.UUID]bool)
+	)
+
+	// Все записи журнала одного продления (по всем пачкам и пользователям) связаны общим correlation_id
+	correlationId := uuid.New()
+
+	for {
+		extended, err := app.extendBatch(ctx, after, filter, days, correlationId)
+		if err != nil {
+			return nil, err
+		}
+		if len(extended) == 0 {
+			break
+		}
+
+		batches++
+		entries += len(extended)
+		for _, entry := range extended {
+			points += int64(entry.Amount)
+			usersSeen[entry.UserId] = true
+		}
+		after = extended[len(extended)-1].Id
+
+		if len(extended) < extendBatchSize {
+			break
+		}
+	}
+
+	return map[string]any{
+		"days":             days,
+		"max_lifetime":     app.config.limits.maxLifetimeDays,
+		"extended_entries": entries,
+		"extended_points":  data.Points(points),
+		"users":            len(usersSeen),
+		"batches":          batches,
+		"correlation_id":   correlationId,
+	}, nil
+}
+
+// extendBatch продлевает одну пачку записей и записывает в журнал по операции на пользователя
+func (app *application) extendBatch(ctx context.Context, after uuid.UUID, filter data.ExtendFilter, days int, correlationId uuid.UUID) ([]*data.ExtendedEntry, error) {
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	extended, err := app.models.BonusEntries.ExtendActiveEntries(ctx, tx, after, filter, days, app.config.limits.maxLifetimeDays, extendBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	perUser := make(map[uuid.UUID]data.Points)
+	for _, entry := range extended {
+		perUser[entry.UserId] += entry.Amount
+	}
+
+	now := time.Now()
+	for userId, amount := range perUser {
+		err = app.insertTransaction(ctx, tx, &data.Transaction{
+			Id:            uuid.New(),
+			UserId:        userId,
+			Type:          "lifetime_extension",
+			Amount:        amount,
+			Delta:         0,
+			CorrelationId: &correlationId,
+			CreatedAt:     now,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return extended, nil
+}
+
+func (app *application) listSourcePoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := app.models.SourcePolicies.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"policies": policies}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateSourcePolicyHandler задает срок жизни по умолчанию для начислений из источника
+func (app *application) updateSourcePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	source := httprouter.ParamsFromContext(r.Context()).ByName("source")
+
+	var input struct {
+		DefaultLifetimeDays int `json:"default_lifetime_days"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	app.checkSource(v, "source", &source)
+	v.Check(len(source) <= maxSourceLength, "source", fmt.Sprintf("must not be more than %d bytes long", maxSourceLength))
+	v.Check(input.DefaultLifetimeDays > 0, "default_lifetime_days", "must be positive")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	policy := &data.SourcePolicy{
+		Source:              source,
+		DefaultLifetimeDays: input.DefaultLifetimeDays,
+	}
+	if err := app.models.SourcePolicies.Upsert(r.Context(), policy); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]any{"policy": policy}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSourcePolicyHandler удаляет политику источника, после чего его начисления получают срок по умолчанию
+func (app *application) deleteSourcePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	source := httprouter.ParamsFromContext(r.Context()).ByName("source")
+
+	err := app.models.SourcePolicies.Delete(r.Context(), source)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"message": "source policy deleted"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type activityResponse struct {
+	Activity   []*data.Transaction `json:"activity"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// listActivityHandler возвращает ленту операций всех пользователей от новых к старым.
+// Следующая страница запрашивается с since=next_cursor предыдущей
+func (app *application) listActivityHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(limit > 0, "limit", "must be positive")
+	v.Check(limit <= 500, "limit", "must not be more than 500")
+
+	var before *data.Cursor
+	if s := qs.Get("since"); s != "" {
+		cursor, err := data.DecodeCursor(s)
+		v.Check(err == nil, "since", "is invalid")
+		before = &cursor
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	activity, err := app.models.Transactions.ListAll(r.Context(), before, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := activityResponse{Activity: activity}
+	if len(activity) == limit {
+		last := activity[len(activity)-1]
+		response.NextCursor = data.Cursor{CreatedAt: last.CreatedAt, Id: last.Id}.Encode()
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
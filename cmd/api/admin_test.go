@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestFragmentedUsers(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	heavy, medium, light := uuid.New(), uuid.New(), uuid.New()
+	seed := func(userId uuid.UUID, n int) {
+		for range n {
+			insertEntry(t, app, userId, 1, time.Now(), 30)
+		}
+	}
+	seed(heavy, 12)
+	seed(medium, 4)
+	seed(light, 2)
+
+	var response struct {
+		Users []data.UserEntryCount `json:"users"`
+	}
+	ts.mustGet(t, "/v1/admin/users/fragmented?min_entries=3", &response)
+
+	want := []data.UserEntryCount{
+		{UserId: heavy, Entries: 12, Balance: 12},
+		{UserId: medium, Entries: 4, Balance: 4},
+	}
+	if len(response.Users) != len(want) {
+		t.Fatalf("got %d users; want %d: %+v", len(response.Users), len(want), response.Users)
+	}
+	for i := range want {
+		if response.Users[i] != want[i] {
+			t.Errorf("user %d: got %+v; want %+v", i, response.Users[i], want[i])
+		}
+	}
+}
+
+func TestCompareUsers(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	a, b := uuid.New(), uuid.New()
+	before := time.Now().Add(-time.Second)
+	deposit(t, ts, a, 50)
+	deposit(t, ts, a, 30)
+	withdraw(t, ts, a, 20)
+	after := time.Now().Add(time.Second)
+
+	var response struct {
+		A userComparison `json:"a"`
+		B userComparison `json:"b"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/admin/users/compare?a=%s&b=%s", a, b), &response)
+
+	got := response.A
+	if got.UserId != a || got.Balance != 60 || got.ActiveEntries != 2 || got.LifetimeEarned != 80 {
+		t.Errorf("a: got %+v; want balance 60, 2 active entries, 80 earned", got)
+	}
+	if got.LastActivity == nil || got.LastActivity.Before(before) || got.LastActivity.After(after) {
+		t.Errorf("a: got last_activity %v; want the time of the withdrawal", got.LastActivity)
+	}
+
+	want := userComparison{UserId: b}
+	if response.B != want {
+		t.Errorf("b: got %+v; want an empty account", response.B)
+	}
+}
+
+func TestCompareUsersValidation(t *testing.T) {
+	app := newTestApplication(t, testConfig(), nil)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.NewString()
+	for _, query := range []string{"a=not-a-uuid&b=" + userId, "a=" + userId + "&b=" + userId} {
+		if status, body := ts.get(t, "/v1/admin/users/compare?"+query); status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d; want %d: %s", query, status, http.StatusUnprocessableEntity, body)
+		}
+	}
+}
+
+func TestUserDefaultLifetimeOverride(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	vip, regular := uuid.New(), uuid.New()
+	status, _, body := ts.request(t, http.MethodPut, fmt.Sprintf("/v1/admin/users/%s/settings", vip), map[string]any{"default_lifetime_days": 90}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("update settings: got status %d: %s", status, body)
+	}
+
+	deposit(t, ts, vip, 10)
+	deposit(t, ts, regular, 10)
+	// Явный lifetime_days важнее настройки пользователя
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": vip, "amount": 20, "type": "deposit", "lifetime_days": 10}, nil)
+
+	lifetimes := func(userId uuid.UUID) map[data.Points]time.Duration {
+		got := make(map[data.Points]time.Duration)
+		for _, entry := range listEntries(t, ts, userId) {
+			got[entry.Amount] = entry.ExpiresAt.Sub(entry.CreatedAt)
+		}
+		return got
+	}
+
+	day := 24 * time.Hour
+	if got := lifetimes(vip); got[10] != 90*day || got[20] != 10*day {
+		t.Errorf("vip: got lifetimes %v; want 90 days for the omitted lifetime and 10 days for the explicit one", got)
+	}
+	if got := lifetimes(regular); got[10] != 30*day {
+		t.Errorf("regular: got lifetime %v; want the global default of 30 days", got[10])
+	}
+}
+
+func TestExtendLifetimes(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	a, b := uuid.New(), uuid.New()
+
+	// На одну запись больше пачки, чтобы продление заняло две транзакции
+	_, err := db.Exec(`
+		INSERT INTO bonus_entries (user_id, amount, expires_at, lifetime_days)
+		SELECT $1, 1, NOW() + INTERVAL '30 days', 30
+		FROM generate_series(1, $2)`, a, extendBatchSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertEntry(t, app, b, 10, time.Now(), 30)
+	// Срок продлевается только до -max-lifetime-days
+	insertEntry(t, app, b, 20, time.Now().AddDate(0, 0, -10), 360)
+
+	var summary struct {
+		ExtendedEntries int       `json:"extended_entries"`
+		ExtendedPoints  int       `json:"extended_points"`
+		Users           int       `json:"users"`
+		Batches         int       `json:"batches"`
+		CorrelationId   uuid.UUID `json:"correlation_id"`
+	}
+	ts.mustPost(t, "/v1/admin/extend", map[string]any{"days": 30}, &summary)
+
+	wantPoints := extendBatchSize + 1 + 30
+	if summary.ExtendedEntries != extendBatchSize+3 || summary.ExtendedPoints != wantPoints || summary.Users != 2 || summary.Batches != 2 {
+		t.Errorf("got %+v; want %d entries, %d points, 2 users, 2 batches", summary, extendBatchSize+3, wantPoints)
+	}
+
+	day := 24 * time.Hour
+	for _, entry := range listEntries(t, ts, b) {
+		want := 60 * day
+		if entry.Amount == 20 {
+			want = 365 * day
+		}
+		if got := entry.ExpiresAt.Sub(entry.CreatedAt); got != want {
+			t.Errorf("entry of %d: got lifetime %v; want %v", entry.Amount, got, want)
+		}
+	}
+
+	// Продление записано в журнал под одним correlation_id
+	journal, err := app.models.Transactions.GetByCorrelationId(context.Background(), summary.CorrelationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var journaled data.Points
+	for _, trx := range journal {
+		if trx.Type != "lifetime_extension" || trx.Delta != 0 {
+			t.Errorf("got journal row %s delta=%d; want lifetime_extension with zero delta", trx.Type, trx.Delta)
+		}
+		journaled += trx.Amount
+	}
+	if journaled != data.Points(wantPoints) {
+		t.Errorf("got %d points journaled; want %d", journaled, wantPoints)
+	}
+}
+
+func TestUsersWithOldGrants(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	oldest, old, fresh := uuid.New(), uuid.New(), uuid.New()
+	// Час запаса, чтобы округление created_at до секунды не уменьшило возраст на день
+	now := time.Now().Add(-time.Hour)
+	insertEntry(t, app, oldest, 10, now.AddDate(0, 0, -300), 365)
+	insertEntry(t, app, oldest, 5, now, 30)
+	insertEntry(t, app, old, 20, now.AddDate(0, 0, -200), 365)
+	insertEntry(t, app, fresh, 30, now.AddDate(0, 0, -10), 365)
+
+	var response struct {
+		Users []data.UserOldestGrant `json:"users"`
+	}
+	ts.mustGet(t, "/v1/admin/users/old-grants?min_age_days=180", &response)
+
+	want := []struct {
+		userId  uuid.UUID
+		ageDays int
+		balance data.Points
+	}{
+		{oldest, 300, 15},
+		{old, 200, 20},
+	}
+	if len(response.Users) != len(want) {
+		t.Fatalf("got %d users; want %d: %+v", len(response.Users), len(want), response.Users)
+	}
+	for i, w := range want {
+		got := response.Users[i]
+		if got.UserId != w.userId || got.AgeDays != w.ageDays || got.Balance != w.balance {
+			t.Errorf("user %d: got %s age=%d balance=%d; want %s age=%d balance=%d",
+				i, got.UserId, got.AgeDays, got.Balance, w.userId, w.ageDays, w.balance)
+		}
+	}
+}
+
+func TestExtensionCap(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	// Общий предел срока жизни выше, чтобы продление ограничивал только -max-extension-days
+	cfg.limits.maxLifetimeDays = 20000
+	cfg.limits.maxExtensionDays = 365
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	insertEntry(t, app, userId, 10, time.Now(), 30)
+
+	tests := []struct {
+		name         string
+		days         int
+		wantStatus   int
+		wantLifetime int
+	}{
+		{name: "beyond the cap", days: 10000, wantStatus: http.StatusUnprocessableEntity, wantLifetime: 30},
+		{name: "at the cap", days: 365, wantStatus: http.StatusOK, wantLifetime: 395},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := ts.postJSON(t, "/v1/admin/extend", map[string]any{"user_ids": []uuid.UUID{userId}, "days": tt.days})
+			if status != tt.wantStatus {
+				t.Errorf("got status %d; want %d: %s", status, tt.wantStatus, body)
+			}
+
+			entries := listEntries(t, ts, userId)
+			if len(entries) != 1 {
+				t.Fatalf("got %d entries; want 1", len(entries))
+			}
+			want := time.Duration(tt.wantLifetime) * 24 * time.Hour
+			if got := entries[0].ExpiresAt.Sub(entries[0].CreatedAt); got != want {
+				t.Errorf("got lifetime %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDormantUsers(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	old := time.Now().AddDate(0, 0, -100)
+	dormant, richer, active, empty := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	insertEntry(t, app, dormant, 50, old, 365)
+	logTransaction(t, app, dormant, "deposit", 50, old)
+	// Служебная запись журнала не считается активностью пользователя
+	logTransaction(t, app, dormant, "lifetime_extension", 0, time.Now())
+
+	insertEntry(t, app, richer, 80, old, 365)
+	logTransaction(t, app, richer, "deposit", 80, old)
+
+	deposit(t, ts, active, 100)
+
+	// Давно неактивный пользователь без баланса в выборку не попадает
+	logTransaction(t, app, empty, "deposit", 10, old)
+
+	var response struct {
+		Users []data.DormantUser `json:"users"`
+	}
+	ts.mustGet(t, "/v1/admin/users/dormant?days=30", &response)
+
+	want := []struct {
+		userId  uuid.UUID
+		balance data.Points
+	}{{richer, 80}, {dormant, 50}}
+	if len(response.Users) != len(want) {
+		t.Fatalf("got %d dormant users; want %d: %+v", len(response.Users), len(want), response.Users)
+	}
+	for i, w := range want {
+		got := response.Users[i]
+		if got.UserId != w.userId || got.Balance != w.balance {
+			t.Errorf("users[%d]: got %s with balance %d; want %s with %d", i, got.UserId, got.Balance, w.userId, w.balance)
+		}
+		if got.LastTransactionAt == nil {
+			t.Errorf("users[%d]: got no last_transaction_at", i)
+		}
+	}
+}
+
+func TestExtendSource(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	a, b := uuid.New(), uuid.New()
+	for _, grant := range []struct {
+		userId uuid.UUID
+		amount int
+		source string
+	}{
+		{a, 10, "referral"},
+		{a, 20, "promo"},
+		{b, 30, "referral"},
+		{b, 40, ""},
+	} {
+		input := map[string]any{"user_id": grant.userId, "amount": grant.amount, "type": "deposit"}
+		if grant.source != "" {
+			input["source"] = grant.source
+		}
+		ts.mustPost(t, "/v1/transactions", input, nil)
+	}
+
+	var summary struct {
+		Source          string `json:"source"`
+		ExtendedEntries int    `json:"extended_entries"`
+		ExtendedPoints  int    `json:"extended_points"`
+		Users           int    `json:"users"`
+	}
+	ts.mustPost(t, "/v1/admin/sources/referral/extend", map[string]any{"days": 10}, &summary)
+
+	if summary.Source != "referral" || summary.ExtendedEntries != 2 || summary.ExtendedPoints != 40 || summary.Users != 2 {
+		t.Errorf("got %+v; want source referral, 2 entries, 40 points, 2 users", summary)
+	}
+
+	// Продлеваются только начисления referral (10 и 30), остальные сохраняют срок по умолчанию
+	day := 24 * time.Hour
+	for _, userId := range []uuid.UUID{a, b} {
+		for _, entry := range listEntries(t, ts, userId) {
+			want := 30 * day
+			if entry.Amount == 10 || entry.Amount == 30 {
+				want = 40 * day
+			}
+			if got := entry.ExpiresAt.Sub(entry.CreatedAt); got != want {
+				t.Errorf("entry of %d: got lifetime %v; want %v", entry.Amount, got, want)
+			}
+		}
+	}
+}
+
+func TestActivityFeed(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	a, b := uuid.New(), uuid.New()
+	now := time.Now()
+	for i := range 5 {
+		userId := a
+		if i%2 == 1 {
+			userId = b
+		}
+		logTransaction(t, app, userId, "deposit", 10*(i+1), now.Add(-time.Duration(i+1)*time.Minute))
+	}
+	// Две операции в одну секунду различаются по id
+	same := now.Add(-10 * time.Minute)
+	logTransaction(t, app, a, "withdrawal", -5, same)
+	logTransaction(t, app, b, "withdrawal", -7, same)
+
+	var (
+		feed []*data.Transaction
+		seen = make(map[uuid.UUID]bool)
+		path = "/v1/admin/activity?limit=2"
+	)
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatal("got no end of the feed")
+		}
+
+		var response activityResponse
+		ts.mustGet(t, path, &response)
+		for _, trx := range response.Activity {
+			if seen[trx.Id] {
+				t.Errorf("page %d: got transaction %s twice", page, trx.Id)
+			}
+			seen[trx.Id] = true
+		}
+		feed = append(feed, response.Activity...)
+
+		// Новая операция между страницами не попадает в следующие страницы
+		if page == 0 {
+			logTransaction(t, app, a, "deposit", 1, time.Now())
+		}
+
+		if response.NextCursor == "" {
+			break
+		}
+		path = "/v1/admin/activity?limit=2&since=" + response.NextCursor
+	}
+
+	if len(feed) != 7 {
+		t.Fatalf("got %d transactions in the feed; want 7", len(feed))
+	}
+	for i := 1; i < len(feed); i++ {
+		if feed[i].CreatedAt.After(feed[i-1].CreatedAt) {
+			t.Errorf("feed[%d] at %v is newer than feed[%d] at %v", i, feed[i].CreatedAt, i-1, feed[i-1].CreatedAt)
+		}
+	}
+	if feed[0].Amount != 10 || feed[0].UserId != a || feed[0].Type != "deposit" {
+		t.Errorf("got newest %+v; want the deposit of 10 by %s", feed[0], a)
+	}
+
+	if status, body := ts.get(t, "/v1/admin/activity?since=garbage"); status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid cursor: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+type volumeStats struct {
+	Count  int         `json:"count"`
+	Amount data.Points `json:"amount"`
+}
+
+type dailyVolume struct {
+	Date  string                 `json:"date"`
+	Types map[string]volumeStats `json:"types"`
+}
+
+// showExpiringLiabilityHandler возвращает суммы баллов всей программы, сгорающих по дням
+func (app *application) showExpiringLiabilityHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	days := app.readInt(r.URL.Query(), "days", 30, v)
+	v.Check(days > 0, "days", "must be positive")
+	v.Check(days <= 366, "days", "must not be more than 366")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	expiring, err := app.models.BonusEntries.GetProgramExpiring(r.Context(), days)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var total data.Points
+	for _, day := range expiring {
+		total += day.Amount
+	}
+
+	response := map[string]any{
+		"days":     days,
+		"total":    total,
+		"expiring": expiring,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showVolumeHandler возвращает число и сумму операций по дням и типам за период.
+// По умолчанию дни без операций пропускаются, с zero_fill=true они возвращаются с нулями
+func (app *application) showVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	y, m, d := time.Now().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	to := app.readDate(qs, "to", today, v)
+	from := app.readDate(qs, "from", to.AddDate(0, 0, -6), v)
+	zeroFill := app.readBool(qs, "zero_fill", false, v)
+	v.Check(!from.After(to), "from", "must not be after to")
+	v.Check(to.Sub(from) <= 366*24*time.Hour, "from", "range must not be longer than 366 days")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	volumes, err := app.models.Transactions.GetDailyVolume(r.Context(), from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	byDate := make(map[string]map[string]volumeStats)
+	types := make(map[string]bool)
+	for _, volume := range volumes {
+		if byDate[volume.Date] == nil {
+			byDate[volume.Date] = make(map[string]volumeStats)
+		}
+		byDate[volume.Date][volume.Type] = volumeStats{Count: volume.Count, Amount: volume.Amount}
+		types[volume.Type] = true
+	}
+
+	days := []dailyVolume{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		dayTypes, exists := byDate[date]
+		if !exists && !zeroFill {
+			continue
+		}
+
+		if zeroFill {
+			if dayTypes == nil {
+				dayTypes = make(map[string]volumeStats)
+			}
+			for txType := range types {
+				if _, exists := dayTypes[txType]; !exists {
+					dayTypes[txType] = volumeStats{}
+				}
+			}
+		}
+
+		days = append(days, dailyVolume{Date: date, Types: dayTypes})
+	}
+
+	response := map[string]any{
+		"from": from.Format("2006-01-02"),
+		"to":   to.Format("2006-01-02"),
+		"days": days,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showLifetimeImpactHandler моделирует изменение срока жизни баллов: сколько баллов программы
+// сгорит в ближайшие days дней сейчас и при сроке жизни lifetime_days. С from_lifetime_days
+// пересчитываются только начисления с этим сроком (например, только выданные со сроком по умолчанию)
+func (app *application) showLifetimeImpactHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+	lifetimeDays := app.readInt(qs, "lifetime_days", 0, v)
+	fromLifetimeDays := app.readInt(qs, "from_lifetime_days", 0, v)
+	days := app.readInt(qs, "days", 30, v)
+	v.Check(lifetimeDays > 0, "lifetime_days", "must be positive")
+	v.Check(fromLifetimeDays >= 0, "from_lifetime_days", "must not be negative")
+	v.Check(days > 0, "days", "must be positive")
+	v.Check(days <= 366, "days", "must not be more than 366")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	impact, err := app.models.BonusEntries.GetLifetimeImpact(r.Context(), days, lifetimeDays, fromLifetimeDays)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := map[string]any{
+		"days":               days,
+		"lifetime_days":      lifetimeDays,
+		"from_lifetime_days": fromLifetimeDays,
+		"recomputed_entries": impact.Entries,
+		"current_expiring":   data.Points(impact.Current),
+		"projected_expiring": data.Points(impact.Projected),
+		"net_change":         data.Points(impact.Projected - impact.Current),
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showBalanceDistributionHandler возвращает перцентили и среднее активных балансов пользователей,
+// чтобы оценить концентрацию баллов. На пустой программе users равен 0, а значения - null
+func (app *application) showBalanceDistributionHandler(w http.ResponseWriter, r *http.Request) {
+	distribution, err := app.models.BonusEntries.GetBalanceDistribution(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := map[string]any{
+		"users": distribution.Users,
+		"p50":   distribution.P50,
+		"p90":   distribution.P90,
+		"p99":   distribution.P99,
+		"mean":  distribution.Mean,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestExpiringLiability(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	// Полдень по UTC, чтобы дата сгорания не зависела от часового пояса сессии БД
+	y, m, d := time.Now().UTC().AddDate(0, 0, -1).Date()
+	base := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	day := func(lifetimeDays int) string {
+		return base.AddDate(0, 0, lifetimeDays).Format("2006-01-02")
+	}
+
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	insertEntry(t, app, alice, 10, base, 3)
+	insertEntry(t, app, alice, 5, base, 6)
+	insertEntry(t, app, bob, 7, base, 3)
+	insertEntry(t, app, bob, 3, base, 41)                     // за пределами окна
+	insertEntry(t, app, carol, 4, base.AddDate(0, 0, -10), 5) // уже сгорело
+
+	var response struct {
+		Days     int `json:"days"`
+		Total    int `json:"total"`
+		Expiring []struct {
+			Date   string `json:"date"`
+			Amount int    `json:"amount"`
+		} `json:"expiring"`
+	}
+	ts.mustGet(t, "/v1/analytics/expiring?days=30", &response)
+
+	want := []struct {
+		date   string
+		amount int
+	}{
+		{day(3), 17},
+		{day(6), 5},
+	}
+
+	if response.Total != 22 {
+		t.Errorf("got total %d; want 22", response.Total)
+	}
+	if len(response.Expiring) != len(want) {
+		t.Fatalf("got %d days; want %d: %+v", len(response.Expiring), len(want), response.Expiring)
+	}
+	for i, w := range want {
+		got := response.Expiring[i]
+		if got.Date != w.date || got.Amount != w.amount {
+			t.Errorf("day %d: got %s %d; want %s %d", i, got.Date, got.Amount, w.date, w.amount)
+		}
+	}
+}
+
+func TestDailyVolume(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	y, m, d := time.Now().UTC().AddDate(0, 0, -3).Date()
+	first := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	third := first.AddDate(0, 0, 2)
+
+	userId := uuid.New()
+	logTransaction(t, app, userId, "deposit", 10, first)
+	logTransaction(t, app, userId, "deposit", 20, first.Add(time.Hour))
+	logTransaction(t, app, userId, "withdrawal", -5, first.Add(2*time.Hour))
+	logTransaction(t, app, userId, "deposit", 7, third)
+
+	url := fmt.Sprintf("/v1/analytics/volume?from=%s&to=%s", first.Format("2006-01-02"), third.Format("2006-01-02"))
+
+	tests := []struct {
+		name     string
+		zeroFill bool
+		want     []dailyVolume
+	}{
+		{
+			name: "empty days omitted",
+			want: []dailyVolume{
+				{Date: first.Format("2006-01-02"), Types: map[string]volumeStats{"deposit": {2, 30}, "withdrawal": {1, 5}}},
+				{Date: third.Format("2006-01-02"), Types: map[string]volumeStats{"deposit": {1, 7}}},
+			},
+		},
+		{
+			name:     "zero filled",
+			zeroFill: true,
+			want: []dailyVolume{
+				{Date: first.Format("2006-01-02"), Types: map[string]volumeStats{"deposit": {2, 30}, "withdrawal": {1, 5}}},
+				{Date: first.AddDate(0, 0, 1).Format("2006-01-02"), Types: map[string]volumeStats{"deposit": {}, "withdrawal": {}}},
+				{Date: third.Format("2006-01-02"), Types: map[string]volumeStats{"deposit": {1, 7}, "withdrawal": {}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Days []dailyVolume `json:"days"`
+			}
+			ts.mustGet(t, fmt.Sprintf("%s&zero_fill=%t", url, tt.zeroFill), &response)
+
+			if !reflect.DeepEqual(response.Days, tt.want) {
+				t.Errorf("got %+v; want %+v", response.Days, tt.want)
+			}
+		})
+	}
+}
+
+func TestLifetimeImpact(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	now := time.Now()
+	userId := uuid.New()
+	insertEntry(t, app, userId, 10, now.AddDate(0, 0, -25), 30) // сгорит через 5 дней
+	insertEntry(t, app, userId, 20, now.AddDate(0, 0, -2), 30)  // через 28 дней
+	insertEntry(t, app, userId, 30, now.AddDate(0, 0, -20), 25) // через 5 дней
+	insertEntry(t, app, userId, 40, now.AddDate(0, 0, -40), 45) // через 5 дней
+
+	tests := []struct {
+		query     string
+		entries   int
+		current   int
+		projected int
+	}{
+		// Со сроком 45 дней вне недели остаются только записи со сроком 45
+		{query: "lifetime_days=45&days=7", entries: 4, current: 80, projected: 40},
+		// Пересчитываются только записи со сроком 30, запись со сроком 25 сгорает как раньше
+		{query: "lifetime_days=45&from_lifetime_days=30&days=7", entries: 2, current: 80, projected: 70},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var response struct {
+				RecomputedEntries int `json:"recomputed_entries"`
+				CurrentExpiring   int `json:"current_expiring"`
+				ProjectedExpiring int `json:"projected_expiring"`
+				NetChange         int `json:"net_change"`
+			}
+			ts.mustGet(t, "/v1/analytics/lifetime-impact?"+tt.query, &response)
+
+			if response.RecomputedEntries != tt.entries || response.CurrentExpiring != tt.current || response.ProjectedExpiring != tt.projected {
+				t.Errorf("got %+v; want %d entries, current %d, projected %d", response, tt.entries, tt.current, tt.projected)
+			}
+			if response.NetChange != tt.projected-tt.current {
+				t.Errorf("got net_change %d; want %d", response.NetChange, tt.projected-tt.current)
+			}
+		})
+	}
+}
+
+func TestBalanceDistribution(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	type distribution struct {
+		Users int      `json:"users"`
+		P50   *float64 `json:"p50"`
+		P90   *float64 `json:"p90"`
+		P99   *float64 `json:"p99"`
+		Mean  *float64 `json:"mean"`
+	}
+
+	// В пустой программе перцентилей нет
+	var empty distribution
+	ts.mustGet(t, "/v1/analytics/balance-distribution", &empty)
+	if empty.Users != 0 || empty.P50 != nil || empty.P90 != nil || empty.P99 != nil || empty.Mean != nil {
+		t.Errorf("empty program: got %+v; want 0 users and null values", empty)
+	}
+
+	// Балансы 10, 20, ..., 100; последний складывается из двух записей
+	for i := 1; i <= 9; i++ {
+		insertEntry(t, app, uuid.New(), i*10, time.Now(), 30)
+	}
+	top := uuid.New()
+	insertEntry(t, app, top, 60, time.Now(), 30)
+	insertEntry(t, app, top, 40, time.Now(), 30)
+	// Сгоревшие баллы не учитываются
+	insertEntry(t, app, uuid.New(), 1000, time.Now().AddDate(0, 0, -40), 30)
+
+	var got distribution
+	ts.mustGet(t, "/v1/analytics/balance-distribution", &got)
+
+	if got.Users != 10 {
+		t.Errorf("got %d users; want 10", got.Users)
+	}
+	for _, tt := range []struct {
+		name  string
+		value *float64
+		want  float64
+	}{
+		{"p50", got.P50, 55},
+		{"p90", got.P90, 91},
+		{"p99", got.P99, 99.1},
+		{"mean", got.Mean, 55},
+	} {
+		if tt.value == nil {
+			t.Errorf("got no %s", tt.name)
+			continue
+		}
+		if math.Abs(*tt.value-tt.want) > 1e-9 {
+			t.Errorf("got %s %v; want %v", tt.name, *tt.value, tt.want)
+		}
+	}
+}
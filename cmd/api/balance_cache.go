@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+// cachedBalance - баланс пользователя, который отдается до validUntil: ближайшего сгорания его записей,
+// но не дольше ttl кэша после чтения из БД
+type cachedBalance struct {
+	balance    int
+	validUntil time.Time
+}
+
+// balanceCache - необязательная проекция активных балансов в памяти для частых запросов баланса.
+// Прогревается при запуске, после каждой закоммиченной операции забывает балансы ее пользователей,
+// а при промахе или истекшей записи баланс читается из БД.
+// Кэш видит только операции своей реплики: операцию на другой реплике он заметит, когда истечет ttl,
+// поэтому ttl ограничивает, насколько устаревшим может быть отданный баланс.
+// Отключенный кэш ничего не хранит, и все запросы идут в БД
+type balanceCache struct {
+	enabled bool
+	ttl     time.Duration
+	model   data.BonusEntryModel
+
+	mu       sync.RWMutex
+	balances map[uuid.UUID]cachedBalance
+	// epoch увеличивается при каждом изменении, чтобы баланс, прочитанный из БД до операции,
+	// не перезаписал баланс после нее
+	epoch uint64
+}
+
+func newBalanceCache(enabled bool, ttl time.Duration, model data.BonusEntryModel) *balanceCache {
+	return &balanceCache{
+		enabled:  enabled,
+		ttl:      ttl,
+		model:    model,
+		balances: make(map[uuid.UUID]cachedBalance),
+	}
+}
+
+// warm загружает активные балансы всех пользователей
+func (c *balanceCache) warm(ctx context.Context) (int, error) {
+	if !c.enabled {
+		return 0, nil
+	}
+
+	c.mu.RLock()
+	epoch := c.epoch
+	c.mu.RUnlock()
+
+	balances, err := c.model.GetAllActiveBalances(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, balance := range balances {
+		c.fill(balance, epoch)
+	}
+
+	return len(balances), nil
+}
+
+// get возвращает баланс из кэша, а при промахе читает его из БД и запоминает
+func (c *balanceCache) get(ctx context.Context, userId uuid.UUID) (int, error) {
+	if !c.enabled {
+		return c.model.GetTotalBalance(ctx, userId, "")
+	}
+
+	c.mu.RLock()
+	cached, ok := c.balances[userId]
+	epoch := c.epoch
+	c.mu.RUnlock()
+
+	if ok && time.Now().Before(cached.validUntil) {
+		return cached.balance, nil
+	}
+
+	balance, err := c.model.GetActiveBalance(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	c.fill(balance, epoch)
+
+	return balance.Balance, nil
+}
+
+// fill запоминает баланс, прочитанный из БД, если с момента чтения ничего не менялось
+func (c *balanceCache) fill(balance *data.ActiveBalance, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.epoch != epoch {
+		return
+	}
+
+	cached := cachedBalance{balance: balance.Balance, validUntil: time.Now().Add(c.ttl)}
+	if balance.NextExpiry != nil && balance.NextExpiry.Before(cached.validUntil) {
+		cached.validUntil = *balance.NextExpiry
+	}
+	c.balances[balance.UserId] = cached
+}
+
+// forget сбрасывает балансы пользователей после закоммиченной операции, и следующий запрос
+// прочитает их из БД. Записывать сюда баланс из транзакции нельзя: коммиты разных запросов
+// доходят до кэша в произвольном порядке, и более старый баланс мог бы перезаписать новый.
+// Увеличение epoch отбрасывает чтения из БД, начатые до коммита
+func (c *balanceCache) forget(userIds ...uuid.UUID) {
+	if !c.enabled {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for _, userId := range userIds {
+		delete(c.balances, userId)
+	}
+}
+
+// invalidate сбрасывает весь кэш, например после прохода сгорания баллов
+func (c *balanceCache) invalidate() {
+	if !c.enabled {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	clear(c.balances)
+}
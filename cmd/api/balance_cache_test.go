@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestBalanceCacheEpoch(t *testing.T) {
+	cache := newBalanceCache(true, time.Hour, data.BonusEntryModel{})
+	a, b := uuid.New(), uuid.New()
+
+	cache.fill(&data.ActiveBalance{UserId: a, Balance: 10}, 0)
+	cache.fill(&data.ActiveBalance{UserId: b, Balance: 20}, 0)
+	if len(cache.balances) != 2 {
+		t.Fatalf("got %d cached balances; want 2", len(cache.balances))
+	}
+
+	// Баланс, прочитанный до операции, не должен попасть в кэш после нее
+	cache.forget(a)
+	cache.fill(&data.ActiveBalance{UserId: a, Balance: 10}, 0)
+	if _, ok := cache.balances[a]; ok {
+		t.Error("got a stale balance cached after forget")
+	}
+	if _, ok := cache.balances[b]; !ok {
+		t.Error("got the balance of another user forgotten")
+	}
+
+	cache.fill(&data.ActiveBalance{UserId: a, Balance: 5}, cache.epoch)
+	if got := cache.balances[a].balance; got != 5 {
+		t.Errorf("got cached balance %d; want 5", got)
+	}
+
+	cache.invalidate()
+	if len(cache.balances) != 0 {
+		t.Errorf("got %d cached balances after invalidate; want 0", len(cache.balances))
+	}
+}
+
+func TestBalanceCacheTTL(t *testing.T) {
+	cache := newBalanceCache(true, time.Hour, data.BonusEntryModel{})
+	now := time.Now()
+	soon, late := now.Add(10*time.Minute), now.Add(2*time.Hour)
+
+	tests := []struct {
+		name       string
+		nextExpiry *time.Time
+		want       time.Time
+	}{
+		{name: "nothing expires", nextExpiry: nil, want: now.Add(time.Hour)},
+		{name: "expiry before the ttl", nextExpiry: &soon, want: soon},
+		{name: "expiry after the ttl", nextExpiry: &late, want: now.Add(time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userId := uuid.New()
+			cache.fill(&data.ActiveBalance{UserId: userId, Balance: 10, NextExpiry: tt.nextExpiry}, cache.epoch)
+
+			got := cache.balances[userId].validUntil
+			if got.Sub(tt.want).Abs() > time.Second {
+				t.Errorf("got cached until %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalanceCache(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.balanceCache = true
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	insertEntry(t, app, userId, 100, time.Now().AddDate(0, 0, -1), 30)
+	// Более позднее начисление, списание его не затронет
+	late := insertEntry(t, app, userId, 20, time.Now(), 30)
+
+	if _, err := app.balances.warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	balance := func() int {
+		t.Helper()
+
+		var response struct {
+			Balance int `json:"balance"`
+		}
+		ts.mustGet(t, fmt.Sprintf("/v1/users/%s/balance", userId), &response)
+		return response.Balance
+	}
+
+	if got := balance(); got != 120 {
+		t.Fatalf("got balance %d; want 120", got)
+	}
+
+	withdraw(t, ts, userId, 30)
+	if got := balance(); got != 90 {
+		t.Errorf("after withdrawal: got balance %d; want 90", got)
+	}
+
+	// Запись сгорает в БД в обход кэша: пока проход сгорания не сбросил кэш, баланс отдается из памяти
+	_, err := db.Exec(`UPDATE bonus_entries SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1`, late.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(); got != 90 {
+		t.Fatalf("before sweep: got balance %d; want the cached 90", got)
+	}
+
+	if _, _, err = app.sweeper.sweep(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(); got != 70 {
+		t.Errorf("after sweep: got balance %d; want 70", got)
+	}
+}
+
+func TestBalanceCacheOtherReplica(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.balanceCache = true
+	cfg.balanceCacheTTL = time.Second
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 100)
+
+	balance := func() int {
+		t.Helper()
+
+		var response struct {
+			Balance int `json:"balance"`
+		}
+		ts.mustGet(t, fmt.Sprintf("/v1/users/%s/balance", userId), &response)
+		return response.Balance
+	}
+
+	if got := balance(); got != 100 {
+		t.Fatalf("got balance %d; want 100", got)
+	}
+
+	// Начисление другой реплики попадает в БД в обход кэша этой реплики
+	insertEntry(t, app, userId, 50, time.Now(), 30)
+	if got := balance(); got != 100 {
+		t.Fatalf("within the ttl: got balance %d; want the cached 100", got)
+	}
+
+	time.Sleep(cfg.balanceCacheTTL)
+	if got := balance(); got != 150 {
+		t.Errorf("after the ttl: got balance %d; want 150", got)
+	}
+}
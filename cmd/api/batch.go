@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// maxBatchSize - максимальное число транзакций в одном пакете
+const maxBatchSize = 1000
+
+type batchItemReport struct {
+	Index  int               `json:"index"`
+	Valid  bool              `json:"valid"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// validateBatchHandler проверяет пакет транзакций без обращения к БД и возвращает отчет по каждой позиции
+func (app *application) validateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var batch []transactionIn
+	if err := app.readJSONTolerant(w, r, &batch, app.config.maxBatchRequestBody, app.toleratedFields...); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(batch) > 0, "transactions", "must contain at least one transaction")
+	v.Check(len(batch) <= maxBatchSize, "transactions", fmt.Sprintf("must not contain more than %d transactions", maxBatchSize))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	items, valid := app.validateBatch(batch)
+
+	response := map[string]any{
+		"valid": valid,
+		"items": items,
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateBatch проверяет каждую транзакцию пакета и повторы одного импорта. Одинаковые позиции
+// без external_reference допустимы (например, два одинаковых начисления одному пользователю),
+// дубликатами считаются только позиции с одним непустым external_reference для того же
+// пользователя и источника. Пользователь сравнивается по разобранному uuid, поэтому разные записи
+// одного id (регистр, фигурные скобки, urn:uuid:) считаются одним пользователем.
+// Возвращает отчет по каждой позиции и признак, что весь пакет корректен
+func (app *application) validateBatch(batch []transactionIn) ([]batchItemReport, bool) {
+	type itemKey struct {
+		userId      uuid.UUID
+		source      string
+		externalRef string
+	}
+	seen := make(map[itemKey]int, len(batch))
+
+	valid := true
+	items := make([]batchItemReport, len(batch))
+	for i := range batch {
+		itemValidator := validator.New()
+		app.validateTransaction(itemValidator, &batch[i])
+
+		// Позиция с некорректным user_id уже отклонена и ни с чем не сравнивается
+		userId, err := uuid.Parse(batch[i].UserId)
+		if err == nil && batch[i].ExternalReference != "" {
+			key := itemKey{userId: userId, source: batch[i].Source, externalRef: batch[i].ExternalReference}
+			if first, exists := seen[key]; exists {
+				itemValidator.AddError("external_reference", fmt.Sprintf("duplicates transaction %d", first))
+			} else {
+				seen[key] = i
+			}
+		}
+
+		items[i] = batchItemReport{
+			Index:  i,
+			Valid:  itemValidator.Valid(),
+			Errors: itemValidator.Errors,
+		}
+		if !itemValidator.Valid() {
+			valid = false
+		}
+	}
+
+	return items, valid
+}
+
+// batchItemError - ошибка выполнения позиции пакета; весь пакет при этом откатывается
+type batchItemError struct {
+	index int
+	err   error
+}
+
+func (e *batchItemError) Error() string {
+	return fmt.Sprintf("transaction %d: %v", e.index, e.err)
+}
+
+func (e *batchItemError) Unwrap() error {
+	return e.err
+}
+
+// batchBalance - баланс пользователя после выполнения всего пакета
+type batchBalance struct {
+	UserId  uuid.UUID   `json:"user_id"`
+	Balance data.Points `json:"balance"`
+}
+
+// createBatchHandler выполняет пакет транзакций атомарно: все позиции выполняются в одной транзакции БД,
+// и ошибка любой из них откатывает весь пакет. Пользователи всех позиций блокируются заранее
+// в одном порядке, поэтому пакеты не взаимоблокируются с переводами и друг с другом
+func (app *application) createBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var batch []transactionIn
+	if err := app.readJSONTolerant(w, r, &batch, app.config.maxBatchRequestBody, app.toleratedFields...); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(batch) > 0, "transactions", "must contain at least one transaction")
+	v.Check(len(batch) <= maxBatchSize, "transactions", fmt.Sprintf("must not contain more than %d transactions", maxBatchSize))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if items, valid := app.validateBatch(batch); !valid {
+		invalid := make([]batchItemReport, 0, len(items))
+		for _, item := range items {
+			if !item.Valid {
+				invalid = append(invalid, item)
+			}
+		}
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, map[string]any{"items": invalid})
+		return
+	}
+
+	ops := make([]*transactionOp, len(batch))
+	senders := make(map[uuid.UUID]bool)
+	for i := range batch {
+		userId, _ := uuid.Parse(batch[i].UserId)
+
+		if !app.flags.enabled(transactionTypeFlags[app.types[batch[i].Type]]) {
+			app.featureDisabledResponse(w, r)
+			return
+		}
+
+		op, err := app.newTransactionOp(r.Context(), &batch[i], userId)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		ops[i] = op
+		senders[userId] = true
+	}
+
+	// Пакет занимает слот каждого пользователя, от имени которого выполняются его позиции
+	acquired := make([]uuid.UUID, 0, len(senders))
+	defer func() {
+		for _, id := range acquired {
+			app.userLimiter.release(id)
+		}
+	}()
+	for id := range senders {
+		if !app.userLimiter.acquire(id) {
+			app.tooManyConcurrentRequestsResponse(w, r)
+			return
+		}
+		acquired = append(acquired, id)
+	}
+
+	lockIds := batchLockIds(ops)
+
+	var (
+		responses []map[string]any
+		balances  []batchBalance
+	)
+	run := func() error {
+		var err error
+		responses, balances, err = app.runBatch(r.Context(), ops, lockIds)
+		return err
+	}
+
+	// Пакет с несколькими пользователями может взаимоблокироваться так же, как перевод
+	var err error
+	if len(lockIds) > 1 {
+		err = app.retryOnDeadlock(r.Context(), run)
+	} else {
+		err = run()
+	}
+
+	if err != nil {
+		var itemErr *batchItemError
+		switch {
+		case errors.As(err, &itemErr) && errors.Is(err, data.ErrInsufficientFunds):
+			app.batchItemFailedResponse(w, r, http.StatusBadRequest, itemErr)
+		case errors.As(err, &itemErr) && errors.Is(err, data.ErrDuplicateReference):
+			app.batchItemFailedResponse(w, r, http.StatusConflict, itemErr)
+		case errors.As(err, &itemErr) && errors.Is(err, errMultiplyOverflow):
+			app.batchItemFailedResponse(w, r, http.StatusUnprocessableEntity, itemErr)
+		case errors.Is(err, errDeadlockRetriesExhausted):
+			app.deadlockRetriesExhaustedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.balances.forget(lockIds...)
+
+	response := map[string]any{
+		"items":    responses,
+		"balances": balances,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// batchLockIds возвращает всех пользователей пакета без повторов в порядке блокировки
+func batchLockIds(ops []*transactionOp) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, op := range ops {
+		for _, id := range op.lockIds() {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sortUserIds(ids)
+	return ids
+}
+
+// runBatch выполняет все позиции пакета в одной транзакции БД. Возвращает ответ по каждой позиции,
+// и итоговые балансы затронутых пользователей
+func (app *application) runBatch(ctx context.Context, ops []*transactionOp, lockIds []uuid.UUID) (_ []map[string]any, _ []batchBalance, err error) {
+	ctx, span := tracer.Start(ctx, "db.transaction", trace.WithAttributes(
+		attribute.String("type", "batch"),
+		attribute.Int("items", len(ops)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	for _, id := range lockIds {
+		if err = app.models.BonusEntries.LockUser(ctx, tx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	responses := make([]map[string]any, len(ops))
+	for i, op := range ops {
+		response, err := app.applyTransaction(ctx, tx, op)
+		if err != nil {
+			return nil, nil, &batchItemError{index: i, err: err}
+		}
+		response["index"] = i
+		responses[i] = response
+	}
+
+	balances := make([]batchBalance, len(lockIds))
+	for i, id := range lockIds {
+		balance, err := app.models.BonusEntries.GetTotalBalanceTx(ctx, tx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		balances[i] = batchBalance{UserId: id, Balance: data.Points(balance)}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return responses, balances, nil
+}
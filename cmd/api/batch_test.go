@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+func TestValidateBatch(t *testing.T) {
+	// Проверка пакета не обращается к БД, поэтому приложение собирается без нее
+	app := newTestApplication(t, testConfig(), nil)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.NewString()
+	batch := []map[string]any{
+		{"user_id": userId, "amount": 10, "type": "deposit"},
+		{"user_id": "not-a-uuid", "amount": 10, "type": "deposit"},
+		{"user_id": userId, "amount": 0, "type": "deposit"},
+		{"user_id": userId, "amount": 10, "type": "bogus"},
+		{"user_id": userId, "amount": 10, "type": "deposit"},
+		{"user_id": userId, "amount": 10, "type": "deposit", "external_reference": "import-1"},
+		{"user_id": userId, "amount": 20, "type": "deposit", "external_reference": "import-1"},
+		{"user_id": userId, "amount": 10, "type": "deposit", "lifetime_days": -1},
+		// Тот же пользователь, записанный иначе, с тем же external_reference - тоже повтор
+		{"user_id": strings.ToUpper(userId), "amount": 10, "type": "deposit", "external_reference": "import-1"},
+		{"user_id": "{" + userId + "}", "amount": 10, "type": "deposit", "external_reference": "import-1"},
+		{"user_id": "urn:uuid:" + userId, "amount": 10, "type": "deposit", "external_reference": "import-1"},
+		// Некорректные user_id не сравниваются между собой
+		{"user_id": "not-a-uuid", "amount": 10, "type": "deposit", "external_reference": "import-2"},
+		{"user_id": "not-a-uuid", "amount": 10, "type": "deposit", "external_reference": "import-2"},
+	}
+
+	// Ожидаемые поля с ошибками по каждой позиции; пустой список - позиция корректна
+	want := [][]string{
+		nil,
+		{"user_id"},
+		{"amount"},
+		{"type"},
+		nil, // повтор позиции 0 без external_reference допустим
+		nil,
+		{"external_reference"},
+		{"lifetime_days"},
+		{"external_reference"},
+		{"external_reference"},
+		{"external_reference"},
+		{"user_id"},
+		{"user_id"},
+	}
+
+	var response struct {
+		Valid bool              `json:"valid"`
+		Items []batchItemReport `json:"items"`
+	}
+	ts.mustPost(t, "/v1/transactions/batch/validate", batch, &response)
+
+	if response.Valid {
+		t.Error("got valid batch; want invalid")
+	}
+	if len(response.Items) != len(batch) {
+		t.Fatalf("got %d items; want %d", len(response.Items), len(batch))
+	}
+
+	for i, item := range response.Items {
+		if item.Index != i {
+			t.Errorf("item %d: got index %d", i, item.Index)
+		}
+		if item.Valid != (len(want[i]) == 0) {
+			t.Errorf("item %d: got valid=%t; want %t", i, item.Valid, len(want[i]) == 0)
+		}
+		if len(item.Errors) != len(want[i]) {
+			t.Errorf("item %d: got errors %v; want %v", i, item.Errors, want[i])
+			continue
+		}
+		for _, key := range want[i] {
+			if _, ok := item.Errors[key]; !ok {
+				t.Errorf("item %d: got errors %v; want an error for %s", i, item.Errors, key)
+			}
+		}
+	}
+}
+
+func TestValidateBatchEmpty(t *testing.T) {
+	app := newTestApplication(t, testConfig(), nil)
+	ts := newTestServer(t, app.routes())
+
+	status, body := ts.postJSON(t, "/v1/transactions/batch/validate", "[]")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
+
+func TestValidateBatchToleratedFields(t *testing.T) {
+	var log lockedBuffer
+	cfg := testConfig()
+	cfg.toleratedFields = "promo_code"
+	app := newTestApplication(t, cfg, nil)
+	app.logger = jsonlog.New(&log, jsonlog.LevelInfo)
+	ts := newTestServer(t, app.routes())
+
+	batch := []map[string]any{
+		{"user_id": uuid.NewString(), "amount": 10, "type": "deposit", "promo_code": "spring"},
+		{"user_id": uuid.NewString(), "amount": 20, "type": "deposit"},
+	}
+
+	var response struct {
+		Valid bool `json:"valid"`
+	}
+	ts.mustPost(t, "/v1/transactions/batch/validate", batch, &response)
+	if !response.Valid {
+		t.Error("got invalid batch; want valid")
+	}
+	if !strings.Contains(log.String(), "deprecation notice") || !strings.Contains(log.String(), `"field":"promo_code"`) {
+		t.Errorf("got log %q; want a deprecation notice for promo_code", log.String())
+	}
+
+	// Поле, которого нет в -tolerated-fields, по-прежнему отклоняется
+	batch[1]["channel"] = "app"
+	status, body := ts.postJSON(t, "/v1/transactions/batch/validate", batch)
+	if status != http.StatusBadRequest {
+		t.Errorf("got status %d; want %d: %s", status, http.StatusBadRequest, body)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// showTimeHandler возвращает время сервера в часовом поясе -timezone и время БД, а также настройки
+// сгорания, чтобы клиент мог сверить свои ожидания о сроках сгорания. Сгорание сравнивается со временем БД,
+// поэтому db_skew показывает, насколько часы БД расходятся с часами сервера
+func (app *application) showTimeHandler(w http.ResponseWriter, r *http.Request) {
+	serverTime := time.Now().In(app.location)
+
+	dbTime, dbTimezone, err := app.models.Clock.Now(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, offset := serverTime.Zone()
+
+	response := map[string]any{
+		"server_time":    serverTime.Format(time.RFC3339Nano),
+		"timezone":       app.location.String(),
+		"utc_offset":     offset,
+		"db_time":        dbTime.Format(time.RFC3339Nano),
+		"db_timezone":    dbTimezone,
+		"db_skew":        dbTime.Sub(serverTime).String(),
+		"sweep_interval": app.config.sweeper.interval.String(),
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"time": response}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShowTime(t *testing.T) {
+	db := newTestDB(t)
+	// Одно соединение, чтобы часовой пояс сессии применился к запросу обработчика
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`SET TIME ZONE 'Europe/Moscow'`); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.timezone = "Asia/Tokyo"
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	var response struct {
+		Time struct {
+			ServerTime    string `json:"server_time"`
+			Timezone      string `json:"timezone"`
+			UTCOffset     int    `json:"utc_offset"`
+			DBTime        string `json:"db_time"`
+			DBTimezone    string `json:"db_timezone"`
+			SweepInterval string `json:"sweep_interval"`
+		} `json:"time"`
+	}
+	ts.mustGet(t, "/v1/time", &response)
+
+	got := response.Time
+	if got.Timezone != "Asia/Tokyo" || got.UTCOffset != 9*60*60 {
+		t.Errorf("got timezone %q, offset %d; want Asia/Tokyo, %d", got.Timezone, got.UTCOffset, 9*60*60)
+	}
+	if got.DBTimezone != "Europe/Moscow" {
+		t.Errorf("got db_timezone %q; want Europe/Moscow", got.DBTimezone)
+	}
+	if got.SweepInterval != "1h0m0s" {
+		t.Errorf("got sweep_interval %q; want 1h0m0s", got.SweepInterval)
+	}
+
+	// Сервер отдает время в поясе -timezone (+09:00), БД - в поясе сессии (+03:00)
+	for name, value := range map[string]struct {
+		time   string
+		offset int
+	}{
+		"server_time": {got.ServerTime, 9 * 60 * 60},
+		"db_time":     {got.DBTime, 3 * 60 * 60},
+	} {
+		parsed, err := time.Parse(time.RFC3339, value.time)
+		if err != nil {
+			t.Errorf("%s: got %q, not RFC3339: %v", name, value.time, err)
+			continue
+		}
+		if _, offset := parsed.Zone(); offset != value.offset {
+			t.Errorf("%s: got offset %d; want %d", name, offset, value.offset)
+		}
+		if skew := time.Since(parsed); skew < -time.Minute || skew > time.Minute {
+			t.Errorf("%s: got %v; want about now", name, parsed)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// applyDiscountHandler оплачивает баллами скидку percent процентов от суммы заказа.
+// Списывается min(баланс, round(order_total*percent/100)), поэтому при недостатке баллов
+// скидка уменьшается, а не отклоняется
+func (app *application) applyDiscountHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		OrderTotal int `json:"order_total"`
+		Percent    int `json:"percent"`
+	}
+	if err = app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.OrderTotal > 0, "order_total", "must be positive")
+	v.Check(input.Percent > 0, "percent", "must be positive")
+	v.Check(input.Percent <= 100, "percent", "must not be more than 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.flags.enabled(flagWithdrawalsEnabled) {
+		app.featureDisabledResponse(w, r)
+		return
+	}
+
+	if !app.userLimiter.acquire(userId) {
+		app.tooManyConcurrentRequestsResponse(w, r)
+		return
+	}
+	defer app.userLimiter.release(userId)
+
+	// Скидка в баллах с округлением до ближайшего целого
+	discount := int((int64(input.OrderTotal)*int64(input.Percent) + 50) / 100)
+
+	tx, err := app.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err = app.models.BonusEntries.LockUser(r.Context(), tx, userId); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	transactionId := uuid.New()
+
+	// Скидка оплачивается баллами всех категорий
+	_, pointsUsed, forfeited, err := app.models.BonusEntries.SpendEntriesUpTo(r.Context(), tx, userId, discount, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = app.journalForfeit(r.Context(), tx, userId, forfeited, transactionId); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	total, err := app.models.BonusEntries.GetTotalBalanceTx(r.Context(), tx, userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	balance := data.Points(total)
+
+	err = app.insertTransaction(r.Context(), tx, &data.Transaction{
+		Id:               transactionId,
+		UserId:           userId,
+		Type:             "discount",
+		Amount:           data.Points(pointsUsed),
+		Delta:            -data.Points(pointsUsed),
+		ResultingBalance: &balance,
+		CorrelationId:    &transactionId,
+		CreatedAt:        time.Now(),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.balances.forget(userId)
+
+	response := map[string]any{
+		"user_id":        userId,
+		"order_total":    data.Points(input.OrderTotal),
+		"percent":        input.Percent,
+		"discount":       data.Points(discount),
+		"points_used":    data.Points(pointsUsed),
+		"balance":        balance,
+		"correlation_id": transactionId,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestApplyDiscount(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name        string
+		balance     int
+		orderTotal  int
+		percent     int
+		discount    int
+		pointsUsed  int
+		wantBalance int
+	}{
+		{name: "balance below discount", balance: 30, orderTotal: 1000, percent: 10, discount: 100, pointsUsed: 30, wantBalance: 0},
+		{name: "discount rounded", balance: 200, orderTotal: 995, percent: 10, discount: 100, pointsUsed: 100, wantBalance: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userId := uuid.New()
+			deposit(t, ts, userId, tt.balance)
+
+			var response struct {
+				Discount   int `json:"discount"`
+				PointsUsed int `json:"points_used"`
+				Balance    int `json:"balance"`
+			}
+			ts.mustPost(t, fmt.Sprintf("/v1/users/%s/apply-discount", userId), map[string]any{
+				"order_total": tt.orderTotal,
+				"percent":     tt.percent,
+			}, &response)
+
+			if response.Discount != tt.discount || response.PointsUsed != tt.pointsUsed || response.Balance != tt.wantBalance {
+				t.Errorf("got discount=%d points_used=%d balance=%d; want %d, %d, %d",
+					response.Discount, response.PointsUsed, response.Balance, tt.discount, tt.pointsUsed, tt.wantBalance)
+			}
+			if balance := balanceOf(t, app, userId); balance != tt.wantBalance {
+				t.Errorf("got stored balance %d; want %d", balance, tt.wantBalance)
+			}
+		})
+	}
+}
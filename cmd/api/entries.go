@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// extendEntryHandler продлевает срок жизни одного начисления на additional_days дней, например
+// чтобы пользователь сохранил баллы, которые скоро сгорят. Новый срок сгорания считается от даты
+// начисления и не может превышать -max-lifetime-days. Продление пишется в журнал как lifetime_extension
+func (app *application) extendEntryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil || id == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		AdditionalDays int `json:"additional_days"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.AdditionalDays > 0, "additional_days", "must be positive")
+	v.Check(input.AdditionalDays <= app.config.limits.maxExtensionDays, "additional_days", fmt.Sprintf("must not be more than %d", app.config.limits.maxExtensionDays))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entry, correlationId, err := app.extendEntry(r.Context(), id, input.AdditionalDays)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEntryNotActive):
+			app.entryNotExtendableResponse(w, r, err)
+		case errors.Is(err, data.ErrLifetimeTooLong):
+			v.AddError("additional_days", fmt.Sprintf("must not extend the lifetime beyond %d days", app.config.limits.maxLifetimeDays))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	response := map[string]any{
+		"entry":          entry,
+		"correlation_id": correlationId,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// extendEntry продлевает запись id и записывает продление в журнал в одной транзакции
+func (app *application) extendEntry(ctx context.Context, id uuid.UUID, days int) (*data.ExtendedEntry, uuid.UUID, error) {
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	entry, err := app.models.BonusEntries.Extend(ctx, tx, id, days, app.config.limits.maxLifetimeDays)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	transactionId := uuid.New()
+	err = app.insertTransaction(ctx, tx, &data.Transaction{
+		Id:            transactionId,
+		UserId:        entry.UserId,
+		Type:          "lifetime_extension",
+		Amount:        entry.Amount,
+		Delta:         0,
+		CorrelationId: &transactionId,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	return entry, transactionId, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestExtendEntry(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	active := insertEntry(t, app, uuid.New(), 10, time.Now(), 30)
+
+	// Запись, переведенная проходом сгорания в статус expired
+	expired := insertEntry(t, app, uuid.New(), 10, time.Now().AddDate(0, 0, -40), 30)
+	if _, _, err := app.sweeper.sweep(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	// Срок записи прошел, но проход сгорания ее еще не обработал
+	overdue := insertEntry(t, app, uuid.New(), 10, time.Now().AddDate(0, 0, -40), 30)
+	// Запись, целиком потраченная списанием
+	spender := uuid.New()
+	spent := insertEntry(t, app, spender, 10, time.Now(), 30)
+	withdraw(t, ts, spender, 10)
+
+	tests := []struct {
+		name         string
+		id           uuid.UUID
+		days         int
+		wantStatus   int
+		wantLifetime int
+	}{
+		{name: "active entry", id: active.Id, days: 10, wantStatus: http.StatusOK, wantLifetime: 40},
+		{name: "past expiry date", id: overdue.Id, days: 10, wantStatus: http.StatusConflict},
+		{name: "expired entry", id: expired.Id, days: 10, wantStatus: http.StatusConflict},
+		{name: "spent entry", id: spent.Id, days: 10, wantStatus: http.StatusConflict},
+		{name: "unknown entry", id: uuid.New(), days: 10, wantStatus: http.StatusNotFound},
+		{name: "no days", id: active.Id, days: 0, wantStatus: http.StatusUnprocessableEntity},
+		{name: "beyond max lifetime", id: active.Id, days: 340, wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := ts.postJSON(t, fmt.Sprintf("/v1/entries/%s/extend", tt.id), map[string]any{"additional_days": tt.days})
+			if status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", status, tt.wantStatus, body)
+			}
+			if status != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Entry data.ExtendedEntry `json:"entry"`
+			}
+			decodeJSON(t, body, &response)
+			if response.Entry.LifetimeDays != tt.wantLifetime {
+				t.Errorf("got lifetime %d; want %d", response.Entry.LifetimeDays, tt.wantLifetime)
+			}
+			want := active.CreatedAt.AddDate(0, 0, tt.wantLifetime)
+			// Время начисления хранится в БД с точностью до секунды
+			if diff := response.Entry.ExpiresAt.Sub(want); diff < -time.Second || diff > time.Second {
+				t.Errorf("got expires_at %v; want %v", response.Entry.ExpiresAt, want)
+			}
+		})
+	}
+}
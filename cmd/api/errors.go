@@ -1,23 +1,70 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+
+	"simple-ledger.itmo.ru/internal/data"
 )
 
+// logError пишет в лог ошибку обработки запроса. Обрыв соединения при отправке ответа
+// логируется отдельно: это не ошибка сервера, и ответ клиенту уже не отправить
+func (app *application) logError(r *http.Request, err error) {
+	var writeErr *responseWriteError
+	if errors.As(err, &writeErr) {
+		app.logger.PrintInfo("client disconnected", map[string]string{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"error":          writeErr.err.Error(),
+		})
+		return
+	}
+
+	app.logger.PrintError(err, map[string]string{
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+	})
+}
+
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	msg := map[string]any{"error": message}
 
 	if err := app.writeJSON(w, status, msg, nil); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		app.logError(r, err)
+
+		var writeErr *responseWriteError
+		if !errors.As(err, &writeErr) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 	}
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, data.ErrQueryTimeout) {
+		app.queryTimeoutResponse(w, r)
+		return
+	}
+
+	app.logError(r, err)
+
+	// Ответ уже частично отправлен, повторная запись заголовков ничего не даст
+	var writeErr *responseWriteError
+	if errors.As(err, &writeErr) {
+		return
+	}
+
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+func (app *application) queryTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "the database is taking too long to respond, retry later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
 	app.errorResponse(w, r, http.StatusNotFound, message)
@@ -35,3 +82,66 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
+
+func (app *application) tooManyConcurrentRequestsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "too many concurrent transactions for this user, retry later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded, retry later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) featureDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this operation is currently disabled"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) reportsBusyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "5")
+	message := "too many reports are being generated, retry later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) sweeperPausedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "expiry sweeper is paused, pass force=true to run it anyway"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) idempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the idempotency key was already used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+func (app *application) duplicateReferenceResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a deposit with this source and external_reference already exists"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) multiplyOverflowResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the bonus would exceed the maximum entry amount of %d points", math.MaxInt32)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+func (app *application) deadlockRetriesExhaustedResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "the operation conflicted with concurrent operations, retry later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) batchItemFailedResponse(w http.ResponseWriter, r *http.Request, status int, itemErr *batchItemError) {
+	message := map[string]any{
+		"index":   itemErr.index,
+		"message": itemErr.err.Error(),
+	}
+	app.errorResponse(w, r, status, message)
+}
+
+func (app *application) reversalRejectedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusConflict, err.Error())
+}
+
+func (app *application) entryNotExtendableResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusConflict, err.Error())
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+func TestServerErrorResponseQueryTimeout(t *testing.T) {
+	app := newTestApplication(t, testConfig(), nil)
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"query timeout", fmt.Errorf("get balance: %w", data.ErrQueryTimeout), http.StatusServiceUnavailable},
+		{"other error", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.serverErrorResponse(rr, httptest.NewRequest(http.MethodGet, "/", nil), tt.err)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if hasRetry := rr.Header().Get("Retry-After") != ""; hasRetry != (tt.wantStatus == http.StatusServiceUnavailable) {
+				t.Errorf("got Retry-After %q", rr.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// TestQueryTimeout замедляет запрос, удерживая блокировку пользователя в другой транзакции,
+// и проверяет, что истечение -db-query-timeout дает 503, а не 500
+func TestQueryTimeout(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.db.queryTimeout = 200 * time.Millisecond
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = app.models.BonusEntries.LockUser(context.Background(), tx, userId); err != nil {
+		t.Fatal(err)
+	}
+
+	status, header, body := ts.request(t, http.MethodPost, "/v1/transactions", map[string]any{"user_id": userId, "amount": 10, "type": "deposit"}, nil)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d: %s", status, http.StatusServiceUnavailable, body)
+	}
+	if header.Get("Retry-After") == "" {
+		t.Error("got no Retry-After header")
+	}
+}
+
+// failingWriter - ResponseWriter, у которого обрывается соединение при отправке тела ответа
+type failingWriter struct {
+	header      http.Header
+	writeHeader int
+}
+
+func (w *failingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *failingWriter) WriteHeader(status int) {
+	w.writeHeader++
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	return 0, errBrokenPipe
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+func TestResponseWriteError(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        any
+		disconnect  bool
+		wantLevel   string
+		wantMessage string
+	}{
+		{name: "client disconnect", data: map[string]any{"balance": 10}, disconnect: true, wantLevel: "INFO", wantMessage: "client disconnected"},
+		{name: "marshal error", data: map[string]any{"balance": make(chan int)}, wantLevel: "ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			app := newTestApplication(t, testConfig(), nil)
+			app.logger = jsonlog.New(&log, jsonlog.LevelInfo)
+
+			w := &failingWriter{header: http.Header{}}
+			err := app.writeJSON(w, http.StatusOK, tt.data, nil)
+			if err == nil {
+				t.Fatal("got no error from writeJSON")
+			}
+
+			var writeErr *responseWriteError
+			if errors.As(err, &writeErr) != tt.disconnect {
+				t.Errorf("got error %v; want responseWriteError %t", err, tt.disconnect)
+			}
+			if tt.disconnect && !errors.Is(err, errBrokenPipe) {
+				t.Errorf("got error %v; want it to wrap %v", err, errBrokenPipe)
+			}
+
+			writes := w.writeHeader
+			app.serverErrorResponse(w, httptest.NewRequest(http.MethodGet, "/", nil), err)
+
+			// После обрыва соединения ответ с ошибкой сервера уже не отправляется
+			if tt.disconnect && w.writeHeader != writes {
+				t.Errorf("got %d more WriteHeader calls after the disconnect; want 0", w.writeHeader-writes)
+			}
+
+			var entry struct {
+				Level   string `json:"level"`
+				Message string `json:"message"`
+			}
+			if err := json.NewDecoder(&log).Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Level != tt.wantLevel {
+				t.Errorf("got log level %q; want %q", entry.Level, tt.wantLevel)
+			}
+			if tt.wantMessage != "" && entry.Message != tt.wantMessage {
+				t.Errorf("got log message %q; want %q", entry.Message, tt.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+const (
+	flagDepositsEnabled    = "deposits_enabled"
+	flagWithdrawalsEnabled = "withdrawals_enabled"
+	flagMultiplyEnabled    = "multiply_enabled"
+	flagTransfersEnabled   = "transfers_enabled"
+)
+
+// defaultFlags - известные флаги и их значения, пока они не заданы в БД
+var defaultFlags = map[string]bool{
+	flagDepositsEnabled:    true,
+	flagWithdrawalsEnabled: true,
+	flagMultiplyEnabled:    true,
+	flagTransfersEnabled:   true,
+}
+
+// transactionTypeFlags - флаг, который разрешает каждый тип транзакции
+var transactionTypeFlags = map[string]string{
+	typeDeposit:         flagDepositsEnabled,
+	typeWithdrawal:      flagWithdrawalsEnabled,
+	typeMultiplyPercent: flagMultiplyEnabled,
+	typeTransfer:        flagTransfersEnabled,
+}
+
+// featureFlags - кэш флагов из БД, который периодически обновляется
+type featureFlags struct {
+	mu     sync.RWMutex
+	values map[string]bool
+	model  data.FlagModel
+}
+
+func newFeatureFlags(model data.FlagModel) *featureFlags {
+	return &featureFlags{
+		values: make(map[string]bool),
+		model:  model,
+	}
+}
+
+// refresh перечитывает флаги из БД
+func (f *featureFlags) refresh(ctx context.Context) error {
+	flags, err := f.model.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]bool, len(flags))
+	for _, flag := range flags {
+		values[flag.Key] = flag.Enabled
+	}
+
+	f.mu.Lock()
+	f.values = values
+	f.mu.Unlock()
+
+	return nil
+}
+
+// enabled возвращает значение флага из кэша или значение по умолчанию
+func (f *featureFlags) enabled(key string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if enabled, ok := f.values[key]; ok {
+		return enabled
+	}
+	return defaultFlags[key]
+}
+
+// refreshFlagsPeriodically обновляет кэш флагов с заданным интервалом
+func (app *application) refreshFlagsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := app.flags.refresh(context.Background()); err != nil {
+			app.logger.PrintError(err, map[string]string{"task": "refresh feature flags"})
+		}
+	}
+}
+
+func (app *application) listFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	flags := make(map[string]bool, len(defaultFlags))
+	for key := range defaultFlags {
+		flags[key] = app.flags.enabled(key)
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]any{"flags": flags}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) setFlagHandler(w http.ResponseWriter, r *http.Request) {
+	key := httprouter.ParamsFromContext(r.Context()).ByName("key")
+	if _, known := defaultFlags[key]; !known {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Enabled != nil, "enabled", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	flag := &data.FeatureFlag{Key: key, Enabled: *input.Enabled}
+	if err := app.models.Flags.Set(r.Context(), flag); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Обновляем кэш сразу, не дожидаясь периодического обновления
+	if err := app.flags.refresh(r.Context()); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]any{"flag": flag}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
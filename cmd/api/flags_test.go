@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestFeatureFlagDefaults(t *testing.T) {
+	flags := newFeatureFlags(data.FlagModel{})
+
+	for key := range defaultFlags {
+		if !flags.enabled(key) {
+			t.Errorf("%s: got disabled; want enabled by default", key)
+		}
+	}
+	if flags.enabled("unknown_flag") {
+		t.Error("got an unknown flag enabled")
+	}
+}
+
+func TestSetFlagAtRuntime(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	body := map[string]any{"user_id": userId, "amount": 10, "type": "deposit"}
+
+	setFlag := func(enabled bool) {
+		t.Helper()
+		status, _, respBody := ts.request(t, http.MethodPut, "/v1/admin/flags/"+flagDepositsEnabled, map[string]any{"enabled": enabled}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("set flag: got status %d: %s", status, respBody)
+		}
+	}
+
+	ts.mustPost(t, "/v1/transactions", body, nil)
+
+	setFlag(false)
+	if status, _ := ts.postJSON(t, "/v1/transactions", body); status != http.StatusForbidden {
+		t.Errorf("deposit with deposits disabled: got status %d; want %d", status, http.StatusForbidden)
+	}
+	// Остальные типы флаг не затрагивает
+	withdraw(t, ts, userId, 5)
+
+	setFlag(true)
+	ts.mustPost(t, "/v1/transactions", body, nil)
+
+	if balance := balanceOf(t, app, userId); balance != 15 {
+		t.Errorf("got balance %d; want 15", balance)
+	}
+}
+
+// TestFlagRefresh проверяет, что флаг, измененный в БД другой репликой, вступает в силу
+// после обновления кэша без перезапуска
+func TestFlagRefresh(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+
+	err := app.models.Flags.Set(context.Background(), &data.FeatureFlag{Key: flagMultiplyEnabled, Enabled: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !app.flags.enabled(flagMultiplyEnabled) {
+		t.Fatal("got the flag disabled before the cache was refreshed")
+	}
+
+	if err = app.flags.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if app.flags.enabled(flagMultiplyEnabled) {
+		t.Error("got the flag enabled after refresh; want disabled")
+	}
+}
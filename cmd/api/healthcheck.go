@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// version задается при сборке: go build -ldflags "-X main.version=1.2.3" ./cmd/api
+var version = "dev"
+
+// healthcheckHandler сообщает версию сервиса и доступность БД: 200, если БД отвечает, иначе 503
+func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	status := http.StatusOK
+	health := map[string]any{
+		"status":      "available",
+		"environment": app.config.env,
+		"version":     version,
+		"database":    "available",
+	}
+
+	if err := app.db.PingContext(ctx); err != nil {
+		app.logger.PrintError(err, map[string]string{"task": "healthcheck database ping"})
+		status = http.StatusServiceUnavailable
+		health["status"] = "unavailable"
+		health["database"] = "unavailable"
+	}
+
+	if err := app.writeJSON(w, status, health, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,7 +9,12 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"simple-ledger.itmo.ru/internal/validator"
 )
 
 func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
@@ -22,6 +28,22 @@ func (app *application) readIDParam(r *http.Request) (uuid.UUID, error) {
 	return id, nil
 }
 
+// responseWriteError - ошибка отправки уже сформированного ответа, обычно клиент отключился.
+// Заголовки к этому моменту уже отправлены, поэтому ответить ошибкой сервера нельзя
+type responseWriteError struct {
+	err error
+}
+
+func (e *responseWriteError) Error() string {
+	return "write response: " + e.err.Error()
+}
+
+func (e *responseWriteError) Unwrap() error {
+	return e.err
+}
+
+// writeJSON отправляет data в формате JSON. Ошибка сериализации возвращается до отправки заголовков,
+// ошибка записи в соединение - как *responseWriteError
 func (app *application) writeJSON(w http.ResponseWriter, status int, data any, headers http.Header) error {
 	js, err := json.Marshal(data)
 	if err != nil {
@@ -38,15 +60,20 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data any, h
 	w.WriteHeader(status)
 
 	if _, err = w.Write(js); err != nil {
-		return err
+		return &responseWriteError{err: err}
 	}
 
 	return nil
 }
 
+// readJSON читает тело запроса не больше -max-request-body
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
-	maxBytes := 10 * 1024 // 10 Kb
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	return app.readJSONLimit(w, r, dst, app.config.maxRequestBody)
+}
+
+// readJSONLimit работает как readJSON, но с размером тела не больше maxBytes, например для пакетов транзакций
+func (app *application) readJSONLimit(w http.ResponseWriter, r *http.Request, dst any, maxBytes int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
@@ -86,3 +113,140 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	}
 	return nil
 }
+
+// readJSONTolerant работает как readJSON, но пропускает перечисленные поля, которые эндпоинт пока
+// не поддерживает. Так новые клиенты могут присылать будущие поля, а остальные неизвестные
+// поля по-прежнему отклоняются. Поля пропускаются в JSON-объекте и в каждом объекте JSON-массива
+// (пакет транзакций). О каждом пропущенном поле пишется предупреждение в лог.
+// Размер тела ограничен maxBytes
+func (app *application) readJSONTolerant(w http.ResponseWriter, r *http.Request, dst any, maxBytes int64, tolerated ...string) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		}
+		return err
+	}
+
+	// Если тело не является JSON-объектом или массивом объектов, ошибку вернет readJSONLimit
+	if len(tolerated) > 0 {
+		var object map[string]json.RawMessage
+		var array []map[string]json.RawMessage
+
+		switch {
+		case json.Unmarshal(body, &object) == nil:
+			if app.dropToleratedFields(r, object, tolerated) {
+				body, err = json.Marshal(object)
+			}
+		case json.Unmarshal(body, &array) == nil:
+			removed := false
+			for _, object := range array {
+				if app.dropToleratedFields(r, object, tolerated) {
+					removed = true
+				}
+			}
+			if removed {
+				body, err = json.Marshal(array)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return app.readJSONLimit(w, r, dst, maxBytes)
+}
+
+// dropToleratedFields удаляет из объекта тела запроса поля tolerated, записывая о каждом предупреждение.
+// Сообщает, было ли что-то удалено
+func (app *application) dropToleratedFields(r *http.Request, fields map[string]json.RawMessage, tolerated []string) bool {
+	removed := false
+	for _, name := range tolerated {
+		if _, exists := fields[name]; exists {
+			app.logger.PrintInfo("deprecation notice: field is not supported yet and was ignored", map[string]string{
+				"request_method": r.Method,
+				"request_url":    r.URL.String(),
+				"field":          name,
+			})
+			delete(fields, name)
+			removed = true
+		}
+	}
+
+	return removed
+}
+
+// readVersion возвращает версию формата ответа из заголовка Accept-Version ("1", "v1", "2", "v2").
+// Без заголовка используется версия 1
+func (app *application) readVersion(r *http.Request, supported int) (int, error) {
+	s := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(r.Header.Get("Accept-Version"))), "v")
+	if s == "" {
+		return 1, nil
+	}
+
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 || version > supported {
+		return 0, fmt.Errorf("unsupported Accept-Version %q", r.Header.Get("Accept-Version"))
+	}
+
+	return version, nil
+}
+
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+
+	return i
+}
+
+// readSpendPreviewLimit читает limit - сколько начислений показать в предпросмотре списания.
+// По умолчанию и не больше -spend-preview-limit; 0 в конфигурации - без ограничения по умолчанию
+func (app *application) readSpendPreviewLimit(qs url.Values, v *validator.Validator) int {
+	maxLimit := app.config.limits.spendPreviewEntries
+	limit := app.readInt(qs, "limit", maxLimit, v)
+	if qs.Get("limit") != "" {
+		v.Check(limit > 0, "limit", "must be positive")
+		v.Check(maxLimit == 0 || limit <= maxLimit, "limit", fmt.Sprintf("must not be more than %d", maxLimit))
+	}
+	return limit
+}
+
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	date, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format")
+		return defaultValue
+	}
+
+	return date
+}
+
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
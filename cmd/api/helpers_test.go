@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+func TestReadJSONTolerant(t *testing.T) {
+	var logs bytes.Buffer
+	app := newTestApplication(t, testConfig(), nil)
+	app.logger = jsonlog.New(&logs, jsonlog.LevelInfo)
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+		wantLog bool
+	}{
+		{
+			name: "known fields",
+			body: `{"user_id": "u1", "amount": 10, "type": "deposit"}`,
+		},
+		{
+			name:    "tolerated field",
+			body:    `{"user_id": "u1", "amount": 10, "type": "deposit", "promo_code": "spring"}`,
+			wantLog: true,
+		},
+		{
+			name:    "unknown field",
+			body:    `{"user_id": "u1", "amount": 10, "type": "deposit", "bogus": 1}`,
+			wantErr: "body contains unknown key \"bogus\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/transactions", strings.NewReader(tt.body))
+			var trxIn transactionIn
+			err := app.readJSONTolerant(httptest.NewRecorder(), r, &trxIn, 1024, "promo_code")
+
+			switch {
+			case tt.wantErr != "":
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("got error %v", err)
+			}
+
+			if trxIn.UserId != "u1" || trxIn.Amount != 10 || trxIn.Type != "deposit" {
+				t.Errorf("got %+v; want the known fields decoded", trxIn)
+			}
+
+			logged := strings.Contains(logs.String(), "deprecation notice") && strings.Contains(logs.String(), `"field":"promo_code"`)
+			if logged != tt.wantLog {
+				t.Errorf("got log %q; want deprecation notice logged: %t", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestReadJSONTolerantArray(t *testing.T) {
+	var logs bytes.Buffer
+	app := newTestApplication(t, testConfig(), nil)
+	app.logger = jsonlog.New(&logs, jsonlog.LevelInfo)
+
+	// Поля убираются из каждой позиции массива, неизвестные поля по-прежнему отклоняются
+	body := `[{"user_id": "u1", "amount": 10, "type": "deposit", "promo_code": "spring"}, {"user_id": "u2", "amount": 20, "type": "deposit"}]`
+	r := httptest.NewRequest(http.MethodPost, "/v1/transactions/batch", strings.NewReader(body))
+	var batch []transactionIn
+	if err := app.readJSONTolerant(httptest.NewRecorder(), r, &batch, 1024, "promo_code"); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(batch) != 2 || batch[0].UserId != "u1" || batch[1].Amount != 20 {
+		t.Errorf("got %+v; want both items decoded", batch)
+	}
+	if !strings.Contains(logs.String(), `"field":"promo_code"`) {
+		t.Errorf("got log %q; want a deprecation notice for promo_code", logs.String())
+	}
+
+	body = `[{"user_id": "u1", "amount": 10, "type": "deposit"}, {"user_id": "u2", "amount": 20, "type": "deposit", "bogus": 1}]`
+	r = httptest.NewRequest(http.MethodPost, "/v1/transactions/batch", strings.NewReader(body))
+	err := app.readJSONTolerant(httptest.NewRecorder(), r, &batch, 1024, "promo_code")
+	if want := "body contains unknown key \"bogus\""; err == nil || err.Error() != want {
+		t.Errorf("got error %v; want %q", err, want)
+	}
+}
+
+func TestNewToleratedFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", list: ""},
+		{name: "spaces and trailing comma", list: " promo_code , channel, ", want: []string{"promo_code", "channel"}},
+		{name: "known field", list: "promo_code,source", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newToleratedFields(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error: %t", err, tt.wantErr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONAmountsAsStrings(t *testing.T) {
+	for _, asStrings := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.amountsAsStrings = asStrings
+		app := newTestApplication(t, cfg, nil)
+
+		rr := httptest.NewRecorder()
+		response := map[string]any{
+			"balance":  data.Points(100),
+			"days":     7,
+			"expiring": []data.ExpiringTotal{{Date: "2026-01-02", Amount: 5}},
+		}
+		if err := app.writeJSON(rr, http.StatusOK, response, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// Строками становятся только суммы баллов, остальные числа и id остаются как есть
+		want := `{"balance":100,"days":7,"expiring":[{"date":"2026-01-02","amount":5}]}`
+		if asStrings {
+			want = `{"balance":"100","days":7,"expiring":[{"date":"2026-01-02","amount":"5"}]}`
+		}
+		if got := strings.TrimSpace(rr.Body.String()); got != want {
+			t.Errorf("amounts-as-strings=%t: got %s; want %s", asStrings, got, want)
+		}
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	app := newTestApplication(t, testConfig(), nil)
+
+	tests := []struct {
+		header  string
+		want    int
+		wantErr bool
+	}{
+		{header: "", want: 1},
+		{header: "1", want: 1},
+		{header: "v2", want: 2},
+		{header: " V2 ", want: 2},
+		{header: "3", wantErr: true},
+		{header: "0", wantErr: true},
+		{header: "latest", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Accept-Version", tt.header)
+			}
+
+			version, err := app.readVersion(r, 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error: %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && version != tt.want {
+				t.Errorf("got version %d; want %d", version, tt.want)
+			}
+		})
+	}
+}
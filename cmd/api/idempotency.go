@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader - заголовок, по которому повтор запроса отличается от нового запроса
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+
+	// idempotencyPruneInterval - как часто удаляются ключи с истекшим сроком хранения
+	idempotencyPruneInterval = time.Hour
+)
+
+// errIdempotencyKeyReused - ключ идемпотентности уже использован с другим телом запроса
+var errIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+// transactionHash - отпечаток запроса для проверки, что ключ идемпотентности повторно используется
+// с тем же запросом. Кроме тела учитывается include=entry: сохраненный ответ содержит запись
+// только при нем, и повтор с другим include получил бы не тот ответ, который запросил.
+// Без include отпечаток совпадает с прежним, и уже сохраненные ключи остаются действительными
+func transactionHash(trxIn *transactionIn, includeEntry bool) (string, error) {
+	js, err := json.Marshal(trxIn)
+	if err != nil {
+		return "", err
+	}
+	if includeEntry {
+		js = append(js, "\ninclude=entry"...)
+	}
+
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// pruneIdempotencyKeysPeriodically удаляет ключи идемпотентности старше -idempotency-key-ttl
+func (app *application) pruneIdempotencyKeysPeriodically() {
+	ticker := time.NewTicker(idempotencyPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := app.models.IdempotencyKeys.DeleteExpired(context.Background())
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": "prune idempotency keys"})
+			continue
+		}
+		if deleted > 0 {
+			app.logger.PrintInfo("pruned expired idempotency keys", map[string]string{"deleted": strconv.FormatInt(deleted, 10)})
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMultiplyIdempotentReplay(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 100)
+
+	body := map[string]any{"user_id": userId, "amount": 10, "type": "multiply_percent"}
+	header := http.Header{idempotencyKeyHeader: {uuid.NewString()}}
+
+	status, _, first := ts.request(t, http.MethodPost, "/v1/transactions", body, header)
+	if status != http.StatusOK {
+		t.Fatalf("multiply: got status %d: %s", status, first)
+	}
+
+	status, replayHeader, replay := ts.request(t, http.MethodPost, "/v1/transactions", body, header)
+	if status != http.StatusOK {
+		t.Fatalf("replay: got status %d: %s", status, replay)
+	}
+	if replayHeader.Get("Idempotent-Replayed") != "true" {
+		t.Error("replay: got no Idempotent-Replayed header")
+	}
+	if !bytes.Equal(bytes.TrimSpace(first), bytes.TrimSpace(replay)) {
+		t.Errorf("replay: got body %s; want the original %s", replay, first)
+	}
+
+	if balance := balanceOf(t, app, userId); balance != 110 {
+		t.Errorf("got balance %d; want 110 after a single multiply", balance)
+	}
+	if entries := listEntries(t, ts, userId); len(entries) != 2 {
+		t.Errorf("got %d entries; want 2", len(entries))
+	}
+
+	// Тот же ключ с другим процентом - ошибка клиента, а не новое умножение
+	body["amount"] = 20
+	status, _, respBody := ts.request(t, http.MethodPost, "/v1/transactions", body, header)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, respBody)
+	}
+}
+
+// TestConcurrentIdempotentSubmissions отправляет один и тот же запрос с одним ключом одновременно
+// и проверяет, что операция выполняется один раз, а остальные запросы получают ее ответ
+func TestConcurrentIdempotentSubmissions(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name        string
+		initial     int
+		txType      string
+		amount      int
+		wantBalance int
+	}{
+		{name: "deposit", initial: 0, txType: "deposit", amount: 100, wantBalance: 100},
+		{name: "withdrawal", initial: 100, txType: "withdrawal", amount: 30, wantBalance: 70},
+	}
+
+	const submissions = 8
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userId := uuid.New()
+			if tt.initial > 0 {
+				deposit(t, ts, userId, tt.initial)
+			}
+
+			body := map[string]any{"user_id": userId, "amount": tt.amount, "type": tt.txType}
+			header := http.Header{idempotencyKeyHeader: {uuid.NewString()}}
+
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				bodies   [][]byte
+				replayed int
+			)
+			for range submissions {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					status, respHeader, respBody, err := ts.send(http.MethodPost, "/v1/transactions", body, header)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if status != http.StatusOK {
+						t.Errorf("got status %d: %s", status, respBody)
+						return
+					}
+
+					mu.Lock()
+					defer mu.Unlock()
+					bodies = append(bodies, bytes.TrimSpace(respBody))
+					if respHeader.Get("Idempotent-Replayed") == "true" {
+						replayed++
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(bodies) == 0 {
+				t.Fatal("got no successful submissions")
+			}
+			if replayed != len(bodies)-1 {
+				t.Errorf("got %d replayed responses of %d; want all but one", replayed, len(bodies))
+			}
+			for _, b := range bodies[1:] {
+				if !bytes.Equal(b, bodies[0]) {
+					t.Errorf("got body %s; want the same %s for every submission", b, bodies[0])
+				}
+			}
+			if balance := balanceOf(t, app, userId); balance != tt.wantBalance {
+				t.Errorf("got balance %d; want %d", balance, tt.wantBalance)
+			}
+		})
+	}
+}
+
+func TestTransactionHash(t *testing.T) {
+	trxIn := &transactionIn{UserId: uuid.NewString(), Amount: 100, Type: "deposit"}
+
+	plain, err := transactionHash(trxIn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Без include отпечаток совпадает с отпечатком одного тела, как до появления include=entry
+	js, err := json.Marshal(trxIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(js)
+	if want := hex.EncodeToString(sum[:]); plain != want {
+		t.Errorf("got hash %s without include; want the body hash %s", plain, want)
+	}
+
+	withEntry, err := transactionHash(trxIn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withEntry == plain {
+		t.Error("got the same hash with include=entry; want a different one")
+	}
+
+	again, err := transactionHash(trxIn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != withEntry {
+		t.Errorf("got hash %s for the same request; want %s", again, withEntry)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+type ledgerResponse struct {
+	UserId     uuid.UUID         `json:"user_id"`
+	Entries    []*data.LedgerRow `json:"entries"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// showUserLedgerHandler возвращает выписку по операциям пользователя с балансом после каждой операции
+func (app *application) showUserLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	v := validator.New()
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(limit > 0, "limit", "must be positive")
+	v.Check(limit <= 500, "limit", "must not be more than 500")
+
+	var after *data.Cursor
+	if s := qs.Get("cursor"); s != "" {
+		cursor, err := data.DecodeCursor(s)
+		v.Check(err == nil, "cursor", "is invalid")
+		after = &cursor
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ledger, err := app.models.Transactions.GetLedger(r.Context(), userId, after, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := ledgerResponse{
+		UserId:  userId,
+		Entries: ledger,
+	}
+	if len(ledger) == limit {
+		last := ledger[len(ledger)-1]
+		response.NextCursor = data.Cursor{CreatedAt: last.CreatedAt, Id: last.Id}.Encode()
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type historyResponse struct {
+	UserId       uuid.UUID           `json:"user_id"`
+	Transactions []*data.Transaction `json:"transactions"`
+	Metadata     data.Metadata       `json:"metadata"`
+	NextCursor   string              `json:"next_cursor,omitempty"`
+}
+
+// listUserTransactionsHandler возвращает историю операций пользователя от новых к старым
+// с балансом, записанным при каждой операции. Листать можно по номеру страницы (page, page_size)
+// или курсором; limit - прежнее название page_size
+func (app *application) listUserTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	v := validator.New()
+	var filters data.Filters
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", app.readInt(qs, "limit", 50, v), v)
+	data.ValidateFilters(v, filters)
+
+	var before *data.Cursor
+	if s := qs.Get("cursor"); s != "" {
+		cursor, err := data.DecodeCursor(s)
+		v.Check(err == nil, "cursor", "is invalid")
+		v.Check(filters.Page == 1, "page", "must not be combined with cursor")
+		before = &cursor
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	transactions, metadata, err := app.models.Transactions.ListByUser(r.Context(), userId, before, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := historyResponse{
+		UserId:       userId,
+		Transactions: transactions,
+		Metadata:     metadata,
+	}
+	if len(transactions) == filters.PageSize {
+		last := transactions[len(transactions)-1]
+		response.NextCursor = data.Cursor{CreatedAt: last.CreatedAt, Id: last.Id}.Encode()
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
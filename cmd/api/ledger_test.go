@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestUserLedgerRunningBalance(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 100)
+	withdraw(t, ts, userId, 30)
+	deposit(t, ts, userId, 50)
+	withdraw(t, ts, userId, 70)
+
+	want := []struct {
+		txType  string
+		delta   data.Points
+		balance data.Points
+	}{
+		{"deposit", 100, 100},
+		{"withdrawal", -30, 70},
+		{"deposit", 50, 120},
+		{"withdrawal", -70, 50},
+	}
+
+	var ledger ledgerResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger", userId), &ledger)
+
+	if len(ledger.Entries) != len(want) {
+		t.Fatalf("got %d rows; want %d", len(ledger.Entries), len(want))
+	}
+	for i, row := range ledger.Entries {
+		if row.Type != want[i].txType || row.Delta != want[i].delta || row.RunningBalance != want[i].balance {
+			t.Errorf("row %d: got %s delta=%d running_balance=%d; want %s delta=%d running_balance=%d",
+				i, row.Type, row.Delta, row.RunningBalance, want[i].txType, want[i].delta, want[i].balance)
+		}
+		if row.ResultingBalance == nil || *row.ResultingBalance != want[i].balance {
+			t.Errorf("row %d: got resulting_balance %v; want %d", i, row.ResultingBalance, want[i].balance)
+		}
+	}
+
+	// Вторая страница продолжает баланс первой, а не считает его заново
+	var first, second ledgerResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger?limit=2", userId), &first)
+	if first.NextCursor == "" {
+		t.Fatal("got no next_cursor for a full page")
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger?limit=2&cursor=%s", userId, first.NextCursor), &second)
+
+	if len(second.Entries) != 2 || second.Entries[0].RunningBalance != 120 || second.Entries[1].RunningBalance != 50 {
+		t.Errorf("got second page %+v; want running balances 120 and 50", second.Entries)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// userLimiter ограничивает число одновременных транзакций одного пользователя,
+// чтобы параллельные запросы не выстраивались в очередь на блокировке строк
+type userLimiter struct {
+	mu       sync.Mutex
+	max      int
+	inFlight map[uuid.UUID]int
+}
+
+// newUserLimiter создает ограничитель; max <= 0 отключает ограничение
+func newUserLimiter(max int) *userLimiter {
+	return &userLimiter{
+		max:      max,
+		inFlight: make(map[uuid.UUID]int),
+	}
+}
+
+// acquire занимает слот пользователя; возвращает false, если лимит исчерпан
+func (l *userLimiter) acquire(userId uuid.UUID) bool {
+	if l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[userId] >= l.max {
+		return false
+	}
+	l.inFlight[userId]++
+
+	return true
+}
+
+// release освобождает слот пользователя и удаляет запись, когда слотов не осталось
+func (l *userLimiter) release(userId uuid.UUID) {
+	if l.max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight[userId]--
+	if l.inFlight[userId] <= 0 {
+		delete(l.inFlight, userId)
+	}
+}
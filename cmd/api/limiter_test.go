@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUserLimiter(t *testing.T) {
+	limiter := newUserLimiter(2)
+	userId, otherId := uuid.New(), uuid.New()
+
+	if !limiter.acquire(userId) || !limiter.acquire(userId) {
+		t.Fatal("got a rejection within the limit")
+	}
+	if limiter.acquire(userId) {
+		t.Error("got a third slot for the same user; want a rejection")
+	}
+	if !limiter.acquire(otherId) {
+		t.Error("got a rejection for another user")
+	}
+
+	limiter.release(userId)
+	if !limiter.acquire(userId) {
+		t.Error("got a rejection after a slot was released")
+	}
+
+	unlimited := newUserLimiter(0)
+	for range 10 {
+		if !unlimited.acquire(userId) {
+			t.Fatal("got a rejection with the limit disabled")
+		}
+	}
+}
+
+func TestUserLimiterConcurrent(t *testing.T) {
+	const max, attempts = 3, 50
+
+	limiter := newUserLimiter(max)
+	userId := uuid.New()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acquired int
+	)
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.acquire(userId) {
+				mu.Lock()
+				acquired++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if acquired != max {
+		t.Errorf("got %d slots; want %d", acquired, max)
+	}
+}
+
+// TestCreateTransactionConcurrencyLimit держит блокировку пользователя, чтобы первый запрос
+// занял единственный слот и ждал ее, и проверяет, что остальные запросы получают 429
+func TestCreateTransactionConcurrencyLimit(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.limits.maxConcurrentPerUser = 1
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	body := map[string]any{"user_id": userId, "amount": 10, "type": "deposit"}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = app.models.BonusEntries.LockUser(context.Background(), tx, userId); err != nil {
+		t.Fatal(err)
+	}
+
+	first := make(chan int)
+	go func() {
+		status, _, _, err := ts.send(http.MethodPost, "/v1/transactions", body, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		first <- status
+	}()
+	waitForLockWaiters(t, app, 1)
+
+	const excess = 5
+	var wg sync.WaitGroup
+	statuses := make([]int, excess)
+	for i := range excess {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			statuses[i], _, _, err = ts.send(http.MethodPost, "/v1/transactions", body, nil)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusTooManyRequests {
+			t.Errorf("excess request %d: got status %d; want %d", i, status, http.StatusTooManyRequests)
+		}
+	}
+
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("first request: got status %d; want %d", status, http.StatusOK)
+	}
+	if balance := balanceOf(t, app, userId); balance != 10 {
+		t.Errorf("got balance %d; want 10", balance)
+	}
+}
+
+// waitForLockWaiters ждет, пока n транзакций не начнут ждать advisory-блокировку
+func waitForLockWaiters(t *testing.T, app *application, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var waiting int
+		err := app.db.QueryRow(`SELECT count(*) FROM pg_locks WHERE locktype = 'advisory' AND NOT granted`).Scan(&waiting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d transactions waiting for a lock; want %d", waiting, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,78 +3,349 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/jsonlog"
 
 	_ "github.com/lib/pq"
 )
 
 type config struct {
-	port int
-	db   struct {
-		dsn string
+	port                     int
+	env                      string
+	timezone                 string
+	amountsAsStrings         bool
+	strictAmounts            bool
+	rejectNullLifetime       bool
+	balanceCache             bool
+	balanceCacheTTL          time.Duration
+	defaultLifetimeDays      int
+	duplicateReferencePolicy string
+	sourceValidation         string
+	maxRequestBody           int64
+	maxBatchRequestBody      int64
+	customTypes              string
+	toleratedFields          string
+	db                       struct {
+		dsn            string
+		queryTimeout   time.Duration
+		connectRetries int
+		connectBackoff time.Duration
+		maxOpenConns   int
+		maxIdleConns   int
+		maxIdleTime    string
 	}
 	timeouts struct {
-		idle  time.Duration
-		read  time.Duration
-		write time.Duration
+		idle     time.Duration
+		read     time.Duration
+		write    time.Duration
+		shutdown time.Duration
+	}
+	limits struct {
+		maxConcurrentPerUser int
+		minDeposit           int
+		maxWithdrawal        int
+		maxConcurrentReports int
+		maxLifetimeDays      int
+		maxExtensionDays     int
+		// spendPreviewEntries - наибольшее число начислений в ответах предпросмотра списания (0 - без ограничения)
+		spendPreviewEntries int
+	}
+	fragments struct {
+		minAmount int
+		policy    string
+	}
+	multiply struct {
+		bonusLifetimeDays int
+		maxBonus          int
+	}
+	flags struct {
+		refreshInterval time.Duration
+	}
+	sweeper struct {
+		interval time.Duration
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	rateLimit struct {
+		rps   float64
+		burst int
+	}
+	otlpEndpoint string
+	outbox       struct {
+		webhookURL string
+		interval   time.Duration
+	}
+	transfer struct {
+		lifetimeDays int
+		// provenance - источник и срок жизни баллов получателя: request, transfer или inherit
+		provenance      string
+		deadlockRetries int
+		deadlockBackoff time.Duration
 	}
 }
 
 type application struct {
 	config config
-	logger *log.Logger
+	logger *jsonlog.Logger
 	models data.Models
 	db     *sql.DB
+
+	// location - часовой пояс времени сервера в /v1/time (-timezone)
+	location *time.Location
+	types    transactionTypes
+	// toleratedFields - будущие поля транзакции, которые принимаются и игнорируются (-tolerated-fields)
+	toleratedFields []string
+	userLimiter     *userLimiter
+	flags           *featureFlags
+	balances        *balanceCache
+	sweeper         *expirySweeper
+	reportSlots     chan struct{}
+	rateLimiter     *rateLimiter
+	metrics         *metrics
 }
 
 func main() {
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 8080, "API server port")
+	flag.StringVar(&cfg.env, "env", "development", "Environment name (development|staging|production)")
+	flag.StringVar(&cfg.timezone, "timezone", "Local", "IANA timezone of the server time reported by /v1/time, e.g. Europe/Moscow (Local = system timezone)")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DB_DSN"), "PostgreSQL DSN")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL query timeout")
+	flag.IntVar(&cfg.db.connectRetries, "db-connect-retries", 0, "Number of retries when PostgreSQL is unavailable at startup")
+	flag.DurationVar(&cfg.db.connectBackoff, "db-connect-backoff", time.Second, "Initial pause between PostgreSQL connection retries (doubles after each attempt)")
+	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 	flag.DurationVar(&cfg.timeouts.idle, "idle-timeout", time.Minute, "HTTP idle timeout")
 	flag.DurationVar(&cfg.timeouts.read, "read-timeout", 10*time.Second, "HTTP read timeout")
 	flag.DurationVar(&cfg.timeouts.write, "write-timeout", 30*time.Second, "HTTP write timeout")
+	flag.DurationVar(&cfg.timeouts.shutdown, "shutdown-timeout", 30*time.Second, "Grace period for in-flight requests on shutdown")
+	flag.IntVar(&cfg.limits.maxConcurrentPerUser, "max-concurrent-per-user", 0, "Max simultaneous transactions per user (0 = unlimited)")
+	flag.IntVar(&cfg.limits.maxConcurrentReports, "max-concurrent-reports", 4, "Max simultaneous program-wide reports (0 = unlimited)")
+	flag.IntVar(&cfg.limits.minDeposit, "min-deposit", 1, "Minimum deposit amount")
+	flag.IntVar(&cfg.limits.maxWithdrawal, "max-withdrawal", 0, "Maximum amount of a single withdrawal (0 = unlimited)")
+	flag.IntVar(&cfg.limits.maxLifetimeDays, "max-lifetime-days", 365, "Max lifetime of an entry in days when extending lifetimes")
+	flag.IntVar(&cfg.limits.maxExtensionDays, "max-extension-days", 365, "Max number of days a single lifetime extension may add")
+	flag.IntVar(&cfg.limits.spendPreviewEntries, "spend-preview-limit", 100, "Max number of entries listed by spend-plan and transaction preview responses (0 = unlimited)")
+	flag.IntVar(&cfg.fragments.minAmount, "min-fragment", 0, "Minimum remainder of a partially spent entry (0 = no minimum)")
+	flag.StringVar(&cfg.fragments.policy, "fragment-policy", "keep", "What to do with remainders below min-fragment (keep|forfeit)")
+	flag.IntVar(&cfg.defaultLifetimeDays, "default-lifetime-days", 30, "Lifetime of an entry in days when lifetime_days is omitted")
+	flag.IntVar(&cfg.multiply.bonusLifetimeDays, "multiply-bonus-lifetime-days", 0, "Lifetime of multiply bonuses in days (0 = default deposit lifetime)")
+	flag.IntVar(&cfg.transfer.lifetimeDays, "transfer-lifetime-days", 0, "Lifetime of points received by transfer in days (0 = recipient's default lifetime)")
+	flag.StringVar(&cfg.transfer.provenance, "transfer-provenance", "request", "Source and lifetime of points received by transfer (request = request source and new lifetime, transfer = source \"transfer\" and new lifetime, inherit = sender's sources and expiry)")
+	flag.IntVar(&cfg.transfer.deadlockRetries, "transfer-deadlock-retries", 3, "How many times a transfer is retried after a deadlock (0 = no retries)")
+	flag.DurationVar(&cfg.transfer.deadlockBackoff, "transfer-deadlock-backoff", 50*time.Millisecond, "Initial pause before retrying a deadlocked transfer, doubled on each retry")
+	flag.StringVar(&cfg.customTypes, "custom-types", "", "Custom transaction types with their behavior, e.g. referral_bonus=credit,chargeback=debit")
+	flag.StringVar(&cfg.toleratedFields, "tolerated-fields", "", "Comma-separated forthcoming transaction fields that are accepted and ignored with a logged notice, e.g. promo_code,channel")
+	flag.IntVar(&cfg.multiply.maxBonus, "multiply-max-bonus", 0, "Maximum bonus of a single multiply_percent transaction (0 = unlimited)")
+	flag.BoolVar(&cfg.rejectNullLifetime, "reject-null-lifetime", false, "Reject transactions with an explicit null lifetime_days")
+	flag.BoolVar(&cfg.strictAmounts, "strict-amounts", false, "Reject amounts above the int32 range on any platform")
+	flag.BoolVar(&cfg.amountsAsStrings, "amounts-as-strings", false, "Serialize point amounts in responses, snapshots and outbox events as decimal strings")
+	flag.DurationVar(&cfg.flags.refreshInterval, "feature-flags-refresh", 30*time.Second, "Feature flags cache refresh interval")
+	flag.DurationVar(&cfg.sweeper.interval, "expiry-sweep-interval", time.Hour, "Interval of marking expired entries (0 = disabled)")
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-key-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are kept")
+	flag.StringVar(&cfg.duplicateReferencePolicy, "duplicate-reference-policy", "skip", "What to do with a deposit whose source and external_reference were already imported (skip|reject)")
+	flag.Float64Var(&cfg.rateLimit.rps, "rate-limit-rps", 10, "Write requests per second allowed for one client (0 = unlimited)")
+	flag.IntVar(&cfg.rateLimit.burst, "rate-limit-burst", 20, "Burst of write requests allowed for one client above rate-limit-rps")
+	flag.StringVar(&cfg.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint for exporting traces, e.g. http://localhost:4318 (empty = tracing disabled)")
+	flag.StringVar(&cfg.outbox.webhookURL, "outbox-webhook-url", "", "URL that receives ledger events from the outbox (empty = outbox disabled)")
+	flag.DurationVar(&cfg.outbox.interval, "outbox-relay-interval", 5*time.Second, "Interval of delivering pending outbox events")
+	flag.Int64Var(&cfg.maxRequestBody, "max-request-body", 10*1024, "Maximum size of a JSON request body in bytes")
+	flag.Int64Var(&cfg.maxBatchRequestBody, "max-batch-request-body", 1024*1024, "Maximum size of a transaction batch request body in bytes")
+	flag.StringVar(&cfg.sourceValidation, "source-validation", "lenient", "How sources with uppercase letters or surrounding whitespace are handled (lenient = normalized, strict = rejected)")
+	flag.BoolVar(&cfg.balanceCache, "balance-cache", false, "Serve user balances from an in-memory projection warmed at startup (sees only this replica's writes)")
+	flag.DurationVar(&cfg.balanceCacheTTL, "balance-cache-ttl", 5*time.Second, "Longest time a cached balance is served, bounding staleness after writes on other replicas")
 	flag.Parse()
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	db, err := openDB(cfg)
+	if cfg.db.queryTimeout <= 0 {
+		logger.PrintFatal(errors.New("db-query-timeout must be positive"), nil)
+	}
+	if cfg.timeouts.shutdown <= 0 {
+		logger.PrintFatal(errors.New("shutdown-timeout must be positive"), nil)
+	}
+	if cfg.idempotency.ttl <= 0 {
+		logger.PrintFatal(errors.New("idempotency-key-ttl must be positive"), nil)
+	}
+	if cfg.sweeper.interval < 0 {
+		logger.PrintFatal(errors.New("expiry-sweep-interval must not be negative"), nil)
+	}
+	if cfg.db.maxOpenConns < 0 || cfg.db.maxIdleConns < 0 {
+		logger.PrintFatal(errors.New("db-max-open-conns and db-max-idle-conns must not be negative"), nil)
+	}
+	if cfg.db.connectRetries < 0 {
+		logger.PrintFatal(errors.New("db-connect-retries must not be negative"), nil)
+	}
+	if cfg.limits.minDeposit < 1 {
+		logger.PrintFatal(errors.New("min-deposit must be positive"), nil)
+	}
+	if cfg.limits.maxWithdrawal < 0 {
+		logger.PrintFatal(errors.New("max-withdrawal must not be negative"), nil)
+	}
+	if cfg.defaultLifetimeDays < 1 {
+		logger.PrintFatal(errors.New("default-lifetime-days must be positive"), nil)
+	}
+	if cfg.limits.maxLifetimeDays < 1 {
+		logger.PrintFatal(errors.New("max-lifetime-days must be positive"), nil)
+	}
+	if cfg.limits.spendPreviewEntries < 0 {
+		logger.PrintFatal(errors.New("spend-preview-limit must not be negative"), nil)
+	}
+	if cfg.limits.maxExtensionDays < 1 {
+		logger.PrintFatal(errors.New("max-extension-days must be positive"), nil)
+	}
+	if cfg.fragments.minAmount < 0 {
+		logger.PrintFatal(errors.New("min-fragment must not be negative"), nil)
+	}
+	if cfg.fragments.policy != "keep" && cfg.fragments.policy != "forfeit" {
+		logger.PrintFatal(errors.New("fragment-policy must be keep or forfeit"), nil)
+	}
+	if cfg.duplicateReferencePolicy != "skip" && cfg.duplicateReferencePolicy != "reject" {
+		logger.PrintFatal(errors.New("duplicate-reference-policy must be skip or reject"), nil)
+	}
+	if cfg.maxRequestBody <= 0 || cfg.maxBatchRequestBody <= 0 {
+		logger.PrintFatal(errors.New("max-request-body and max-batch-request-body must be positive"), nil)
+	}
+	if cfg.sourceValidation != "lenient" && cfg.sourceValidation != "strict" {
+		logger.PrintFatal(errors.New("source-validation must be lenient or strict"), nil)
+	}
+	if cfg.multiply.bonusLifetimeDays < 0 {
+		logger.PrintFatal(errors.New("multiply-bonus-lifetime-days must not be negative"), nil)
+	}
+	if cfg.transfer.provenance != "request" && cfg.transfer.provenance != "transfer" && cfg.transfer.provenance != "inherit" {
+		logger.PrintFatal(errors.New("transfer-provenance must be request, transfer or inherit"), nil)
+	}
+	if cfg.transfer.lifetimeDays < 0 {
+		logger.PrintFatal(errors.New("transfer-lifetime-days must not be negative"), nil)
+	}
+	if cfg.rateLimit.rps < 0 {
+		logger.PrintFatal(errors.New("rate-limit-rps must not be negative"), nil)
+	}
+	if cfg.rateLimit.rps > 0 && cfg.rateLimit.burst < 1 {
+		logger.PrintFatal(errors.New("rate-limit-burst must be positive"), nil)
+	}
+	if cfg.flags.refreshInterval <= 0 {
+		logger.PrintFatal(errors.New("feature-flags-refresh must be positive"), nil)
+	}
+	if cfg.outbox.interval <= 0 {
+		logger.PrintFatal(errors.New("outbox-relay-interval must be positive"), nil)
+	}
+	if cfg.transfer.deadlockRetries < 0 {
+		logger.PrintFatal(errors.New("transfer-deadlock-retries must not be negative"), nil)
+	}
+	if cfg.transfer.deadlockBackoff < 0 {
+		logger.PrintFatal(errors.New("transfer-deadlock-backoff must not be negative"), nil)
+	}
+	if cfg.balanceCache && cfg.balanceCacheTTL <= 0 {
+		logger.PrintFatal(errors.New("balance-cache-ttl must be positive"), nil)
+	}
+	if cfg.multiply.maxBonus < 0 {
+		logger.PrintFatal(errors.New("multiply-max-bonus must not be negative"), nil)
+	}
+
+	location, err := time.LoadLocation(cfg.timezone)
+	if err != nil {
+		logger.PrintFatal(fmt.Errorf("timezone: %w", err), nil)
+	}
+
+	types, err := newTransactionTypes(cfg.customTypes)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	toleratedFields, err := newToleratedFields(cfg.toleratedFields)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.otlpEndpoint, cfg.env)
 	if err != nil {
-		logger.Fatal(err, nil)
+		logger.PrintFatal(err, nil)
+	}
+
+	db, err := openDB(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
 	}
 	defer db.Close()
 
+	models := data.NewModels(db, cfg.db.queryTimeout)
+	models.BonusEntries.Fragments = data.FragmentPolicy{
+		MinAmount: cfg.fragments.minAmount,
+		Forfeit:   cfg.fragments.policy == "forfeit",
+	}
+	models.IdempotencyKeys.TTL = cfg.idempotency.ttl
+	data.SetPointsAsStrings(cfg.amountsAsStrings)
+
+	balances := newBalanceCache(cfg.balanceCache, cfg.balanceCacheTTL, models.BonusEntries)
+
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: models,
 		db:     db,
+
+		location:        location,
+		types:           types,
+		toleratedFields: toleratedFields,
+		userLimiter:     newUserLimiter(cfg.limits.maxConcurrentPerUser),
+		rateLimiter:     newRateLimiter(cfg.rateLimit.rps, cfg.rateLimit.burst),
+		metrics:         newMetrics(db),
+		flags:           newFeatureFlags(models.Flags),
+		balances:        balances,
+		sweeper:         newExpirySweeper(models.BonusEntries, balances),
 	}
 
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      app.routes(),
-		IdleTimeout:  cfg.timeouts.idle,
-		ReadTimeout:  cfg.timeouts.read,
-		WriteTimeout: cfg.timeouts.write,
+	if cfg.limits.maxConcurrentReports > 0 {
+		app.reportSlots = make(chan struct{}, cfg.limits.maxConcurrentReports)
 	}
 
-	logger.Printf("starting server on %s", srv.Addr)
-	err = srv.ListenAndServe()
-	logger.Fatal(err)
-}
+	if err = app.flags.refresh(context.Background()); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	go app.refreshFlagsPeriodically(cfg.flags.refreshInterval)
 
-func openDB(cfg config) (*sql.DB, error) {
+	// Без прогрева кэш заполняется по мере запросов, поэтому ошибка прогрева не мешает запуску
+	if cfg.balanceCache {
+		warmed, err := app.balances.warm(context.Background())
+		if err != nil {
+			logger.PrintError(err, map[string]string{"task": "warm balance cache"})
+		} else {
+			logger.PrintInfo("balance cache warmed", map[string]string{"users": strconv.Itoa(warmed)})
+		}
+	}
+	go app.pruneIdempotencyKeysPeriodically()
+	go app.rateLimiter.evictPeriodically()
+	if cfg.outbox.webhookURL != "" {
+		go app.relayOutboxPeriodically()
+	}
+
+	if cfg.sweeper.interval > 0 {
+		app.startSweeper(cfg.sweeper.interval)
+	}
+
+	err = app.serve()
+
+	// Спаны, накопленные к остановке, отправляются до выхода
+	if shutdownErr := shutdownTracing(context.Background()); shutdownErr != nil {
+		logger.PrintError(shutdownErr, map[string]string{"task": "shutdown tracing"})
+	}
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+}
 
-	fmt.Printf("Using DSN: %s\n", cfg.db.dsn)
+func openDB(cfg config, logger *jsonlog.Logger) (*sql.DB, error) {
 
 	if cfg.db.dsn == "" {
 		return nil, fmt.Errorf("DB_DSN is empty")
@@ -85,13 +356,48 @@ func openDB(cfg config) (*sql.DB, error) {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// Ограничиваем пул, чтобы несколько реплик API не исчерпали соединения PostgreSQL
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
 
-	err = db.PingContext(ctx)
+	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
 	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid db-max-idle-time: %w", err)
+	}
+	db.SetConnMaxIdleTime(duration)
+
+	err = pingWithRetry(db.PingContext, cfg.db.connectRetries, cfg.db.connectBackoff, logger)
+	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// pingWithRetry проверяет подключение к БД и при недоступной БД повторяет проверку retries раз
+// с удвоением паузы, чтобы кратковременный сбой при запуске не приводил к перезапуску сервиса
+func pingWithRetry(ping func(context.Context) error, retries int, backoff time.Duration, logger *jsonlog.Logger) error {
+	attempts := retries + 1
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == attempts {
+			return err
+		}
+
+		logger.PrintInfo("database is unavailable, retrying", map[string]string{
+			"error":   err.Error(),
+			"attempt": fmt.Sprintf("%d of %d", attempt, attempts),
+			"backoff": backoff.String(),
+		})
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+func TestPingWithRetry(t *testing.T) {
+	errUnavailable := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		retries  int
+		failures int
+		wantErr  bool
+	}{
+		{name: "available at once", retries: 0, failures: 0},
+		{name: "available on the third attempt", retries: 3, failures: 2},
+		{name: "retries exhausted", retries: 2, failures: 5, wantErr: true},
+		{name: "no retries", retries: 0, failures: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := jsonlog.New(&logs, jsonlog.LevelInfo)
+
+			calls := 0
+			ping := func(ctx context.Context) error {
+				calls++
+				if calls <= tt.failures {
+					return errUnavailable
+				}
+				return nil
+			}
+
+			err := pingWithRetry(ping, tt.retries, time.Millisecond, logger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error: %t", err, tt.wantErr)
+			}
+
+			wantCalls := min(tt.failures+1, tt.retries+1)
+			if calls != wantCalls {
+				t.Errorf("got %d attempts; want %d", calls, wantCalls)
+			}
+			// О каждой неудачной попытке, после которой будет повтор, пишется запись в лог
+			if logged := strings.Count(logs.String(), "database is unavailable, retrying"); logged != wantCalls-1 {
+				t.Errorf("got %d retry log records; want %d", logged, wantCalls-1)
+			}
+		})
+	}
+}
+
+func TestOpenDBUnavailable(t *testing.T) {
+	// Свободный порт, на котором никто не слушает
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cfg := testConfig()
+	cfg.db.dsn = "postgres://ledger@" + addr + "/ledger?sslmode=disable&connect_timeout=1"
+	cfg.db.maxIdleTime = "15m"
+	cfg.db.connectRetries = 2
+	cfg.db.connectBackoff = time.Millisecond
+
+	var logs bytes.Buffer
+	db, err := openDB(cfg, jsonlog.New(&logs, jsonlog.LevelInfo))
+	if err == nil {
+		db.Close()
+		t.Fatal("got no error for an unavailable database")
+	}
+	if logged := strings.Count(logs.String(), "database is unavailable, retrying"); logged != 2 {
+		t.Errorf("got %d retry log records; want 2", logged)
+	}
+}
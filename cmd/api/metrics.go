@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics - метрики сервиса для Prometheus
+type metrics struct {
+	registry *prometheus.Registry
+	// transactions - число запросов POST /v1/transactions по типу операции и результату
+	transactions *prometheus.CounterVec
+	// requestDuration - время обработки запросов по маршруту, методу и коду ответа
+	requestDuration *prometheus.HistogramVec
+}
+
+// newMetrics создает метрики и регистрирует их вместе со статистикой пула соединений db
+// и стандартными метриками процесса и среды выполнения Go
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ledger_transactions_total",
+			Help: "Transactions requested through POST /v1/transactions by type and outcome.",
+		}, []string{"type", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ledger_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+	}
+
+	m.registry.MustRegister(
+		m.transactions,
+		m.requestDuration,
+		collectors.NewDBStatsCollector(db, "ledger"),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// handler отдает метрики в формате Prometheus
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeLatency измеряет время обработки запросов. Запрос учитывается по шаблону маршрута,
+// а не по фактическому пути, чтобы id пользователей не раздували число временных рядов
+func (app *application) observeLatency(router *httprouter.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		router.ServeHTTP(rec, r)
+
+		app.metrics.requestDuration.
+			WithLabelValues(routePattern(router, r), r.Method, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// routePattern восстанавливает шаблон маршрута запроса, заменяя значения параметров их именами
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+	next := 0
+	for i, segment := range segments {
+		if next < len(params) && segment == params[next].Value {
+			segments[i] = ":" + params[next].Key
+			next++
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
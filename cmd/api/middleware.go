@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// recoverPanic превращает панику в обработчике в ответ 500, чтобы клиент не получал оборванное соединение.
+// Соединение после такого ответа закрывается, стек паники пишется в лог
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				w.Header().Set("Connection", "close")
+				app.serverErrorResponse(w, r, fmt.Errorf("panic: %v\n%s", err, debug.Stack()))
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder запоминает код ответа для лога запросов
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// logRequest пишет в лог метод, путь, код ответа и длительность каждого запроса
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		app.logger.PrintInfo("request", map[string]string{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"status":         strconv.Itoa(rec.status),
+			"duration":       time.Since(start).String(),
+		})
+	})
+}
+
+// limitReports ограничивает число одновременно выполняемых тяжелых отчетов по всей программе,
+// чтобы всплеск обновлений дашбордов не перегружал БД
+func (app *application) limitReports(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.reportSlots == nil {
+			next(w, r)
+			return
+		}
+
+		select {
+		case app.reportSlots <- struct{}{}:
+			defer func() { <-app.reportSlots }()
+			next(w, r)
+		default:
+			app.reportsBusyResponse(w, r)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+func TestLimitReports(t *testing.T) {
+	cfg := testConfig()
+	cfg.limits.maxConcurrentReports = 2
+	app := newTestApplication(t, cfg, nil)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := app.limitReports(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Занимаем все слоты отчетами, которые ждут release
+	var wg sync.WaitGroup
+	codes := make([]int, cfg.limits.maxConcurrentReports)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest(http.MethodGet, "/v1/analytics/expiring", nil))
+			codes[i] = rr.Code
+		}()
+		<-entered
+	}
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodGet, "/v1/analytics/expiring", nil))
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("excess report: got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Error("excess report: got no Retry-After header")
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("admitted report: got status %d; want %d", code, http.StatusOK)
+		}
+	}
+
+	// После завершения отчетов слоты освобождаются
+	rr := httptest.NewRecorder()
+	go func() { <-entered }()
+	handler(rr, httptest.NewRequest(http.MethodGet, "/v1/analytics/expiring", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("report after release: got status %d; want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var log lockedBuffer
+	app := newTestApplication(t, testConfig(), nil)
+	app.logger = jsonlog.New(&log, jsonlog.LevelInfo)
+
+	handler := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	// Клиент получает ответ, а не оборванное соединение
+	ts := newTestServer(t, handler)
+	status, _, body := ts.request(t, http.MethodGet, "/", nil, nil)
+	if status != http.StatusInternalServerError {
+		t.Errorf("got status %d; want %d", status, http.StatusInternalServerError)
+	}
+
+	// Клиент HTTP не показывает заголовок Connection, поэтому он проверяется на самом ответе
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Header().Get("Connection") != "close" {
+		t.Errorf("got Connection %q; want close", rr.Header().Get("Connection"))
+	}
+
+	var response struct {
+		Error string `json:"error"`
+	}
+	decodeJSON(t, body, &response)
+	if response.Error == "" {
+		t.Errorf("got body %s; want a JSON error", body)
+	}
+
+	if !strings.Contains(log.String(), "panic: boom") {
+		t.Errorf("got log %s; want the panic logged", log.String())
+	}
+}
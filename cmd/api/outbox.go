@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+const (
+	// outboxEventTransaction - событие о новой записи журнала операций
+	outboxEventTransaction = "ledger.transaction"
+	// outboxBatchSize - сколько событий релей доставляет за один проход
+	outboxBatchSize = 100
+	// outboxDeliveryTimeout - таймаут доставки одного события
+	outboxDeliveryTimeout = 10 * time.Second
+	// outboxClaimLease - на сколько релей забирает пачку событий: не меньше худшего времени ее доставки,
+	// чтобы другая реплика не забрала события, пока этот проход еще их доставляет
+	outboxClaimLease = outboxBatchSize * outboxDeliveryTimeout
+)
+
+// insertTransaction записывает операцию в журнал и, если включен outbox, событие о ней
+// в той же транзакции: событие попадет к подписчику, только если операция закоммичена
+func (app *application) insertTransaction(ctx context.Context, tx *sql.Tx, t *data.Transaction) error {
+	if err := app.models.Transactions.Insert(ctx, tx, t); err != nil {
+		return err
+	}
+
+	if app.config.outbox.webhookURL == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Outbox.InsertTx(ctx, tx, &data.OutboxEvent{
+		Id:        uuid.New(),
+		EventType: outboxEventTransaction,
+		Payload:   payload,
+	})
+}
+
+// relayOutboxPeriodically доставляет накопленные события каждые -outbox-relay-interval
+func (app *application) relayOutboxPeriodically() {
+	ticker := time.NewTicker(app.config.outbox.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sent, err := app.relayOutbox(context.Background())
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": "relay outbox"})
+		}
+		if sent > 0 {
+			app.logger.PrintInfo("outbox events delivered", map[string]string{"sent": strconv.Itoa(sent)})
+		}
+	}
+}
+
+// relayOutbox забирает пачку недоставленных событий, доставляет их по порядку и отмечает доставленные.
+// Доставка идет вне транзакции БД: медленный подписчик не держит блокировки строк outbox, а каждая
+// отметка - отдельный короткий запрос. На первой неудачной доставке проход останавливается, а остаток
+// пачки возвращается в очередь, чтобы не нарушать порядок событий. Доставка - как минимум один раз:
+// если процесс упадет между доставкой и отметкой, событие будет отправлено повторно
+func (app *application) relayOutbox(ctx context.Context) (int, error) {
+	events, err := app.models.Outbox.ClaimPending(ctx, outboxBatchSize, outboxClaimLease)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i, event := range events {
+		if deliveryErr := app.deliverOutboxEvent(ctx, event); deliveryErr != nil {
+			if err = app.models.Outbox.MarkFailed(ctx, event.Id, deliveryErr.Error()); err != nil {
+				return sent, err
+			}
+
+			var rest []string
+			for _, event := range events[i+1:] {
+				rest = append(rest, event.Id.String())
+			}
+			if err = app.models.Outbox.Release(ctx, rest); err != nil {
+				return sent, err
+			}
+
+			return sent, fmt.Errorf("deliver outbox event: %w", deliveryErr)
+		}
+
+		if err = app.models.Outbox.MarkSent(ctx, event.Id); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// deliverOutboxEvent отправляет событие на -outbox-webhook-url. Тело запроса - payload события
+// без изменений, id и тип события передаются в заголовках
+func (app *application) deliverOutboxEvent(ctx context.Context, event *data.OutboxEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, outboxDeliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.config.outbox.webhookURL, bytes.NewReader(event.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", event.Id.String())
+	req.Header.Set("X-Event-Type", event.EventType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+// webhookRecorder - подписчик outbox, который запоминает доставленные события. Если задан db,
+// во время доставки он проверяет, что релей не держит блокировку строки события
+type webhookRecorder struct {
+	db       *sql.DB
+	mu       sync.Mutex
+	fail     bool
+	ids      []string
+	bodies   [][]byte
+	lockErrs []error
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	var lockErr error
+	if rec.db != nil {
+		_, lockErr = rec.db.Exec(`SELECT 1 FROM outbox WHERE id = $1 FOR UPDATE NOWAIT`, r.Header.Get("X-Event-Id"))
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.lockErrs = append(rec.lockErrs, lockErr)
+
+	if rec.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	rec.ids = append(rec.ids, r.Header.Get("X-Event-Id"))
+	rec.bodies = append(rec.bodies, body)
+}
+
+func TestOutbox(t *testing.T) {
+	db := newTestDB(t)
+	webhook := &webhookRecorder{db: db, fail: true}
+	srv := httptest.NewServer(webhook)
+	t.Cleanup(srv.Close)
+
+	cfg := testConfig()
+	cfg.outbox.webhookURL = srv.URL
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 100)
+
+	// Отклоненное списание не коммитится, и события о нем нет
+	if status, body := ts.postJSON(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 500, "type": "withdrawal"}); status == http.StatusOK {
+		t.Fatalf("overdraft: got status %d: %s", status, body)
+	}
+
+	var (
+		eventId uuid.UUID
+		payload []byte
+	)
+	err := db.QueryRow(`SELECT id, payload FROM outbox WHERE sent_at IS NULL`).Scan(&eventId, &payload)
+	if err != nil {
+		t.Fatalf("got no single pending outbox event: %v", err)
+	}
+
+	var event data.Transaction
+	if err = json.Unmarshal(payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.UserId != userId || event.Type != "deposit" || event.Delta != 100 {
+		t.Errorf("got event %+v; want a deposit of 100 for %s", event, userId)
+	}
+
+	// Недоступный подписчик: событие остается в очереди
+	if _, err = app.relayOutbox(context.Background()); err == nil {
+		t.Error("got no error while the webhook is down")
+	}
+
+	var released bool
+	err = db.QueryRow(`SELECT claimed_until IS NULL FROM outbox WHERE id = $1 AND sent_at IS NULL`, eventId).Scan(&released)
+	if err != nil || !released {
+		t.Errorf("got failed event still claimed (released %t, error %v); want it back in the queue", released, err)
+	}
+
+	webhook.mu.Lock()
+	webhook.fail = false
+	webhook.mu.Unlock()
+
+	sent, err := app.relayOutbox(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("got %d events sent; want 1", sent)
+	}
+
+	webhook.mu.Lock()
+	ids, bodies, lockErrs := webhook.ids, webhook.bodies, webhook.lockErrs
+	webhook.mu.Unlock()
+
+	// Доставка идет вне транзакции: подписчик может заблокировать строку события, пока ее доставляют
+	for i, err := range lockErrs {
+		if err != nil {
+			t.Errorf("delivery %d: got the event row locked during delivery: %v", i, err)
+		}
+	}
+
+	if len(bodies) != 1 {
+		t.Fatalf("got %d deliveries; want 1", len(bodies))
+	}
+	if ids[0] != eventId.String() {
+		t.Errorf("got X-Event-Id %s; want %s", ids[0], eventId)
+	}
+	if !bytes.Equal(bodies[0], payload) {
+		t.Errorf("got body %s; want the recorded payload %s", bodies[0], payload)
+	}
+
+	// Тело - ровно то, что выдал json.Marshal: порядок полей data.Transaction и без пробелов
+	var delivered data.Transaction
+	if err = json.Unmarshal(bodies[0], &delivered); err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := json.Marshal(delivered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bodies[0], marshalled) {
+		t.Errorf("got body %s; want the marshalled transaction %s", bodies[0], marshalled)
+	}
+
+	var attempts int
+	err = db.QueryRow(`SELECT attempts FROM outbox WHERE id = $1 AND sent_at IS NOT NULL`, eventId).Scan(&attempts)
+	if err != nil {
+		t.Fatalf("got event not marked sent: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts; want 2", attempts)
+	}
+
+	if sent, err = app.relayOutbox(context.Background()); err != nil || sent != 0 {
+		t.Errorf("second relay: got %d sent, error %v; want 0, nil", sent, err)
+	}
+}
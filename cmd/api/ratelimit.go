@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// rateLimitEvictInterval - как часто удаляются корзины клиентов, которые давно не присылали запросы
+const rateLimitEvictInterval = time.Minute
+
+// tokenBucket - корзина токенов одного клиента. Токены пополняются со скоростью rps до burst,
+// каждый запрос забирает один токен
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter ограничивает частоту запросов каждого клиента. rps <= 0 отключает ограничение
+type rateLimiter struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rps:     rps,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow забирает токен клиента key. Если токенов нет, возвращает false и время до появления токена
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l.rps <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(l.burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.rps)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rps * float64(time.Second))
+		return false, wait
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// evictPeriodically удаляет корзины, которые успели бы наполниться до burst: такая корзина
+// ничем не отличается от новой, поэтому память растет только с числом активных клиентов
+func (l *rateLimiter) evictPeriodically() {
+	if l.rps <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rateLimitEvictInterval)
+	defer ticker.Stop()
+
+	refill := time.Duration(float64(l.burst) / l.rps * float64(time.Second))
+
+	for range ticker.C {
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if time.Since(bucket.last) > refill {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimit ограничивает частоту запросов к операциям записи. Клиент определяется по id пользователя
+// из пути или поля user_id тела запроса, а если их нет - по IP-адресу
+func (app *application) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := app.rateLimiter.allow(app.rateLimitKey(r))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// rateLimitKey возвращает ключ клиента. Прочитанное начало тела возвращается перед остатком,
+// чтобы обработчик прочитал тело целиком и сам проверил его размер
+func (app *application) rateLimitKey(r *http.Request) string {
+	if id := httprouter.ParamsFromContext(r.Context()).ByName("id"); id != "" {
+		return "user:" + id
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, app.config.maxRequestBody))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err == nil {
+		var input struct {
+			UserId string `json:"user_id"`
+		}
+		if json.Unmarshal(body, &input) == nil && input.UserId != "" {
+			return "user:" + input.UserId
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
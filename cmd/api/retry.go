@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+// errDeadlockRetriesExhausted - операция каждый раз прерывалась взаимоблокировкой
+// и не выполнилась за -transfer-deadlock-retries повторов
+var errDeadlockRetriesExhausted = errors.New("deadlock retries exhausted")
+
+// retryOnDeadlock выполняет fn и повторяет ее, если Postgres прервал транзакцию из-за взаимоблокировки.
+// Пауза перед повтором начинается с -transfer-deadlock-backoff и удваивается, к ней добавляется
+// случайная добавка, чтобы столкнувшиеся транзакции не повторялись одновременно
+func (app *application) retryOnDeadlock(ctx context.Context, fn func() error) error {
+	backoff := app.config.transfer.deadlockBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !data.IsDeadlock(err) {
+			return err
+		}
+		if attempt > app.config.transfer.deadlockRetries {
+			return fmt.Errorf("%w after %d attempts: %w", errDeadlockRetriesExhausted, attempt, err)
+		}
+
+		app.logger.PrintInfo("deadlock detected, retrying", map[string]string{
+			"attempt": fmt.Sprintf("%d of %d", attempt, app.config.transfer.deadlockRetries),
+		})
+
+		pause := backoff
+		if backoff > 0 {
+			pause += rand.N(backoff)
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+func TestRetryOnDeadlock(t *testing.T) {
+	deadlock := &pq.Error{Code: "40P01", Message: "deadlock detected"}
+	other := errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "no deadlock", errs: []error{nil}, wantCalls: 1},
+		{name: "succeeds after retries", errs: []error{deadlock, deadlock, nil}, wantCalls: 3},
+		{name: "other error is not retried", errs: []error{other}, wantCalls: 1, wantErr: other},
+		{name: "retries exhausted", errs: []error{deadlock, deadlock, deadlock, deadlock, nil}, wantCalls: 4, wantErr: errDeadlockRetriesExhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.transfer.deadlockRetries = 3
+			cfg.transfer.deadlockBackoff = time.Millisecond
+			app := newTestApplication(t, cfg, nil)
+
+			calls := 0
+			err := app.retryOnDeadlock(context.Background(), func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls; want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryOnDeadlockCanceled(t *testing.T) {
+	cfg := testConfig()
+	cfg.transfer.deadlockBackoff = time.Hour
+	app := newTestApplication(t, cfg, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := app.retryOnDeadlock(ctx, func() error {
+		return &pq.Error{Code: "40P01"}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v; want %v", err, context.Canceled)
+	}
+}
+
+// TestTransferDeadlockRetry создает взаимоблокировку перевода с другой транзакцией: она держит
+// блокировку второго пользователя перевода и затем запрашивает блокировку первого. Postgres
+// прерывает перевод, а перевод повторяется и выполняется после отката этой транзакции
+func TestTransferDeadlockRetry(t *testing.T) {
+	db := newTestDB(t)
+	var log lockedBuffer
+	app := newTestApplication(t, testConfig(), db)
+	app.logger = jsonlog.New(&log, jsonlog.LevelInfo)
+	ts := newTestServer(t, app.routes())
+
+	sender, recipient := uuid.New(), uuid.New()
+	deposit(t, ts, sender, 100)
+
+	// Перевод блокирует пользователей в этом порядке
+	ids := []uuid.UUID{sender, recipient}
+	sortUserIds(ids)
+	first, second := ids[0], ids[1]
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	// Взаимоблокировку обнаружит перевод, у которого deadlock_timeout по умолчанию меньше
+	if _, err = tx.Exec(`SET LOCAL deadlock_timeout = '30s'`); err != nil {
+		t.Fatal(err)
+	}
+	if err = app.models.BonusEntries.LockUser(context.Background(), tx, second); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		status int
+		body   []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		status, _, body, err := ts.send(http.MethodPost, "/v1/transactions", map[string]any{
+			"user_id":    sender,
+			"to_user_id": recipient,
+			"amount":     40,
+			"type":       "transfer",
+		}, nil)
+		done <- result{status, body, err}
+	}()
+
+	waitForLockWaiters(t, app, 1)
+
+	// Перевод держит блокировку first и ждет second, эта транзакция ждет first
+	if err = app.models.BonusEntries.LockUser(context.Background(), tx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", res.status, http.StatusOK, res.body)
+	}
+	if !strings.Contains(log.String(), "deadlock detected, retrying") {
+		t.Error("got no retry logged after the deadlock")
+	}
+
+	for userId, want := range map[uuid.UUID]int{sender: 60, recipient: 40} {
+		if balance := balanceOf(t, app, userId); balance != want {
+			t.Errorf("user %s: got balance %d; want %d", userId, balance, want)
+		}
+	}
+}
+
+// lockedBuffer - буфер лога, который можно читать, пока сервер пишет в него из других горутин
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
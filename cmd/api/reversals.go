@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+// typeReversal - тип записи журнала, отменяющей другую операцию
+const typeReversal = "reversal"
+
+var (
+	errAlreadyReversed = errors.New("the transaction has already been reversed")
+	errNotReversible   = errors.New("transactions of this type cannot be reversed")
+	errReversalSpent   = errors.New("the points granted by the transaction have already been partly spent")
+	errReversalExpired = errors.New("the points granted by the transaction have already expired")
+)
+
+// reverseTransactionHandler отменяет операцию журнала по ее id. Начисление (deposit, multiply_percent
+// и пользовательские credit-типы) отменяется, только если созданные им баллы целиком активны:
+// они помечаются void. Списание (withdrawal, discount и debit-типы) отменяется возвратом списанных
+// баллов новым начислением со сроком жизни по умолчанию. Само сторно пишется в журнал как reversal
+func (app *application) reverseTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil || id == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	original, err := app.models.Transactions.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.userLimiter.acquire(original.UserId) {
+		app.tooManyConcurrentRequestsResponse(w, r)
+		return
+	}
+	defer app.userLimiter.release(original.UserId)
+
+	reversal, err := app.reverseTransaction(r.Context(), original)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAlreadyReversed), errors.Is(err, errNotReversible),
+			errors.Is(err, errReversalSpent), errors.Is(err, errReversalExpired):
+			app.reversalRejectedResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.balances.forget(reversal.UserId)
+
+	response := map[string]any{
+		"reversal": reversal,
+		"balance":  *reversal.ResultingBalance,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reverseTransaction отменяет операцию original в одной транзакции под блокировкой ее пользователя.
+// Возвращает запись сторно
+func (app *application) reverseTransaction(ctx context.Context, original *data.Transaction) (_ *data.Transaction, err error) {
+	ctx, span := tracer.Start(ctx, "db.transaction", trace.WithAttributes(
+		attribute.String("user_id", original.UserId.String()),
+		attribute.String("type", typeReversal),
+		attribute.String("transaction_id", original.Id.String()),
+	))
+	defer func() { endSpan(span, err) }()
+
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = app.models.BonusEntries.LockUser(ctx, tx, original.UserId); err != nil {
+		return nil, err
+	}
+
+	// Сторно не отменяется, как и операции, не менявшие баланс
+	if original.Type == typeReversal || original.Delta == 0 {
+		return nil, errNotReversible
+	}
+
+	reversed, err := app.models.Transactions.IsReversedTx(ctx, tx, original.Id)
+	if err != nil {
+		return nil, err
+	}
+	if reversed {
+		return nil, errAlreadyReversed
+	}
+
+	reversalId := uuid.New()
+
+	baseType := app.types[original.Type]
+	switch {
+	case baseType == typeDeposit || baseType == typeMultiplyPercent:
+		err = app.voidGrantedEntries(ctx, tx, original)
+	case baseType == typeWithdrawal || original.Type == "discount":
+		var lifetimeDays int
+		lifetimeDays, err = app.defaultLifetimeDays(ctx, original.UserId)
+		if err != nil {
+			return nil, err
+		}
+		// Списание могло затронуть несколько категорий, поэтому баллы возвращаются в категорию по умолчанию
+		_, err = app.handleDeposit(ctx, tx, original.UserId, -int(original.Delta), lifetimeDays, "", "", "", reversalId)
+	default:
+		err = errNotReversible
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := app.models.BonusEntries.GetTotalBalanceTx(ctx, tx, original.UserId)
+	if err != nil {
+		return nil, err
+	}
+	balance := data.Points(total)
+
+	// Сторно попадает в ту же группу correlation_id, что и отменяемая операция
+	correlationId := original.CorrelationId
+	if correlationId == nil {
+		correlationId = &original.Id
+	}
+
+	reversal := &data.Transaction{
+		Id:                    reversalId,
+		UserId:                original.UserId,
+		Type:                  typeReversal,
+		Amount:                original.Amount,
+		Delta:                 -original.Delta,
+		ResultingBalance:      &balance,
+		CorrelationId:         correlationId,
+		ReversedTransactionId: &original.Id,
+		CreatedAt:             time.Now(),
+	}
+	if err = app.insertTransaction(ctx, tx, reversal); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return reversal, nil
+}
+
+// voidGrantedEntries помечает void записи, созданные начислением original. Если часть баллов
+// уже списана или сгорела, начисление не отменяется
+func (app *application) voidGrantedEntries(ctx context.Context, tx *sql.Tx, original *data.Transaction) error {
+	entries, err := app.models.BonusEntries.GetByTransactionForUpdate(ctx, tx, original.Id)
+	if err != nil {
+		return err
+	}
+
+	// Записи, созданные до связи начислений с журналом, найти нельзя
+	if len(entries) == 0 {
+		return errNotReversible
+	}
+
+	now := time.Now()
+	var total data.Points
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		switch {
+		case entry.Status == data.BonusEntryStatusSpent:
+			return errReversalSpent
+		case entry.Status == data.BonusEntryStatusExpired || !entry.ExpiresAt().After(now):
+			return errReversalExpired
+		case entry.Status != data.BonusEntryStatusActive:
+			return errAlreadyReversed
+		}
+		total += entry.Amount
+		ids = append(ids, entry.Id.String())
+	}
+
+	// Остаток частично списанной записи тоже связан с начислением, но сумма будет меньше
+	if total != original.Delta {
+		return errReversalSpent
+	}
+
+	return app.models.BonusEntries.VoidEntries(ctx, tx, ids)
+}
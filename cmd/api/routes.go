@@ -10,8 +10,58 @@ func (app *application) routes() *httprouter.Router {
 
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
-	router.HandlerFunc(http.MethodPost, "/v1/transactions", app.createTransactionHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/time", app.showTimeHandler)
+	router.Handler(http.MethodGet, "/metrics", app.metrics.handler())
+
+	router.HandlerFunc(http.MethodGet, "/v1/transactions", app.listTransactionsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/transactions", app.rateLimit(app.createTransactionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/transactions/batch", app.rateLimit(app.createBatchHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/transactions/batch/validate", app.validateBatchHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/transactions/preview", app.previewTransactionHandler)
+	// Не /v1/transactions/:id/reverse: httprouter не допускает :id рядом с batch и preview
+	router.HandlerFunc(http.MethodPost, "/v1/transactions/reverse/:id", app.reverseTransactionHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/expiry-preview", app.showExpiryPreviewHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/entries/:id/extend", app.extendEntryHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/users/:id/balance", app.showUserBalanceHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/entries", app.listUserEntriesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/spend-plan", app.showSpendPlanHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/multiply-preview", app.showMultiplyPreviewHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/expiry-risk", app.showExpiryRiskHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/risk-breakdown", app.showRiskBreakdownHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/ledger", app.showUserLedgerHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/transactions", app.listUserTransactionsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/expiry-forecast", app.showExpiryForecastHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/recently-expired", app.listRecentlyExpiredHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/bonus-share", app.showBonusShareHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/to-target", app.showToTargetHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/expirations", app.listExpirationsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/oldest-grants", app.showOldestGrantsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/expiry-simulation", app.showExpirySimulationHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/:id/apply-discount", app.rateLimit(app.applyDiscountHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/analytics/expiring", app.limitReports(app.showExpiringLiabilityHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/analytics/volume", app.limitReports(app.showVolumeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/analytics/lifetime-impact", app.limitReports(app.showLifetimeImpactHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/analytics/balance-distribution", app.limitReports(app.showBalanceDistributionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.adminUserReportsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/settings", app.showUserSettingsHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/settings", app.updateUserSettingsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/admin/extend", app.extendLifetimesHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/admin/sources/:source/extend", app.extendSourceHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/admin/abuse", app.limitReports(app.listSuspectedAbuseHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/snapshot", app.limitReports(app.showSnapshotHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/activity", app.listActivityHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/admin/sweeper", app.showSweeperHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/admin/sweeper/pause", app.pauseSweeperHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/admin/sweeper/resume", app.resumeSweeperHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/admin/sweeper/run", app.runSweeperHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/admin/source-policies", app.listSourcePoliciesHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/admin/source-policies/:source", app.updateSourcePolicyHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/source-policies/:source", app.deleteSourcePolicyHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/admin/flags", app.listFlagsHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/admin/flags/:key", app.setFlagHandler)
 
 	return router
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// serve запускает HTTP-сервер и при SIGINT/SIGTERM останавливает его, давая текущим
+// запросам до timeouts.shutdown на завершение, чтобы не обрывать транзакции на середине
+func (app *application) serve() error {
+	router := app.routes()
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.logRequest(app.traceRequest(router, app.recoverPanic(app.observeLatency(router)))),
+		ErrorLog:     log.New(app.logger, "", 0),
+		IdleTimeout:  app.config.timeouts.idle,
+		ReadTimeout:  app.config.timeouts.read,
+		WriteTimeout: app.config.timeouts.write,
+	}
+
+	shutdownErr := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.PrintInfo("shutting down server", map[string]string{"signal": s.String()})
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.timeouts.shutdown)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+
+		app.logger.PrintInfo("waiting for expiry sweeper to stop", nil)
+		app.sweeper.stop()
+
+		shutdownErr <- err
+	}()
+
+	app.logger.PrintInfo("starting server", map[string]string{"addr": srv.Addr, "env": app.config.env})
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	if err = <-shutdownErr; err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("stopped server", map[string]string{"addr": srv.Addr})
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// snapshotPageSize - число записей, читаемых из БД за один запрос при выгрузке
+const snapshotPageSize = 1000
+
+// snapshotEntry - строка выгрузки активных начислений
+type snapshotEntry struct {
+	Seq          int64       `json:"seq"`
+	Id           uuid.UUID   `json:"id"`
+	UserId       uuid.UUID   `json:"user_id"`
+	Amount       data.Points `json:"amount"`
+	CreatedAt    time.Time   `json:"created_at"`
+	ExpiresAt    time.Time   `json:"expires_at"`
+	LifetimeDays int         `json:"lifetime_days"`
+}
+
+// showSnapshotHandler выгружает все активные начисления программы в виде NDJSON, сжатого gzip,
+// в порядке возрастания номера seq. Записи читаются из БД страницами, поэтому выгрузка не требует
+// одного большого запроса. Параметр since - seq последней записи предыдущей выгрузки. Курсор - номер,
+// а не id: id случайные, и запись, созданная после выгрузки, могла бы получить id меньше курсора
+func (app *application) showSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	after := int64(app.readInt(r.URL.Query(), "since", 0, v))
+	v.Check(after >= 0, "since", "must not be negative")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Первая страница читается до отправки заголовков, чтобы ошибку можно было вернуть обычным ответом
+	entries, err := app.models.BonusEntries.GetActiveEntriesPage(r.Context(), after, snapshotPageSize)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+
+	// При ошибке gzip-поток не закрывается, чтобы клиент увидел оборванную выгрузку, а не неполную
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	for len(entries) > 0 {
+		for _, entry := range entries {
+			err = enc.Encode(snapshotEntry{
+				Seq:          entry.Seq,
+				Id:           entry.Id,
+				UserId:       entry.UserId,
+				Amount:       entry.Amount,
+				CreatedAt:    entry.CreatedAt,
+				ExpiresAt:    entry.ExpiresAt(),
+				LifetimeDays: entry.LifetimeDays,
+			})
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"task": "snapshot"})
+				return
+			}
+		}
+
+		if len(entries) < snapshotPageSize {
+			break
+		}
+
+		after = entries[len(entries)-1].Seq
+		entries, err = app.models.BonusEntries.GetActiveEntriesPage(r.Context(), after, snapshotPageSize)
+		if err != nil {
+			// Заголовки уже отправлены, поэтому выгрузка просто обрывается
+			app.logger.PrintError(err, map[string]string{"task": "snapshot"})
+			return
+		}
+	}
+
+	if err = gz.Close(); err != nil {
+		app.logger.PrintError(err, map[string]string{"task": "snapshot"})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	var ids []uuid.UUID
+	for _, amount := range []int{10, 20, 30} {
+		entry := insertEntry(t, app, uuid.New(), amount, time.Now(), 30)
+		ids = append(ids, entry.Id)
+	}
+	spent := insertEntry(t, app, uuid.New(), 40, time.Now(), 30)
+	if _, err := db.Exec(`UPDATE bonus_entries SET status = 'spent', spent_at = NOW() WHERE id = $1`, spent.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot читает выгрузку и возвращает ее строки по порядку
+	snapshot := func(query string) []snapshotEntry {
+		t.Helper()
+
+		// С явным Accept-Encoding клиент не распаковывает ответ сам
+		status, header, body := ts.request(t, http.MethodGet, "/v1/admin/snapshot"+query, nil, http.Header{"Accept-Encoding": {"gzip"}})
+		if status != http.StatusOK {
+			t.Fatalf("got status %d: %s", status, body)
+		}
+		if header.Get("Content-Encoding") != "gzip" || header.Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("got Content-Encoding %q and Content-Type %q", header.Get("Content-Encoding"), header.Get("Content-Type"))
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []snapshotEntry
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var entry snapshotEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("line %q: %v", scanner.Text(), err)
+			}
+			got = append(got, entry)
+		}
+		if err = scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		return got
+	}
+
+	entryIds := func(entries []snapshotEntry) []uuid.UUID {
+		var got []uuid.UUID
+		for _, entry := range entries {
+			got = append(got, entry.Id)
+		}
+		return got
+	}
+
+	full := snapshot("")
+	if got := entryIds(full); !slices.Equal(got, ids) {
+		t.Fatalf("full snapshot: got %v; want active entries in creation order %v", got, ids)
+	}
+	for i := 1; i < len(full); i++ {
+		if full[i].Seq <= full[i-1].Seq {
+			t.Errorf("got seq %d after %d; want increasing seq", full[i].Seq, full[i-1].Seq)
+		}
+	}
+
+	// Запись, созданная после выгрузки, попадает в следующую, даже если ее id меньше всех прежних
+	cursor := full[1].Seq
+	lowest := &data.BonusEntry{
+		Id:           uuid.MustParse("00000000-0000-4000-8000-000000000000"),
+		UserId:       uuid.New(),
+		Amount:       50,
+		CreatedAt:    time.Now(),
+		LifetimeDays: 30,
+		Status:       data.BonusEntryStatusActive,
+	}
+	if err := app.models.BonusEntries.Insert(context.Background(), lowest); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []uuid.UUID{ids[2], lowest.Id}
+	if got := entryIds(snapshot(fmt.Sprintf("?since=%d", cursor))); !slices.Equal(got, want) {
+		t.Errorf("incremental snapshot: got %v; want %v", got, want)
+	}
+
+	if status, body := ts.get(t, "/v1/admin/snapshot?since=-1"); status != http.StatusUnprocessableEntity {
+		t.Errorf("negative since: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// expirySweeper периодически переводит просроченные записи в статус 'expired'.
+// Во время инцидентов его можно приостановить без перезапуска сервиса
+type expirySweeper struct {
+	model    data.BonusEntryModel
+	balances *balanceCache
+	paused   atomic.Bool
+
+	// running не дает запускать проходы одновременно (по расписанию и вручную)
+	running sync.Mutex
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+
+	mu          sync.Mutex
+	lastRun     *time.Time
+	lastExpired int64
+	lastError   string
+}
+
+// sweeperStatus - состояние фонового сгорания баллов
+type sweeperStatus struct {
+	Paused      bool       `json:"paused"`
+	Interval    string     `json:"interval"`
+	LastRun     *time.Time `json:"last_run"`
+	LastExpired int64      `json:"last_expired"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+func newExpirySweeper(model data.BonusEntryModel, balances *balanceCache) *expirySweeper {
+	return &expirySweeper{
+		model:    model,
+		balances: balances,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// sweep выполняет один проход, если сгорание не приостановлено или force.
+// Возвращает false, если проход был пропущен из-за паузы, и число сгоревших записей
+func (s *expirySweeper) sweep(ctx context.Context, force bool) (bool, int64, error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	if s.paused.Load() && !force {
+		return false, 0, nil
+	}
+
+	expired, err := s.model.UpdateExpiredEntries(ctx)
+	if expired > 0 {
+		s.balances.invalidate()
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	s.lastRun = &now
+	s.lastExpired = expired
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	s.mu.Unlock()
+
+	return true, expired, err
+}
+
+func (s *expirySweeper) status(interval time.Duration) sweeperStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sweeperStatus{
+		Paused:      s.paused.Load(),
+		Interval:    interval.String(),
+		LastRun:     s.lastRun,
+		LastExpired: s.lastExpired,
+		LastError:   s.lastError,
+	}
+}
+
+// stop останавливает проходы по расписанию и дожидается завершения текущего прохода
+func (s *expirySweeper) stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+// startSweeper запускает в фоне проходы сгорания с заданным интервалом до вызова stop
+func (app *application) startSweeper(interval time.Duration) {
+	app.sweeper.wg.Add(1)
+	go app.sweepExpiredPeriodically(interval)
+}
+
+func (app *application) sweepExpiredPeriodically(interval time.Duration) {
+	defer app.sweeper.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.sweeper.stopCh:
+			return
+		case <-ticker.C:
+			ran, expired, err := app.sweeper.sweep(context.Background(), false)
+			switch {
+			case err != nil:
+				app.logger.PrintError(err, map[string]string{"task": "expiry sweep"})
+			case ran:
+				app.logger.PrintInfo("expiry sweep finished", map[string]string{"expired": strconv.FormatInt(expired, 10)})
+			}
+		}
+	}
+}
+
+func (app *application) showSweeperHandler(w http.ResponseWriter, r *http.Request) {
+	status := app.sweeper.status(app.config.sweeper.interval)
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]any{"sweeper": status}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) pauseSweeperHandler(w http.ResponseWriter, r *http.Request) {
+	app.sweeper.paused.Store(true)
+	app.logger.PrintInfo("expiry sweeper paused", nil)
+
+	app.showSweeperHandler(w, r)
+}
+
+func (app *application) resumeSweeperHandler(w http.ResponseWriter, r *http.Request) {
+	app.sweeper.paused.Store(false)
+	app.logger.PrintInfo("expiry sweeper resumed", nil)
+
+	app.showSweeperHandler(w, r)
+}
+
+// runSweeperHandler запускает проход сгорания вне расписания. Если сгорание приостановлено,
+// проход выполняется только с force=true
+func (app *application) runSweeperHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	force := app.readBool(r.URL.Query(), "force", false, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ran, expired, err := app.sweeper.sweep(r.Context(), force)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ran {
+		app.sweeperPausedResponse(w, r)
+		return
+	}
+
+	app.logger.PrintInfo("expiry sweeper run manually", map[string]string{
+		"force":   strconv.FormatBool(force),
+		"expired": strconv.FormatInt(expired, 10),
+	})
+
+	if err = app.writeJSON(w, http.StatusOK, map[string]any{"expired": expired}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
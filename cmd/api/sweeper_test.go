@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestRecentlyExpired(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	createdAt := time.Now().AddDate(0, 0, -10).Truncate(time.Second)
+	expired := insertEntry(t, app, userId, 10, createdAt, 5)
+	old := insertEntry(t, app, userId, 20, createdAt.AddDate(0, 0, -60), 5)
+	insertEntry(t, app, userId, 30, time.Now(), 30)
+
+	before := time.Now().Add(-time.Second)
+	if _, _, err := app.sweeper.sweep(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(time.Second)
+
+	// Запись сгорела раньше окна запроса
+	_, err := db.Exec(`UPDATE bonus_entries SET expired_at = NOW() - INTERVAL '40 days' WHERE id = $1`, old.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Total   int                  `json:"total"`
+		Entries []*data.ExpiredEntry `json:"entries"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/recently-expired?days=30", userId), &response)
+
+	if response.Total != 10 || len(response.Entries) != 1 {
+		t.Fatalf("got total %d and %d entries; want 10 and 1", response.Total, len(response.Entries))
+	}
+
+	entry := response.Entries[0]
+	if entry.Id != expired.Id || entry.Amount != 10 {
+		t.Errorf("got entry %s of %d; want %s of 10", entry.Id, entry.Amount, expired.Id)
+	}
+	if !entry.CreatedAt.Equal(createdAt) {
+		t.Errorf("got created_at %v; want %v", entry.CreatedAt, createdAt)
+	}
+	if entry.ExpiredAt.Before(before) || entry.ExpiredAt.After(after) {
+		t.Errorf("got expired_at %v; want the sweep time", entry.ExpiredAt)
+	}
+}
+
+func TestExpirationsInRange(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	createdAt := time.Now().AddDate(0, 0, -60)
+	var entries []*data.BonusEntry
+	for _, amount := range []int{10, 20, 30} {
+		entries = append(entries, insertEntry(t, app, userId, amount, createdAt, 5))
+	}
+	if _, _, err := app.sweeper.sweep(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Сдвигаем время сгорания, как если бы проходы были в разные дни (полдень по UTC)
+	y, m, d := time.Now().UTC().Date()
+	today := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	expiredAt := []time.Time{today.AddDate(0, 0, -10), today.AddDate(0, 0, -3), today.AddDate(0, 0, -1)}
+	for i, entry := range entries {
+		if _, err := db.Exec(`UPDATE bonus_entries SET expired_at = $2 WHERE id = $1`, entry.Id, expiredAt[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var response struct {
+		Total   int                  `json:"total"`
+		Entries []*data.ExpiredEntry `json:"entries"`
+	}
+	url := fmt.Sprintf("/v1/users/%s/expirations?from=%s&to=%s", userId,
+		today.AddDate(0, 0, -5).Format("2006-01-02"), today.AddDate(0, 0, -1).Format("2006-01-02"))
+	ts.mustGet(t, url, &response)
+
+	if response.Total != 50 || len(response.Entries) != 2 {
+		t.Fatalf("got total %d and %d entries; want 50 and 2", response.Total, len(response.Entries))
+	}
+	for i, entry := range response.Entries {
+		want := entries[i+1]
+		if entry.Id != want.Id || entry.Amount != want.Amount || !entry.ExpiredAt.Equal(expiredAt[i+1]) {
+			t.Errorf("entry %d: got %s of %d expired at %v; want %s of %d expired at %v",
+				i, entry.Id, entry.Amount, entry.ExpiredAt, want.Id, want.Amount, expiredAt[i+1])
+		}
+	}
+}
+
+func TestSweeperPauseResume(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.sweeper.interval = 10 * time.Millisecond
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	insertEntry(t, app, userId, 10, time.Now().AddDate(0, 0, -10), 5)
+
+	var response struct {
+		Sweeper sweeperStatus `json:"sweeper"`
+	}
+	ts.mustPost(t, "/v1/admin/sweeper/pause", nil, &response)
+	if !response.Sweeper.Paused {
+		t.Fatal("got sweeper not paused after pause")
+	}
+
+	app.startSweeper(cfg.sweeper.interval)
+	t.Cleanup(app.sweeper.stop)
+
+	// Несколько тиков на паузе ничего не сжигают
+	time.Sleep(10 * cfg.sweeper.interval)
+	if status := entryStatus(t, app, userId); status != data.BonusEntryStatusActive {
+		t.Fatalf("got entry %s while paused; want active", status)
+	}
+	ts.mustGet(t, "/v1/admin/sweeper", &response)
+	if response.Sweeper.LastRun != nil {
+		t.Errorf("got last_run %v while paused; want none", response.Sweeper.LastRun)
+	}
+
+	ts.mustPost(t, "/v1/admin/sweeper/resume", nil, &response)
+	if response.Sweeper.Paused {
+		t.Fatal("got sweeper paused after resume")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for entryStatus(t, app, userId) != data.BonusEntryStatusExpired {
+		if time.Now().After(deadline) {
+			t.Fatal("got entry not expired after resume")
+		}
+		time.Sleep(cfg.sweeper.interval)
+	}
+
+	ts.mustGet(t, "/v1/admin/sweeper", &response)
+	if response.Sweeper.LastRun == nil {
+		t.Error("got no last_run after resume")
+	}
+}
+
+// entryStatus возвращает статус единственной записи пользователя
+func entryStatus(t *testing.T, app *application, userId uuid.UUID) data.BonusEntryStatus {
+	t.Helper()
+
+	var status data.BonusEntryStatus
+	err := app.db.QueryRow(`SELECT status FROM bonus_entries WHERE user_id = $1`, userId).Scan(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status
+}
+
+func TestRunSweeper(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId, other, live := uuid.New(), uuid.New(), uuid.New()
+	insertEntry(t, app, userId, 10, time.Now().AddDate(0, 0, -10), 5)
+	insertEntry(t, app, other, 20, time.Now().AddDate(0, 0, -40), 30)
+	insertEntry(t, app, live, 30, time.Now(), 30)
+
+	ts.mustPost(t, "/v1/admin/sweeper/pause", nil, nil)
+
+	// На паузе ручной проход выполняется только с force=true
+	if status, body := ts.postJSON(t, "/v1/admin/sweeper/run", nil); status != http.StatusConflict {
+		t.Errorf("run while paused: got status %d; want %d: %s", status, http.StatusConflict, body)
+	}
+	if status := entryStatus(t, app, userId); status != data.BonusEntryStatusActive {
+		t.Fatalf("got entry %s after a refused run; want active", status)
+	}
+
+	var response struct {
+		Expired int64 `json:"expired"`
+	}
+	ts.mustPost(t, "/v1/admin/sweeper/run?force=true", nil, &response)
+	if response.Expired != 2 {
+		t.Errorf("got expired %d; want 2", response.Expired)
+	}
+	for _, id := range []uuid.UUID{userId, other} {
+		if status := entryStatus(t, app, id); status != data.BonusEntryStatusExpired {
+			t.Errorf("got entry %s after a forced run; want expired", status)
+		}
+	}
+	if status := entryStatus(t, app, live); status != data.BonusEntryStatusActive {
+		t.Errorf("got live entry %s; want active", status)
+	}
+
+	// Без паузы проход выполняется без force, а повторный проход ничего не находит
+	ts.mustPost(t, "/v1/admin/sweeper/resume", nil, nil)
+	ts.mustPost(t, "/v1/admin/sweeper/run", nil, &response)
+	if response.Expired != 0 {
+		t.Errorf("second run: got expired %d; want 0", response.Expired)
+	}
+}
+
+func TestExpirySweep(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+
+	expired, live := uuid.New(), uuid.New()
+	insertEntry(t, app, expired, 10, time.Now().AddDate(0, 0, -10), 5)
+	insertEntry(t, app, live, 20, time.Now(), 30)
+
+	ran, count, err := app.sweeper.sweep(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ran || count != 1 {
+		t.Errorf("got ran %t, expired %d; want true, 1", ran, count)
+	}
+
+	if status := entryStatus(t, app, expired); status != data.BonusEntryStatusExpired {
+		t.Errorf("got expired entry %s; want expired", status)
+	}
+	if status := entryStatus(t, app, live); status != data.BonusEntryStatusActive {
+		t.Errorf("got live entry %s; want active", status)
+	}
+
+	var expiredAt *time.Time
+	err = app.db.QueryRow(`SELECT expired_at FROM bonus_entries WHERE user_id = $1`, expired).Scan(&expiredAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiredAt == nil {
+		t.Error("got no expired_at after the sweep")
+	}
+}
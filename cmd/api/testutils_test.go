@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/jsonlog"
+)
+
+// testDSNEnv - переменная окружения с DSN тестовой PostgreSQL. Тесты, которым нужна БД,
+// без нее пропускаются, остальные работают без БД
+const testDSNEnv = "LEDGER_TEST_DSN"
+
+// testSchema - схема тестовой БД этого пакета. У internal/data своя схема, поэтому пакеты
+// можно тестировать одновременно на одной БД
+const testSchema = "ledger_api_test"
+
+// newTestDB открывает тестовую БД из LEDGER_TEST_DSN и создает в ней пустую схему
+// по всем миграциям. Каждый тест начинает с чистыми таблицами
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", withSearchPath(dsn, testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %[1]s CASCADE; CREATE SCHEMA %[1]s", testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Glob возвращает файлы в лексическом порядке, то есть в порядке номеров миграций
+	migrations, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range migrations {
+		script, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(string(script)); err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+	}
+
+	return db
+}
+
+// withSearchPath добавляет к DSN (URL или key=value) схему по умолчанию для соединений
+func withSearchPath(dsn, schema string) string {
+	switch {
+	case !strings.Contains(dsn, "://"):
+		return dsn + " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		return dsn + "&search_path=" + schema
+	default:
+		return dsn + "?search_path=" + schema
+	}
+}
+
+// testConfig возвращает конфигурацию со значениями флагов по умолчанию. Ограничение частоты
+// запросов выключено, чтобы тесты могли выполнять много операций одного пользователя подряд
+func testConfig() config {
+	var cfg config
+
+	cfg.env = "testing"
+	cfg.timezone = "Local"
+	cfg.defaultLifetimeDays = 30
+	cfg.duplicateReferencePolicy = "skip"
+	cfg.sourceValidation = "lenient"
+	cfg.maxRequestBody = 10 * 1024
+	cfg.maxBatchRequestBody = 1024 * 1024
+	cfg.balanceCacheTTL = 5 * time.Second
+	cfg.db.queryTimeout = 3 * time.Second
+	cfg.limits.maxConcurrentReports = 4
+	cfg.limits.minDeposit = 1
+	cfg.limits.maxLifetimeDays = 365
+	cfg.limits.maxExtensionDays = 365
+	cfg.limits.spendPreviewEntries = 100
+	cfg.fragments.policy = "keep"
+	cfg.flags.refreshInterval = 30 * time.Second
+	cfg.sweeper.interval = time.Hour
+	cfg.idempotency.ttl = 24 * time.Hour
+	cfg.outbox.interval = 5 * time.Second
+	cfg.transfer.provenance = "request"
+	cfg.transfer.deadlockRetries = 3
+	cfg.transfer.deadlockBackoff = 50 * time.Millisecond
+
+	return cfg
+}
+
+// newTestApplication собирает приложение так же, как main, но без фоновых задач и с логом,
+// который ничего не пишет. db может быть nil для тестов, которые не обращаются к БД
+func newTestApplication(t *testing.T, cfg config, db *sql.DB) *application {
+	t.Helper()
+
+	types, err := newTransactionTypes(cfg.customTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toleratedFields, err := newToleratedFields(cfg.toleratedFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := time.LoadLocation(cfg.timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.NewModels(db, cfg.db.queryTimeout)
+	models.BonusEntries.Fragments = data.FragmentPolicy{
+		MinAmount: cfg.fragments.minAmount,
+		Forfeit:   cfg.fragments.policy == "forfeit",
+	}
+	models.IdempotencyKeys.TTL = cfg.idempotency.ttl
+	data.SetPointsAsStrings(cfg.amountsAsStrings)
+	t.Cleanup(func() { data.SetPointsAsStrings(false) })
+
+	balances := newBalanceCache(cfg.balanceCache, cfg.balanceCacheTTL, models.BonusEntries)
+
+	app := &application{
+		config: cfg,
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: models,
+		db:     db,
+
+		location:        location,
+		types:           types,
+		toleratedFields: toleratedFields,
+		userLimiter:     newUserLimiter(cfg.limits.maxConcurrentPerUser),
+		rateLimiter:     newRateLimiter(cfg.rateLimit.rps, cfg.rateLimit.burst),
+		metrics:         newMetrics(db),
+		flags:           newFeatureFlags(models.Flags),
+		balances:        balances,
+		sweeper:         newExpirySweeper(models.BonusEntries, balances),
+	}
+
+	if cfg.limits.maxConcurrentReports > 0 {
+		app.reportSlots = make(chan struct{}, cfg.limits.maxConcurrentReports)
+	}
+
+	return app
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// request отправляет запрос и возвращает код, заголовки и тело ответа. body - строка
+// с готовым телом или значение, которое кодируется в JSON; nil - запрос без тела
+func (ts *testServer) request(t *testing.T, method, urlPath string, body any, header http.Header) (int, http.Header, []byte) {
+	t.Helper()
+
+	status, respHeader, respBody, err := ts.send(method, urlPath, body, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, respHeader, respBody
+}
+
+// send работает как request, но возвращает ошибку, поэтому его можно вызывать из других горутин
+func (ts *testServer) send(method, urlPath string, body any, header http.Header) (int, http.Header, []byte, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		reader = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, reader)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer rs.Body.Close()
+
+	respBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return rs.StatusCode, rs.Header, respBody, nil
+}
+
+func (ts *testServer) get(t *testing.T, urlPath string) (int, []byte) {
+	t.Helper()
+
+	status, _, body := ts.request(t, http.MethodGet, urlPath, nil, nil)
+	return status, body
+}
+
+func (ts *testServer) postJSON(t *testing.T, urlPath string, body any) (int, []byte) {
+	t.Helper()
+
+	status, _, respBody := ts.request(t, http.MethodPost, urlPath, body, nil)
+	return status, respBody
+}
+
+// mustPost отправляет POST и проверяет, что ответ 200, а тело раскодировано в dst (если dst не nil)
+func (ts *testServer) mustPost(t *testing.T, urlPath string, body any, dst any) {
+	t.Helper()
+
+	status, respBody := ts.postJSON(t, urlPath, body)
+	if status != http.StatusOK {
+		t.Fatalf("POST %s: got status %d; want %d: %s", urlPath, status, http.StatusOK, respBody)
+	}
+	if dst != nil {
+		decodeJSON(t, respBody, dst)
+	}
+}
+
+// mustGet отправляет GET, проверяет, что ответ 200, и раскодирует тело в dst
+func (ts *testServer) mustGet(t *testing.T, urlPath string, dst any) {
+	t.Helper()
+
+	status, body := ts.get(t, urlPath)
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: got status %d; want %d: %s", urlPath, status, http.StatusOK, body)
+	}
+	decodeJSON(t, body, dst)
+}
+
+func decodeJSON(t *testing.T, body []byte, dst any) {
+	t.Helper()
+
+	if err := json.Unmarshal(body, dst); err != nil {
+		t.Fatalf("decode %s: %v", body, err)
+	}
+}
+
+// deposit начисляет пользователю amount баллов со сроком жизни по умолчанию через POST /v1/transactions
+func deposit(t *testing.T, ts *testServer, userId uuid.UUID, amount int) {
+	t.Helper()
+
+	ts.mustPost(t, "/v1/transactions", map[string]any{
+		"user_id": userId,
+		"amount":  amount,
+		"type":    "deposit",
+	}, nil)
+}
+
+// withdraw списывает у пользователя amount баллов через POST /v1/transactions
+func withdraw(t *testing.T, ts *testServer, userId uuid.UUID, amount int) {
+	t.Helper()
+
+	ts.mustPost(t, "/v1/transactions", map[string]any{
+		"user_id": userId,
+		"amount":  amount,
+		"type":    "withdrawal",
+	}, nil)
+}
+
+// insertEntry записывает активное начисление напрямую в БД, например с датой в прошлом.
+// Дата сгорания - createdAt плюс lifetimeDays
+func insertEntry(t *testing.T, app *application, userId uuid.UUID, amount int, createdAt time.Time, lifetimeDays int) *data.BonusEntry {
+	t.Helper()
+
+	entry := &data.BonusEntry{
+		Id:           uuid.New(),
+		UserId:       userId,
+		Amount:       data.Points(amount),
+		CreatedAt:    createdAt,
+		LifetimeDays: lifetimeDays,
+		Status:       data.BonusEntryStatusActive,
+	}
+	if err := app.models.BonusEntries.Insert(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	return entry
+}
+
+// balanceOf возвращает общий баланс пользователя из БД
+func balanceOf(t *testing.T, app *application, userId uuid.UUID) int {
+	t.Helper()
+
+	balance, err := app.models.BonusEntries.GetTotalBalance(context.Background(), userId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return balance
+}
+
+// listEntries возвращает записи баллов пользователя в любом статусе через GET /v1/users/:id/entries
+func listEntries(t *testing.T, ts *testServer, userId uuid.UUID) []entryResponse {
+	t.Helper()
+
+	var response struct {
+		Entries []entryResponse `json:"entries"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/entries", userId), &response)
+
+	return response.Entries
+}
+
+// logTransaction записывает операцию в журнал напрямую, например с датой в прошлом
+func logTransaction(t *testing.T, app *application, userId uuid.UUID, txType string, delta int, createdAt time.Time) {
+	t.Helper()
+
+	amount := delta
+	if amount < 0 {
+		amount = -amount
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	err = app.models.Transactions.Insert(context.Background(), tx, &data.Transaction{
+		Id:        uuid.New(),
+		UserId:    userId,
+		Type:      txType,
+		Amount:    data.Points(amount),
+		Delta:     data.Points(delta),
+		CreatedAt: createdAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
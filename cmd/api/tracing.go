@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName - имя трассировщика HTTP-запросов и транзакций БД
+const tracerName = "simple-ledger.itmo.ru/cmd/api"
+
+var tracer = otel.Tracer(tracerName)
+
+// setupTracing включает экспорт трассировок по OTLP/HTTP на endpoint. Без endpoint провайдер
+// трассировок остается глобальным no-op, и спаны ничего не стоят. Возвращает функцию, которая
+// отправляет накопленные спаны и останавливает экспорт
+func setupTracing(ctx context.Context, endpoint string, env string) (func(context.Context) error, error) {
+	// Контекст трассировки принимается из заголовков traceparent/tracestate входящих запросов
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "itmo-ledger"),
+			attribute.String("deployment.environment", env),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// traceRequest открывает спан на каждый HTTP-запрос, продолжая трассировку клиента, если она передана.
+// Спан называется по шаблону маршрута, а контекст со спаном передается обработчику и моделям
+func (app *application) traceRequest(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := routePattern(router, r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(rec.status))
+		}
+	})
+}
+
+// endSpan закрывает спан, помечая его ошибочным, если операция завершилась ошибкой
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,128 +3,684 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
-
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"simple-ledger.itmo.ru/internal/data"
 	"simple-ledger.itmo.ru/internal/validator"
 )
 
+const (
+	// maxSourceLength - максимальная длина источника начисления
+	maxSourceLength = 64
+	// maxExternalReferenceLength - максимальная длина внешнего id начисления
+	maxExternalReferenceLength = 128
+)
+
 type transactionIn struct {
-	UserId       string `json:"user_id"`
-	Amount       int    `json:"amount"`
-	Type         string `json:"type"`
-	LifetimeDays *int   `json:"lifetime_days,omitempty"`
+	UserId       string      `json:"user_id"`
+	Amount       int         `json:"amount"`
+	Type         string      `json:"type"`
+	LifetimeDays nullableInt `json:"lifetime_days"`
+	Source       string      `json:"source"`
+	ToUserId     string      `json:"to_user_id"`
+	// ExternalReference - id начисления во внешней системе для защиты от повторного импорта
+	ExternalReference string `json:"external_reference"`
+	// Category - категория начисления, а для списания и перевода - категория, из которой списываются
+	// баллы (пусто - из всех). omitempty сохраняет хэши ключей идемпотентности запросов без категории
+	Category string `json:"category,omitempty"`
+}
+
+// nullableInt - необязательное целое поле JSON, для которого отличается явный null от отсутствия поля
+type nullableInt struct {
+	Value *int
+	Null  bool
+}
+
+func (n *nullableInt) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		n.Value = nil
+		n.Null = true
+		return nil
+	}
+
+	var value int
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	n.Value = &value
+	return nil
+}
+
+type spendPlanResponse struct {
+	UserId    uuid.UUID            `json:"user_id"`
+	Requested data.Points          `json:"requested"`
+	Available data.Points          `json:"available"`
+	Amount    data.Points          `json:"amount"`
+	Plan      []data.SpendPlanItem `json:"plan"`
+	// Truncated - план обрезан по limit и не покрывает amount целиком
+	Truncated bool `json:"truncated"`
+}
+
+type expiryRiskResponse struct {
+	UserId           uuid.UUID   `json:"user_id"`
+	Balance          data.Points `json:"balance"`
+	Threshold        data.Points `json:"threshold"`
+	Days             int         `json:"days"`
+	Expiring         data.Points `json:"expiring"`
+	ProjectedBalance data.Points `json:"projected_balance"`
+	AtRisk           bool        `json:"at_risk"`
+	Shortfall        data.Points `json:"shortfall"`
+}
+
+type expiryForecastItem struct {
+	Date       string      `json:"date"`
+	Amount     data.Points `json:"amount"`
+	Cumulative data.Points `json:"cumulative"`
+	Remaining  data.Points `json:"remaining"`
+}
+
+type entryResponse struct {
+	Id        uuid.UUID             `json:"id"`
+	Amount    data.Points           `json:"amount"`
+	Category  string                `json:"category"`
+	Status    data.BonusEntryStatus `json:"status"`
+	CreatedAt time.Time             `json:"created_at"`
+	ExpiresAt time.Time             `json:"expires_at"`
+	SpentAt   *time.Time            `json:"spent_at,omitempty"`
+	ExpiredAt *time.Time            `json:"expired_at,omitempty"`
+}
+
+// grantResponse - запись баллов, созданная начислением, для ответа с include=entry
+type grantResponse struct {
+	Id           uuid.UUID `json:"id"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	LifetimeDays int       `json:"lifetime_days"`
 }
 
 type balanceResponse struct {
-	UserId   uuid.UUID      `json:"user_id"`
-	Balance  int            `json:"balance"`
-	Expiring map[string]int `json:"expiring"`
+	UserId   uuid.UUID            `json:"user_id"`
+	Balance  data.Points          `json:"balance"`
+	Expiring []data.ExpiringTotal `json:"expiring"`
+}
+
+// validateTransaction проверяет входные данные одной транзакции и возвращает id пользователя
+func (app *application) validateTransaction(v *validator.Validator, trxIn *transactionIn) uuid.UUID {
+	userId, err := uuid.Parse(trxIn.UserId)
+
+	v.Check(err == nil, "user_id", "must be uuid")
+	v.Check(trxIn.Amount > 0, "amount", "must be positive")
+
+	// Сумма хранится в БД как int4, а размер int зависит от платформы. В строгом режиме суммы
+	// больше int32 отклоняются одинаково на любой платформе
+	if app.config.strictAmounts {
+		v.Check(int64(trxIn.Amount) <= math.MaxInt32, "amount", fmt.Sprintf("must not be more than %d", math.MaxInt32))
+	}
+	v.Check(validator.IsPermitted(trxIn.Type, app.types.names()...), "type", "must be one of "+strings.Join(app.types.names(), ", "))
+
+	// Бонус multiply_percent начисляется даже если он меньше min-deposit: ограничение касается только прямых начислений
+	if app.types[trxIn.Type] == typeDeposit {
+		v.Check(trxIn.Amount >= app.config.limits.minDeposit, "amount", fmt.Sprintf("must be at least %d", app.config.limits.minDeposit))
+	}
+
+	// Ограничение одного списания не зависит от баланса и снижает ущерб от скомпрометированного клиента
+	if app.types[trxIn.Type] == typeWithdrawal && app.config.limits.maxWithdrawal > 0 {
+		v.Check(trxIn.Amount <= app.config.limits.maxWithdrawal, "amount", fmt.Sprintf("must not be more than %d", app.config.limits.maxWithdrawal))
+	}
+
+	// Проверка lifetime_days, если указан
+	if trxIn.LifetimeDays.Value != nil {
+		v.Check(*trxIn.LifetimeDays.Value > 0, "lifetime_days", "must be positive")
+	}
+
+	// Получатель указывается только для перевода и должен отличаться от отправителя
+	if app.types[trxIn.Type] == typeTransfer {
+		toUserId, toErr := uuid.Parse(trxIn.ToUserId)
+		v.Check(toErr == nil, "to_user_id", "must be uuid")
+		v.Check(toErr != nil || err != nil || toUserId != userId, "to_user_id", "must differ from user_id")
+	} else {
+		v.Check(trxIn.ToUserId == "", "to_user_id", "must be empty unless type is transfer")
+	}
+
+	app.checkSource(v, "source", &trxIn.Source)
+	v.Check(len(trxIn.Source) <= maxSourceLength, "source", fmt.Sprintf("must not be more than %d bytes long", maxSourceLength))
+
+	// Категория нормализуется так же, как источник, чтобы Promo и promo не стали разными балансами
+	app.checkSource(v, "category", &trxIn.Category)
+	v.Check(len(trxIn.Category) <= maxSourceLength, "category", fmt.Sprintf("must not be more than %d bytes long", maxSourceLength))
+
+	if app.types[trxIn.Type] == typeDeposit {
+		v.Check(len(trxIn.ExternalReference) <= maxExternalReferenceLength, "external_reference", fmt.Sprintf("must not be more than %d bytes long", maxExternalReferenceLength))
+	} else {
+		v.Check(trxIn.ExternalReference == "", "external_reference", "must be empty unless type is a deposit")
+	}
+
+	// Явный null по умолчанию означает срок жизни по умолчанию, как и отсутствие поля.
+	// С -reject-null-lifetime такой запрос считается ошибкой клиента
+	if app.config.rejectNullLifetime {
+		v.Check(!trxIn.LifetimeDays.Null, "lifetime_days", "must be a positive integer or omitted")
+	}
+
+	return userId
+}
+
+// checkSource приводит источник начисления к единому виду, чтобы "Promo", "promo " и "promo"
+// не дробили отчеты. С -source-validation=lenient пробелы по краям убираются, а буквы переводятся
+// в нижний регистр, со strict такой источник отклоняется
+// newToleratedFields разбирает список будущих полей транзакции через запятую ("promo_code,channel"),
+// которые принимаются и игнорируются. Поле, которое транзакция уже поддерживает, отклоняется:
+// иначе его значение молча отбрасывалось бы
+func newToleratedFields(list string) ([]string, error) {
+	var fields []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(strings.NewReader("{" + string(key) + ":null}"))
+		dec.DisallowUnknownFields()
+		var trxIn transactionIn
+		if dec.Decode(&trxIn) == nil {
+			return nil, fmt.Errorf("tolerated field %q is already supported by transactions", name)
+		}
+
+		fields = append(fields, name)
+	}
+
+	return fields, nil
+}
+
+func (app *application) checkSource(v *validator.Validator, key string, source *string) {
+	normalized := strings.ToLower(strings.TrimSpace(*source))
+
+	if app.config.sourceValidation == "strict" {
+		v.Check(*source == normalized, key, "must be lowercase without leading or trailing whitespace")
+		return
+	}
+
+	*source = normalized
 }
 
 func (app *application) createTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	// Тип в метрике указывается только для прошедших проверку запросов, чтобы произвольные
+	// значения из запроса не раздували число временных рядов
+	metricType, result := "unknown", "error"
+	defer func() {
+		app.metrics.transactions.WithLabelValues(metricType, result).Inc()
+	}()
+
 	var trxIn transactionIn
-	err := app.readJSON(w, r, &trxIn)
+	err := app.readJSONTolerant(w, r, &trxIn, app.config.maxRequestBody, app.toleratedFields...)
 	if err != nil {
+		result = "invalid"
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	userId, err := uuid.Parse(trxIn.UserId)
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
 
-	v := validator.New()
-	v.Check(err == nil, "user_id", "must be uuid")
-	v.Check(trxIn.Amount > 0, "amount", "must be positive")
-	v.Check(validator.IsPermitted(trxIn.Type, "deposit", "withdrawal"), "type", "must be deposit or withdrawal")
+	include := r.URL.Query().Get("include")
 
-	// Проверка lifetime_days, если указан
-	if trxIn.LifetimeDays != nil {
-		v.Check(*trxIn.LifetimeDays > 0, "lifetime_days", "must be positive")
-	}
+	v := validator.New()
+	userId := app.validateTransaction(v, &trxIn)
+	v.Check(len(idempotencyKey) <= maxIdempotencyKeyLength, "idempotency_key", fmt.Sprintf("must not be more than %d bytes long", maxIdempotencyKeyLength))
+	v.Check(validator.IsPermitted(include, "", "entry"), "include", "must be entry")
 
 	if !v.Valid() {
+		result = "invalid"
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	metricType = trxIn.Type
+
+	// Пользовательские типы обрабатываются так же, как их базовый тип, но в журнал пишутся под своим именем
+	baseType := app.types[trxIn.Type]
+
+	if !app.flags.enabled(transactionTypeFlags[baseType]) {
+		result = "disabled"
+		app.featureDisabledResponse(w, r)
+		return
+	}
 
-	lifetimeDays := 30
-	if trxIn.LifetimeDays != nil {
-		lifetimeDays = *trxIn.LifetimeDays
+	if !app.userLimiter.acquire(userId) {
+		result = "limited"
+		app.tooManyConcurrentRequestsResponse(w, r)
+		return
 	}
+	defer app.userLimiter.release(userId)
 
-	// Начинаем транзакцию
-	tx, err := app.db.Begin()
+	op, err := app.newTransactionOp(r.Context(), &trxIn, userId)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	defer tx.Rollback()
-	// Skip balance table check - bonus entries system doesn't require user pre-registration
+	op.includeEntry = include == "entry"
 
-	if trxIn.Type == "deposit" {
-		err = app.handleDeposit(tx, userId, trxIn.Amount, lifetimeDays)
+	// Перевод блокирует двух пользователей и может взаимоблокироваться с другими операциями,
+	// поэтому при взаимоблокировке он повторяется целиком. Операции одного пользователя не повторяются
+	var outcome *transactionOutcome
+	run := func() error {
+		outcome, err = app.runTransaction(r.Context(), op, idempotencyKey)
+		return err
+	}
+	if baseType == typeTransfer {
+		err = app.retryOnDeadlock(r.Context(), run)
 	} else {
-		err = app.handleWithdrawal(tx, userId, trxIn.Amount)
+		err = run()
 	}
 
 	if err != nil {
-		if errors.Is(err, data.ErrInsufficientFunds) {
+		switch {
+		case errors.Is(err, data.ErrInsufficientFunds):
+			result = "insufficient_funds"
 			app.badRequestResponse(w, r, err)
-			return
+		case errors.Is(err, data.ErrDuplicateReference):
+			result = "duplicate_reference"
+			app.duplicateReferenceResponse(w, r)
+		case errors.Is(err, errMultiplyOverflow):
+			result = "multiply_overflow"
+			app.multiplyOverflowResponse(w, r)
+		case errors.Is(err, errIdempotencyKeyReused):
+			result = "idempotency_key_reused"
+			app.idempotencyKeyReusedResponse(w, r)
+		case errors.Is(err, errDeadlockRetriesExhausted):
+			result = "deadlock"
+			app.deadlockRetriesExhaustedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
-		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Коммитим транзакцию
-	if err = tx.Commit(); err != nil {
-		app.serverErrorResponse(w, r, err)
+	if outcome.replayed {
+		result = "replayed"
+		headers := make(http.Header)
+		headers.Set("Idempotent-Replayed", "true")
+		if err = app.writeJSON(w, outcome.status, outcome.body, headers); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Получаем обновленный баланс для ответа
-	balance, err := app.models.BonusEntries.GetTotalBalance(userId)
-	if err != nil {
+	result = "ok"
+	app.balances.forget(op.lockIds()...)
+
+	if err = app.writeJSON(w, http.StatusOK, outcome.body, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	response := map[string]interface{}{
-		"user_id": userId,
-		"amount":  trxIn.Amount,
-		"type":    trxIn.Type,
-		"balance": balance,
+// transactionOp - проверенная операция, готовая к выполнению в транзакции БД
+type transactionOp struct {
+	in       *transactionIn
+	userId   uuid.UUID
+	toUserId uuid.UUID
+	baseType string
+	// lifetimeDays - срок жизни создаваемого начисления (для перевода - начисления получателя)
+	lifetimeDays int
+	// includeEntry - вернуть в ответе на начисление созданную запись (include=entry)
+	includeEntry bool
+}
+
+// transactionOutcome - результат выполненной операции: ответ клиенту. replayed означает
+// сохраненный ответ на повтор запроса с тем же ключом идемпотентности
+type transactionOutcome struct {
+	status   int
+	body     any
+	replayed bool
+}
+
+// newTransactionOp определяет базовый тип, получателя и срок жизни начисления для проверенной операции
+func (app *application) newTransactionOp(ctx context.Context, trxIn *transactionIn, userId uuid.UUID) (*transactionOp, error) {
+	op := &transactionOp{
+		in:       trxIn,
+		userId:   userId,
+		baseType: app.types[trxIn.Type],
 	}
 
-	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
-		app.serverErrorResponse(w, r, err)
+	// Для перевода срок жизни определяется для получателя: переведенные баллы начисляются заново,
+	// а не сохраняют срок сгорания отправителя
+	lifetimeUserId := userId
+	if op.baseType == typeTransfer {
+		op.toUserId, _ = uuid.Parse(trxIn.ToUserId)
+		lifetimeUserId = op.toUserId
+	}
+
+	lifetimeDays, err := app.lifetimeDays(ctx, lifetimeUserId, op.baseType, trxIn.Source, trxIn.LifetimeDays.Value)
+	if err != nil {
+		return nil, err
+	}
+	op.lifetimeDays = lifetimeDays
+
+	return op, nil
+}
+
+// lockIds возвращает пользователей, которых блокирует операция. Перевод блокирует обоих
+// пользователей в одном порядке, чтобы встречные переводы не взаимоблокировались
+func (op *transactionOp) lockIds() []uuid.UUID {
+	ids := []uuid.UUID{op.userId}
+	if op.baseType == typeTransfer {
+		ids = append(ids, op.toUserId)
+	}
+	return ids
+}
+
+// sortUserIds упорядочивает пользователей для блокировки
+func sortUserIds(ids []uuid.UUID) {
+	slices.SortFunc(ids, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+}
+
+// runTransaction выполняет операцию в отдельной транзакции БД: блокирует пользователей,
+// проверяет ключ идемпотентности, применяет операцию и сохраняет ответ под ключом
+func (app *application) runTransaction(ctx context.Context, op *transactionOp, idempotencyKey string) (outcome *transactionOutcome, err error) {
+	ctx, span := tracer.Start(ctx, "db.transaction", trace.WithAttributes(
+		attribute.String("user_id", op.userId.String()),
+		attribute.String("type", op.in.Type),
+		attribute.Int("amount", op.in.Amount),
+	))
+	defer func() { endSpan(span, err) }()
+
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// Skip balance table check - bonus entries system doesn't require user pre-registration
+
+	lockIds := op.lockIds()
+	sortUserIds(lockIds)
+	for _, id := range lockIds {
+		if err = app.models.BonusEntries.LockUser(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	// Ключ идемпотентности проверяется под блокировкой пользователя: повтор запроса, пришедший
+	// одновременно с оригиналом, дождется его коммита и получит сохраненный ответ
+	var requestHash string
+	if idempotencyKey != "" {
+		requestHash, err = transactionHash(op.in, op.includeEntry)
+		if err != nil {
+			return nil, err
+		}
+
+		stored, err := app.models.IdempotencyKeys.GetTx(ctx, tx, idempotencyKey, op.userId)
+		switch {
+		case err == nil:
+			if stored.RequestHash != requestHash {
+				return nil, errIdempotencyKeyReused
+			}
+			return &transactionOutcome{status: stored.Status, body: json.RawMessage(stored.Response), replayed: true}, nil
+		case !errors.Is(err, data.ErrRecordNotFound):
+			return nil, err
+		}
+	}
+
+	response, err := app.applyTransaction(ctx, tx, op)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ответ сохраняется вместе с операцией, чтобы повтор запроса с тем же ключом получил его же
+	if idempotencyKey != "" {
+		body, err := json.Marshal(response)
+		if err != nil {
+			return nil, err
+		}
+
+		err = app.models.IdempotencyKeys.InsertTx(ctx, tx, &data.IdempotencyKey{
+			Key:         idempotencyKey,
+			UserId:      op.userId,
+			RequestHash: requestHash,
+			Status:      http.StatusOK,
+			Response:    body,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &transactionOutcome{status: http.StatusOK, body: response}, nil
+}
+
+// applyTransaction выполняет операцию в транзакции tx, в которой ее пользователи уже заблокированы,
+// и записывает ее в журнал. Возвращает ответ клиенту.
+// Повторный импорт начисления с политикой skip возвращает отчет skipped без изменений
+func (app *application) applyTransaction(ctx context.Context, tx *sql.Tx, op *transactionOp) (map[string]any, error) {
+	trxIn := op.in
+	userId := op.userId
+	toUserId := op.toUserId
+	baseType := op.baseType
+
+	// id операции журнала заранее, чтобы связать с ней создаваемые начисления.
+	// Он же служит correlation_id для всех операций журнала, порожденных этой транзакцией
+	transactionId := uuid.New()
+	// Операция журнала получателя перевода, с ней связывается начисление получателя
+	recipientTransactionId := uuid.New()
+
+	// Для multiply_percent amount - это процент, а processedAmount - начисленный бонус
+	processedAmount := trxIn.Amount
+	delta := 0
+	clamped := false
+
+	var err error
+	var grant *data.BonusEntry
+	switch baseType {
+	case typeDeposit:
+		grant, err = app.handleDeposit(ctx, tx, userId, trxIn.Amount, op.lifetimeDays, trxIn.Source, trxIn.Category, trxIn.ExternalReference, transactionId)
+		delta = processedAmount
+	case typeWithdrawal:
+		err = app.handleWithdrawal(ctx, tx, userId, trxIn.Amount, trxIn.Category, transactionId)
+		delta = -processedAmount
+	case typeMultiplyPercent:
+		processedAmount, clamped, err = app.handleMultiply(ctx, tx, userId, trxIn.Amount, op.lifetimeDays, trxIn.Source, trxIn.Category, transactionId)
+		delta = processedAmount
+	case typeTransfer:
+		err = app.handleTransfer(ctx, tx, userId, toUserId, trxIn.Amount, op.lifetimeDays, trxIn.Source, trxIn.Category, transactionId, recipientTransactionId)
+		delta = -processedAmount
+	}
+
+	if errors.Is(err, data.ErrDuplicateReference) && app.config.duplicateReferencePolicy != "reject" {
+		response, err := app.duplicateDeposit(ctx, tx, userId, trxIn)
+		return response, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Баланс для ответа и журнала считается в той же транзакции, чтобы он соответствовал только что
+	// выполненной операции, даже если после коммита баллы успеют сгореть
+	total, err := app.models.BonusEntries.GetTotalBalanceTx(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	balance := data.Points(total)
+
+	// Записываем операцию в журнал в той же транзакции
+	err = app.insertTransaction(ctx, tx, &data.Transaction{
+		Id:               transactionId,
+		UserId:           userId,
+		Type:             trxIn.Type,
+		Amount:           data.Points(processedAmount),
+		Delta:            data.Points(delta),
+		ResultingBalance: &balance,
+		CorrelationId:    &transactionId,
+		CreatedAt:        time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Получатель перевода получает свою запись журнала с тем же correlation_id
+	if baseType == typeTransfer {
+		total, err := app.models.BonusEntries.GetTotalBalanceTx(ctx, tx, toUserId)
+		if err != nil {
+			return nil, err
+		}
+		recipientBalance := data.Points(total)
+
+		err = app.insertTransaction(ctx, tx, &data.Transaction{
+			Id:               recipientTransactionId,
+			UserId:           toUserId,
+			Type:             trxIn.Type,
+			Amount:           data.Points(processedAmount),
+			Delta:            data.Points(processedAmount),
+			ResultingBalance: &recipientBalance,
+			CorrelationId:    &transactionId,
+			CreatedAt:        time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response := map[string]any{
+		"user_id":          userId,
+		"amount":           data.Points(trxIn.Amount),
+		"type":             trxIn.Type,
+		"processed_amount": data.Points(processedAmount),
+		"balance":          balance,
+		"correlation_id":   transactionId,
+	}
+
+	// Для бонуса отдельно показываем запрошенный процент и фактически начисленную сумму,
+	// чтобы клиент мог сообщить об ограничении бонуса
+	if baseType == typeMultiplyPercent {
+		response["requested_percent"] = trxIn.Amount
+		response["granted"] = data.Points(processedAmount)
+		response["clamped"] = clamped
+	}
+	if baseType == typeTransfer {
+		response["to_user_id"] = toUserId
+	}
+	if op.includeEntry && grant != nil {
+		response["entry"] = grantResponse{
+			Id:           grant.Id,
+			ExpiresAt:    grant.ExpiresAt(),
+			LifetimeDays: grant.LifetimeDays,
+		}
+	}
+
+	return response, nil
+}
+
+// lifetimeDays возвращает срок жизни нового начисления: явно указанный, срок бонусов
+// multiply_percent или переводов из конфигурации, срок из политики источника или срок по умолчанию для пользователя
+func (app *application) lifetimeDays(ctx context.Context, userId uuid.UUID, baseType string, source string, explicit *int) (int, error) {
+	switch {
+	case explicit != nil:
+		return *explicit, nil
+	case baseType == typeMultiplyPercent && app.config.multiply.bonusLifetimeDays > 0:
+		return app.config.multiply.bonusLifetimeDays, nil
+	case baseType == typeTransfer && app.config.transfer.lifetimeDays > 0:
+		return app.config.transfer.lifetimeDays, nil
 	}
+
+	if source != "" {
+		policy, err := app.models.SourcePolicies.Get(ctx, source)
+		switch {
+		case err == nil:
+			return policy.DefaultLifetimeDays, nil
+		case !errors.Is(err, data.ErrRecordNotFound):
+			return 0, err
+		}
+	}
+
+	return app.defaultLifetimeDays(ctx, userId)
 }
 
-func (app *application) handleDeposit(tx *sql.Tx, userId uuid.UUID, amount int, lifetimeDays int) error {
+// defaultLifetimeDays возвращает срок жизни начисления, для которого не указан lifetime_days:
+// персональную настройку пользователя, если она задана, иначе общий срок -default-lifetime-days
+func (app *application) defaultLifetimeDays(ctx context.Context, userId uuid.UUID) (int, error) {
+	settings, err := app.models.UserSettings.Get(ctx, userId)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return app.config.defaultLifetimeDays, nil
+	case err != nil:
+		return 0, err
+	case settings.DefaultLifetimeDays != nil:
+		return *settings.DefaultLifetimeDays, nil
+	default:
+		return app.config.defaultLifetimeDays, nil
+	}
+}
+
+// duplicateDeposit формирует отчет о пропущенном повторном импорте начисления с уже известным
+// external_reference. С -duplicate-reference-policy=reject повтор не пропускается, а отклоняется
+func (app *application) duplicateDeposit(ctx context.Context, tx *sql.Tx, userId uuid.UUID, trxIn *transactionIn) (map[string]any, error) {
+	balance, err := app.models.BonusEntries.GetTotalBalanceTx(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"user_id":            userId,
+		"amount":             data.Points(trxIn.Amount),
+		"type":               trxIn.Type,
+		"source":             trxIn.Source,
+		"external_reference": trxIn.ExternalReference,
+		"processed_amount":   data.Points(0),
+		"balance":            data.Points(balance),
+		"skipped":            true,
+		"reason":             "duplicate external_reference",
+	}, nil
+}
 
-	now := time.Now()
+// handleDeposit создает начисление, связанное с операцией журнала transactionId, и возвращает созданную запись.
+// Если начисление с тем же source и externalReference у пользователя уже есть, возвращает ErrDuplicateReference
+func (app *application) handleDeposit(ctx context.Context, tx *sql.Tx, userId uuid.UUID, amount int, lifetimeDays int, source string, category string, externalReference string, transactionId uuid.UUID) (*data.BonusEntry, error) {
 	entry := &data.BonusEntry{
-		Id:           uuid.New(),
-		UserId:       userId,
-		Amount:       amount,
-		CreatedAt:    now,
-		LifetimeDays: lifetimeDays,
-		Status:       data.BonusEntryStatusActive,
+		Id:                uuid.New(),
+		UserId:            userId,
+		Amount:            data.Points(amount),
+		CreatedAt:         time.Now(),
+		LifetimeDays:      lifetimeDays,
+		Status:            data.BonusEntryStatusActive,
+		TransactionId:     &transactionId,
+		Source:            source,
+		ExternalReference: externalReference,
+		Category:          category,
 	}
 
+	if err := app.insertGrant(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// insertGrant записывает начисление entry в транзакции tx, без категории - в data.DefaultCategory.
+// Повторный импорт начисления с теми же source и external_reference возвращает data.ErrDuplicateReference
+func (app *application) insertGrant(ctx context.Context, tx *sql.Tx, entry *data.BonusEntry) error {
 	expiresAt := entry.ExpiresAt()
+	if entry.Category == "" {
+		entry.Category = data.DefaultCategory
+	}
 
 	query := `
-		INSERT INTO bonus_entries (id, user_id, amount, created_at, expires_at, lifetime_days, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO bonus_entries (id, user_id, amount, created_at, expires_at, lifetime_days, status, transaction_id, source, external_reference, category)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11)
+		ON CONFLICT (user_id, source, external_reference) WHERE external_reference IS NOT NULL DO NOTHING
 		RETURNING id, created_at`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, app.config.db.queryTimeout)
 	defer cancel()
 
 	err := tx.QueryRowContext(ctx, query,
@@ -135,15 +691,160 @@ func (app *application) handleDeposit(tx *sql.Tx, userId uuid.UUID, amount int,
 		expiresAt,
 		entry.LifetimeDays,
 		entry.Status,
+		entry.TransactionId,
+		entry.Source,
+		entry.ExternalReference,
+		entry.Category,
 	).Scan(&entry.Id, &entry.CreatedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return data.ErrDuplicateReference
+	case err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return data.ErrQueryTimeout
+	}
 
 	return err
 }
 
-func (app *application) handleWithdrawal(tx *sql.Tx, userId uuid.UUID, amount int) error {
+func (app *application) handleWithdrawal(ctx context.Context, tx *sql.Tx, userId uuid.UUID, amount int, category string, correlationId uuid.UUID) error {
 	// Используем метод модели для списания с блокировками
-	_, err := app.models.BonusEntries.SpendEntries(tx, userId, amount)
-	return err
+	_, forfeited, err := app.models.BonusEntries.SpendEntries(ctx, tx, userId, amount, category)
+	if err != nil {
+		return err
+	}
+
+	return app.journalForfeit(ctx, tx, userId, forfeited, correlationId)
+}
+
+// journalForfeit записывает в журнал как fragment_forfeit остаток частичного списания, сгоревший
+// по -fragment-policy, с correlation_id списания. Как и любая операция журнала, он попадает в outbox
+func (app *application) journalForfeit(ctx context.Context, tx *sql.Tx, userId uuid.UUID, forfeited int, correlationId uuid.UUID) error {
+	if forfeited == 0 {
+		return nil
+	}
+
+	total, err := app.models.BonusEntries.GetTotalBalanceTx(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+	balance := data.Points(total)
+
+	return app.insertTransaction(ctx, tx, &data.Transaction{
+		Id:               uuid.New(),
+		UserId:           userId,
+		Type:             "fragment_forfeit",
+		Amount:           data.Points(forfeited),
+		Delta:            -data.Points(forfeited),
+		ResultingBalance: &balance,
+		CorrelationId:    &correlationId,
+		CreatedAt:        time.Now(),
+	})
+}
+
+// handleTransfer списывает amount баллов у отправителя по принципу FIFO и начисляет их получателю,
+// связывая начисления с операцией журнала получателя. По -transfer-provenance получатель получает
+// одну запись со сроком жизни lifetimeDays и источником из запроса (request) или источником transfer,
+// либо (inherit) по записи на каждую списанную часть с источником и сроком сгорания записи отправителя.
+// Непустой category ограничивает списание этой категорией, и в ней же баллы начисляются получателю
+func (app *application) handleTransfer(ctx context.Context, tx *sql.Tx, userId uuid.UUID, toUserId uuid.UUID, amount int, lifetimeDays int, source string, category string, transactionId uuid.UUID, recipientTransactionId uuid.UUID) error {
+	spent, forfeited, err := app.models.BonusEntries.SpendEntries(ctx, tx, userId, amount, category)
+	if err != nil {
+		return err
+	}
+	if err = app.journalForfeit(ctx, tx, userId, forfeited, transactionId); err != nil {
+		return err
+	}
+
+	switch app.config.transfer.provenance {
+	case "inherit":
+		for _, entry := range spent {
+			// Дата начисления и срок жизни копируются, чтобы запись получателя сгорела
+			// тогда же, когда сгорела бы запись отправителя
+			grant := &data.BonusEntry{
+				Id:            uuid.New(),
+				UserId:        toUserId,
+				Amount:        entry.Amount,
+				CreatedAt:     entry.CreatedAt,
+				LifetimeDays:  entry.LifetimeDays,
+				Status:        data.BonusEntryStatusActive,
+				TransactionId: &recipientTransactionId,
+				Source:        entry.Source,
+				Category:      entry.Category,
+			}
+			if err = app.insertGrant(ctx, tx, grant); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "transfer":
+		source = typeTransfer
+	}
+
+	return app.insertGrant(ctx, tx, &data.BonusEntry{
+		Id:            uuid.New(),
+		UserId:        toUserId,
+		Amount:        data.Points(amount),
+		CreatedAt:     time.Now(),
+		LifetimeDays:  lifetimeDays,
+		Status:        data.BonusEntryStatusActive,
+		TransactionId: &recipientTransactionId,
+		Source:        source,
+		Category:      category,
+	})
+}
+
+// handleMultiply начисляет бонус в размере percent процентов от текущего баланса.
+// База - все активные записи пользователя (включая бессрочные, если такие появятся),
+// бонус начисляется отдельной записью со своим сроком жизни, а не бессрочно.
+// Бонус не превышает -multiply-max-bonus. Возвращает размер начисленного бонуса и признак того,
+// что он был ограничен
+func (app *application) handleMultiply(ctx context.Context, tx *sql.Tx, userId uuid.UUID, percent int, lifetimeDays int, source string, category string, transactionId uuid.UUID) (int, bool, error) {
+	entries, err := app.models.BonusEntries.GetActiveEntriesForUpdate(ctx, tx, userId)
+	if err != nil {
+		return 0, false, err
+	}
+
+	bonus, clamped, err := multiplyBonus(entries, percent, app.config.multiply.maxBonus)
+	if err != nil || bonus <= 0 {
+		return 0, false, err
+	}
+
+	_, err = app.handleDeposit(ctx, tx, userId, bonus, lifetimeDays, source, category, "", transactionId)
+	return bonus, clamped, err
+}
+
+// errMultiplyOverflow - бонус multiply_percent не помещается в сумму начисления
+var errMultiplyOverflow = errors.New("multiply bonus is too large")
+
+// multiplyBonus считает бонус multiply_percent: percent процентов от суммы записей entries
+// с округлением вниз, не больше maxBonus (0 - без ограничения). Возвращает бонус и признак ограничения.
+// Сумма начисления хранится в БД как int4, поэтому бонус, не помещающийся в int32 на любой платформе,
+// возвращается как errMultiplyOverflow, а не усекается
+func multiplyBonus(entries []*data.BonusEntry, percent int, maxBonus int) (int, bool, error) {
+	var total int64
+	for _, entry := range entries {
+		if int64(entry.Amount) > math.MaxInt64-total {
+			return 0, false, errMultiplyOverflow
+		}
+		total += int64(entry.Amount)
+	}
+
+	if percent > 0 && total > math.MaxInt64/int64(percent) {
+		return 0, false, errMultiplyOverflow
+	}
+	bonus := (total * int64(percent)) / 100
+
+	clamped := false
+	if maxBonus > 0 && bonus > int64(maxBonus) {
+		bonus = int64(maxBonus)
+		clamped = true
+	}
+
+	if bonus > math.MaxInt32 {
+		return 0, false, errMultiplyOverflow
+	}
+
+	return int(bonus), clamped, nil
 }
 
 func (app *application) showUserBalanceHandler(w http.ResponseWriter, r *http.Request) {
@@ -155,26 +856,865 @@ func (app *application) showUserBalanceHandler(w http.ResponseWriter, r *http.Re
 
 	// Skip balance table check - bonus entries system allows checking balance for any user
 
-	// Получаем общий баланс
-	balance, err := app.models.BonusEntries.GetTotalBalance(userId)
+	version, err := app.readVersion(r, 2)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	granularity := data.ExpiryGranularity(r.URL.Query().Get("granularity"))
+	if granularity == "" {
+		granularity = data.ExpiryGranularityDay
+	}
+
+	category := r.URL.Query().Get("category")
+
+	v := validator.New()
+	v.Check(validator.IsPermitted(granularity, data.ExpiryGranularityDay, data.ExpiryGranularityTimestamp), "granularity", "must be day or timestamp")
+	app.checkSource(v, "category", &category)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Получаем общий баланс. Кэш хранит только общие балансы, баланс категории читается из БД
+	var balance int
+	if category == "" {
+		balance, err = app.balances.get(r.Context(), userId)
+	} else {
+		balance, err = app.models.BonusEntries.GetTotalBalance(r.Context(), userId, category)
+	}
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Получаем информацию о сгорании баллов (на ближайшие 7 дней)
-	expiring, err := app.models.BonusEntries.GetExpiringEntries(userId, 7)
+	// Получаем информацию о сгорании баллов (на ближайшие 7 дней) той же категории, что и баланс
+	expiring, err := app.models.BonusEntries.GetExpiringEntries(r.Context(), userId, category, 7, granularity)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	response := balanceResponse{
+	var response any = balanceResponse{
 		UserId:   userId,
-		Balance:  balance,
+		Balance:  data.Points(balance),
 		Expiring: expiring,
 	}
 
+	// Версия 2 вкладывает данные баланса в конверт data
+	if version == 2 {
+		response = map[string]any{"version": version, "data": response}
+	}
+
+	headers := http.Header{"Vary": []string{"Accept-Version"}}
+
+	if err = app.writeJSON(w, http.StatusOK, response, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUserEntriesHandler возвращает постранично отдельные начисления, из которых складывается
+// баланс пользователя, с возможностью отбора по статусу
+func (app *application) listUserEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+	filter := data.EntryFilter{Status: data.BonusEntryStatus(qs.Get("status"))}
+
+	v := validator.New()
+	if filter.Status != "" {
+		v.Check(validator.IsPermitted(filter.Status, data.BonusEntryStatusActive, data.BonusEntryStatusExpired, data.BonusEntryStatusSpent), "status", "must be active, expired or spent")
+	}
+
+	var filters data.Filters
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 100, v)
+	data.ValidateFilters(v, filters)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.BonusEntries.GetEntries(r.Context(), userId, filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	items := make([]entryResponse, len(entries))
+	for i, entry := range entries {
+		items[i] = entryResponse{
+			Id:        entry.Id,
+			Amount:    entry.Amount,
+			Category:  entry.Category,
+			Status:    entry.Status,
+			CreatedAt: entry.CreatedAt,
+			ExpiresAt: entry.ExpiresAt(),
+			SpentAt:   entry.SpentAt,
+			ExpiredAt: entry.ExpiredAt,
+		}
+	}
+
+	response := map[string]any{
+		"user_id":  userId,
+		"entries":  items,
+		"metadata": metadata,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showSpendPlanHandler показывает, сколько баллов и из каких начислений будет списано
+// при частичном списании (up_to), ничего не изменяя. В плане не больше limit начислений.
+// Непустой category строит план только по начислениям этой категории, как при списании из нее
+func (app *application) showSpendPlanHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	v := validator.New()
+	requested := app.readInt(qs, "amount", 0, v)
+	v.Check(requested > 0, "amount", "must be positive")
+	limit := app.readSpendPreviewLimit(qs, v)
+	category := qs.Get("category")
+	app.checkSource(v, "category", &category)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Доступный баланс считается по всем записям, а для плана читаются только первые limit записей
+	available, err := app.models.BonusEntries.GetTotalBalance(r.Context(), userId, category)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	entries, err := app.models.BonusEntries.GetActiveEntries(r.Context(), userId, category, data.Filters{Page: 1, PageSize: limit})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	plan, planned := data.PlanSpend(entries, requested)
+	amount := min(requested, available)
+
+	response := spendPlanResponse{
+		UserId:    userId,
+		Requested: data.Points(requested),
+		Available: data.Points(available),
+		Amount:    data.Points(amount),
+		Plan:      plan,
+		Truncated: planned < amount,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// previewTransactionHandler показывает, какие начисления будут израсходованы списанием или переводом
+// и хватит ли баланса, ничего не изменяя. Записи читаются с той же блокировкой, что и при списании,
+// чтобы дождаться уже идущих списаний, а транзакция всегда откатывается
+func (app *application) previewTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var trxIn transactionIn
+	if err := app.readJSON(w, r, &trxIn); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	limit := app.readSpendPreviewLimit(r.URL.Query(), v)
+	userId := app.validateTransaction(v, &trxIn)
+	baseType := app.types[trxIn.Type]
+	v.Check(baseType == "" || baseType == typeWithdrawal || baseType == typeTransfer, "type", "must be a type that spends points")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tx, err := app.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	entries, err := app.models.BonusEntries.GetActiveEntriesForUpdate(r.Context(), tx, userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Списание из категории видит только ее записи
+	entries = data.FilterCategory(entries, trxIn.Category)
+
+	amount := data.Points(trxIn.Amount)
+	var available data.Points
+	for _, entry := range entries {
+		available += entry.Amount
+	}
+
+	// Если баллов не хватает, списание будет отклонено целиком и ничего не израсходует
+	sufficient := available >= amount
+	plan := []data.SpendPlanItem{}
+	var forfeited data.Points
+	if sufficient {
+		plan, _ = data.PlanSpend(entries, trxIn.Amount)
+
+		// Остаток последней, частично списанной записи может сразу сгореть по -fragment-policy
+		if len(plan) > 0 {
+			last := len(plan) - 1
+			remainder := entries[last].Amount - plan[last].Amount
+			fragments := app.models.BonusEntries.Fragments
+			if fragments.Forfeit && remainder > 0 && int(remainder) < fragments.MinAmount {
+				forfeited = remainder
+			}
+		}
+	}
+
+	remaining := available
+	if sufficient {
+		remaining = available - amount - forfeited
+	}
+
+	// Списание видит все записи, а в ответ попадают только первые limit из них
+	truncated := limit > 0 && len(plan) > limit
+	if truncated {
+		plan = plan[:limit]
+	}
+
+	response := map[string]any{
+		"user_id":           userId,
+		"type":              trxIn.Type,
+		"amount":            amount,
+		"available":         available,
+		"sufficient":        sufficient,
+		"entries":           plan,
+		"truncated":         truncated,
+		"forfeited":         forfeited,
+		"remaining_balance": remaining,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showExpiryRiskHandler сообщает, опустится ли баланс ниже порога за N дней из-за сгорания баллов
+// и сколько баллов нужно начислить, чтобы этого избежать
+func (app *application) showExpiryRiskHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	v := validator.New()
+	threshold := app.readInt(qs, "threshold", -1, v)
+	days := app.readInt(qs, "days", 7, v)
+	v.Check(threshold >= 0, "threshold", "must be provided and not negative")
+	v.Check(days > 0, "days", "must be positive")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	balance, err := app.balances.get(r.Context(), userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	expiring, err := app.models.BonusEntries.GetExpiringEntries(r.Context(), userId, "", days, data.ExpiryGranularityDay)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var expiringTotal data.Points
+	for _, item := range expiring {
+		expiringTotal += item.Amount
+	}
+
+	projected := data.Points(balance) - expiringTotal
+
+	response := expiryRiskResponse{
+		UserId:           userId,
+		Balance:          data.Points(balance),
+		Threshold:        data.Points(threshold),
+		Days:             days,
+		Expiring:         expiringTotal,
+		ProjectedBalance: projected,
+		AtRisk:           projected < data.Points(threshold),
+		Shortfall:        max(0, data.Points(threshold)-projected),
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showRiskBreakdownHandler делит активный баланс пользователя на баллы под угрозой сгорания
+// в ближайшие days дней и остальные, для индикатора на дашборде
+func (app *application) showRiskBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	days := app.readInt(r.URL.Query(), "days", 30, v)
+	v.Check(days > 0, "days", "must be positive")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	breakdown, err := app.models.BonusEntries.GetRiskBreakdown(r.Context(), userId, days)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := map[string]any{
+		"user_id":          userId,
+		"days":             days,
+		"balance":          data.Points(breakdown.AtRisk + breakdown.Safe),
+		"at_risk":          data.Points(breakdown.AtRisk),
+		"safe":             data.Points(breakdown.Safe),
+		"earliest_at_risk": breakdown.EarliestAtRisk,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showExpiryForecastHandler возвращает график сгорания баланса при условии, что пользователь
+// больше не будет тратить и получать баллы. Баланс считается как сумма графика, а не берется из
+// кэша балансов: оба значения получены одним запросом, поэтому remaining не уходит в минус, а у
+// последней строки равен нулю - бессрочных баллов в сервисе нет
+func (app *application) showExpiryForecastHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	schedule, err := app.models.BonusEntries.GetExpirySchedule(r.Context(), userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var balance data.Points
+	for _, day := range schedule {
+		balance += day.Amount
+	}
+
+	forecast := make([]expiryForecastItem, 0, len(schedule))
+	var cumulative data.Points
+	for _, day := range schedule {
+		cumulative += day.Amount
+		forecast = append(forecast, expiryForecastItem{
+			Date:       day.Date,
+			Amount:     day.Amount,
+			Cumulative: cumulative,
+			Remaining:  balance - cumulative,
+		})
+	}
+
+	response := map[string]any{
+		"user_id":  userId,
+		"balance":  balance,
+		"forecast": forecast,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listRecentlyExpiredHandler возвращает записи пользователя, сгоревшие за последние days дней
+func (app *application) listRecentlyExpiredHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	days := app.readInt(r.URL.Query(), "days", 30, v)
+	v.Check(days > 0, "days", "must be positive")
+	v.Check(days <= 366, "days", "must not be more than 366")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, err := app.models.BonusEntries.GetRecentlyExpired(r.Context(), userId, days)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var total data.Points
+	for _, entry := range entries {
+		total += entry.Amount
+	}
+
+	response := map[string]any{
+		"user_id": userId,
+		"days":    days,
+		"total":   total,
+		"entries": entries,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showExpiryPreviewHandler показывает, когда сгорят баллы, если начислить их пользователю сейчас.
+// Срок жизни выбирается так же, как при создании транзакции type, с учетом lifetime_days,
+// политики источника source, настроек пользователя и конфигурации. Бессрочных начислений в сервисе нет
+func (app *application) showExpiryPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	userId, err := uuid.Parse(qs.Get("user_id"))
+
+	txType := qs.Get("type")
+	if txType == "" {
+		txType = typeDeposit
+	}
+	source := qs.Get("source")
+
+	v := validator.New()
+	v.Check(err == nil, "user_id", "must be uuid")
+	v.Check(app.types[txType] == typeDeposit || app.types[txType] == typeMultiplyPercent, "type", "must be a type that grants points")
+	// Источник приводится так же, как при создании транзакции, иначе политика источника не найдется
+	app.checkSource(v, "source", &source)
+
+	var explicit *int
+	if qs.Has("lifetime_days") {
+		days := app.readInt(qs, "lifetime_days", 0, v)
+		v.Check(days > 0, "lifetime_days", "must be positive")
+		explicit = &days
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	lifetimeDays, err := app.lifetimeDays(r.Context(), userId, app.types[txType], source, explicit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Время начисления хранится в БД с точностью до секунды
+	entry := data.BonusEntry{
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+		LifetimeDays: lifetimeDays,
+	}
+
+	response := map[string]any{
+		"user_id":       userId,
+		"type":          txType,
+		"source":        source,
+		"lifetime_days": lifetimeDays,
+		"created_at":    entry.CreatedAt,
+		"expires_at":    entry.ExpiresAt(),
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showBonusShareHandler показывает, какая часть активного баланса пользователя получена бонусами
+// multiply_percent, а какая - обычными начислениями. Начисления, созданные до появления связи
+// с журналом, считаются отдельно как unattributed
+func (app *application) showBonusShareHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	balances, err := app.models.BonusEntries.GetBalanceByType(r.Context(), userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var balance, multiply, organic, unattributed data.Points
+	for _, b := range balances {
+		balance += b.Amount
+		switch {
+		case b.Type == "":
+			unattributed += b.Amount
+		case app.types[b.Type] == typeMultiplyPercent:
+			multiply += b.Amount
+		default:
+			organic += b.Amount
+		}
+	}
+
+	multiplyShare := 0.0
+	if balance > 0 {
+		multiplyShare = float64(multiply) * 100 / float64(balance)
+	}
+
+	response := map[string]any{
+		"user_id":        userId,
+		"balance":        balance,
+		"multiply":       multiply,
+		"organic":        organic,
+		"unattributed":   unattributed,
+		"multiply_share": multiplyShare,
+		"by_type":        balances,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showToTargetHandler возвращает, сколько баллов пользователю не хватает до target
+// (0, если баланс уже не меньше). Баланс считается так же, как в /balance: бессрочных
+// начислений и замороженных пользователей в сервисе нет
+func (app *application) showToTargetHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	target := app.readInt(r.URL.Query(), "target", 0, v)
+	v.Check(target > 0, "target", "must be positive")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	balance, err := app.balances.get(r.Context(), userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := map[string]any{
+		"user_id": userId,
+		"target":  data.Points(target),
+		"balance": data.Points(balance),
+		"needed":  data.Points(max(target-balance, 0)),
+		"reached": balance >= target,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listExpirationsHandler возвращает начисления пользователя, сгоревшие с from по to включительно
+// (по умолчанию последние 30 дней), чтобы поддержка могла объяснить уменьшение баланса без списаний
+func (app *application) listExpirationsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	v := validator.New()
+	y, m, d := time.Now().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	to := app.readDate(qs, "to", today, v)
+	from := app.readDate(qs, "from", to.AddDate(0, 0, -29), v)
+	v.Check(!from.After(to), "from", "must not be after to")
+	v.Check(to.Sub(from) <= 366*24*time.Hour, "from", "range must not be longer than 366 days")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, err := app.models.BonusEntries.GetExpiredBetween(r.Context(), userId, from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var total data.Points
+	for _, entry := range entries {
+		total += entry.Amount
+	}
+
+	response := map[string]any{
+		"user_id": userId,
+		"from":    from.Format("2006-01-02"),
+		"to":      to.Format("2006-01-02"),
+		"total":   total,
+		"entries": entries,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showOldestGrantsHandler возвращает самые старые начисления, которые вместе покрывают
+// не меньше percent процентов баланса - их стоит потратить в первую очередь
+func (app *application) showOldestGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	percent := app.readInt(r.URL.Query(), "percent", 100, v)
+	v.Check(percent > 0, "percent", "must be positive")
+	v.Check(percent <= 100, "percent", "must not be more than 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, err := app.models.BonusEntries.GetActiveEntries(r.Context(), userId, "", data.AllEntries)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	balance, target, covered, plan := oldestGrants(entries, percent)
+
+	response := map[string]any{
+		"user_id": userId,
+		"balance": data.Points(balance),
+		"percent": percent,
+		"target":  data.Points(target),
+		"covered": data.Points(covered),
+		"grants":  plan,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oldestGrants выбирает самые старые начисления из entries (в порядке FIFO), которые вместе покрывают
+// не меньше percent процентов их суммы. Возвращает сумму всех записей, цель, покрытую сумму и сами начисления
+func oldestGrants(entries []*data.BonusEntry, percent int) (int, int, int, []data.SpendPlanItem) {
+	balance := 0
+	for _, entry := range entries {
+		balance += int(entry.Amount)
+	}
+
+	// Округляем цель вверх, чтобы набранная сумма была не меньше запрошенного процента
+	target := (balance*percent + 99) / 100
+	grants, covered := data.OldestCovering(entries, target)
+
+	plan := make([]data.SpendPlanItem, 0, len(grants))
+	for _, grant := range grants {
+		plan = append(plan, data.SpendPlanItem{
+			EntryId:   grant.Id,
+			Amount:    grant.Amount,
+			CreatedAt: grant.CreatedAt,
+			ExpiresAt: grant.ExpiresAt(),
+		})
+	}
+
+	return balance, target, covered, plan
+}
+
+// showExpirySimulationHandler моделирует досрочное сгорание самых старых начислений пользователя,
+// чтобы сократить баланс на percent процентов, ничего не изменяя. Начисления сгорают целиком,
+// поэтому фактическое сокращение (reduced_percent) может быть больше запрошенного
+func (app *application) showExpirySimulationHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	percent := app.readInt(r.URL.Query(), "percent", 0, v)
+	v.Check(percent > 0, "percent", "must be positive")
+	v.Check(percent <= 100, "percent", "must not be more than 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, err := app.models.BonusEntries.GetActiveEntries(r.Context(), userId, "", data.AllEntries)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	balance, target, covered, plan := oldestGrants(entries, percent)
+
+	reducedPercent := 0.0
+	if balance > 0 {
+		reducedPercent = float64(covered) * 100 / float64(balance)
+	}
+
+	response := map[string]any{
+		"user_id":           userId,
+		"balance":           data.Points(balance),
+		"percent":           percent,
+		"target":            data.Points(target),
+		"expiring":          data.Points(covered),
+		"projected_balance": data.Points(balance - covered),
+		"reduced_percent":   reducedPercent,
+		"grants":            plan,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listTransactionsHandler возвращает группу операций журнала с общим correlation_id,
+// например списание вместе со сгоранием его остатка
+func (app *application) listTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	correlationId, err := uuid.Parse(r.URL.Query().Get("correlation_id"))
+	v.Check(err == nil, "correlation_id", "must be a valid uuid")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	transactions, err := app.models.Transactions.GetByCorrelationId(r.Context(), correlationId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(transactions) == 0 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	response := map[string]any{
+		"correlation_id": correlationId,
+		"transactions":   transactions,
+	}
+
+	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showMultiplyPreviewHandler рассчитывает бонус multiply_percent для пользователя без начисления:
+// размер бонуса, срок его сгорания и срок сгорания баллов, от которых он считается.
+// Помогает оценить акцию: бонус с коротким сроком жизни может сгореть раньше исходных баллов
+func (app *application) showMultiplyPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := app.readIDParam(r)
+	if err != nil || userId == uuid.Nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+	source := qs.Get("source")
+
+	v := validator.New()
+	percent := app.readInt(qs, "percent", 0, v)
+	v.Check(percent > 0, "percent", "must be positive")
+	app.checkSource(v, "source", &source)
+	v.Check(len(source) <= maxSourceLength, "source", fmt.Sprintf("must not be more than %d bytes long", maxSourceLength))
+
+	var explicit *int
+	if qs.Has("lifetime_days") {
+		days := app.readInt(qs, "lifetime_days", 0, v)
+		v.Check(days > 0, "lifetime_days", "must be positive")
+		explicit = &days
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, err := app.models.BonusEntries.GetActiveEntries(r.Context(), userId, "", data.AllEntries)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	lifetimeDays, err := app.lifetimeDays(r.Context(), userId, typeMultiplyPercent, source, explicit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	bonus, clamped, err := multiplyBonus(entries, percent, app.config.multiply.maxBonus)
+	if err != nil {
+		app.multiplyOverflowResponse(w, r)
+		return
+	}
+
+	var base int64
+	var baseExpiresAt *time.Time
+	for _, entry := range entries {
+		base += int64(entry.Amount)
+		if expiresAt := entry.ExpiresAt(); baseExpiresAt == nil || expiresAt.After(*baseExpiresAt) {
+			baseExpiresAt = &expiresAt
+		}
+	}
+
+	// Время начисления хранится в БД с точностью до секунды
+	bonusEntry := data.BonusEntry{
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+		LifetimeDays: lifetimeDays,
+	}
+	bonusExpiresAt := bonusEntry.ExpiresAt()
+
+	// base_expires_at - самое позднее сгорание исходных баллов (null, если баланс пуст)
+	response := map[string]any{
+		"user_id":          userId,
+		"percent":          percent,
+		"base":             data.Points(base),
+		"bonus":            data.Points(bonus),
+		"clamped":          clamped,
+		"lifetime_days":    lifetimeDays,
+		"bonus_expires_at": bonusExpiresAt,
+		"base_expires_at":  baseExpiresAt,
+		"outlives_base":    baseExpiresAt == nil || bonusExpiresAt.After(*baseExpiresAt),
+	}
+
 	if err = app.writeJSON(w, http.StatusOK, response, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
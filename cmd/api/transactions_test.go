@@ -0,0 +1,1729 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+	"simple-ledger.itmo.ru/internal/jsonlog"
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+func TestSpendPlan(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	older := insertEntry(t, app, userId, 10, time.Now().AddDate(0, 0, -2), 30)
+	newer := insertEntry(t, app, userId, 20, time.Now().AddDate(0, 0, -1), 30)
+
+	var plan spendPlanResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/spend-plan?amount=100", userId), &plan)
+
+	if plan.Requested != 100 || plan.Available != 30 || plan.Amount != 30 {
+		t.Errorf("got requested=%d available=%d amount=%d; want 100, 30, 30", plan.Requested, plan.Available, plan.Amount)
+	}
+	if plan.Truncated {
+		t.Error("got truncated plan; want the whole plan")
+	}
+
+	want := []struct {
+		id     uuid.UUID
+		amount data.Points
+	}{{older.Id, 10}, {newer.Id, 20}}
+	if len(plan.Plan) != len(want) {
+		t.Fatalf("got %d plan items; want %d", len(plan.Plan), len(want))
+	}
+	for i, item := range plan.Plan {
+		if item.EntryId != want[i].id || item.Amount != want[i].amount {
+			t.Errorf("plan[%d]: got entry %s amount %d; want entry %s amount %d", i, item.EntryId, item.Amount, want[i].id, want[i].amount)
+		}
+	}
+}
+
+func TestExpiryRisk(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	// 50 баллов сгорят через 3 дня, 20 - через 25 дней
+	insertEntry(t, app, userId, 50, time.Now().AddDate(0, 0, -27), 30)
+	insertEntry(t, app, userId, 20, time.Now().AddDate(0, 0, -5), 30)
+
+	tests := []struct {
+		name      string
+		threshold int
+		atRisk    bool
+		shortfall data.Points
+	}{
+		{name: "drops below threshold", threshold: 40, atRisk: true, shortfall: 20},
+		{name: "stays above threshold", threshold: 10, atRisk: false, shortfall: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var risk expiryRiskResponse
+			ts.mustGet(t, fmt.Sprintf("/v1/users/%s/expiry-risk?threshold=%d&days=7", userId, tt.threshold), &risk)
+
+			if risk.Balance != 70 || risk.Expiring != 50 || risk.ProjectedBalance != 20 {
+				t.Errorf("got balance=%d expiring=%d projected=%d; want 70, 50, 20", risk.Balance, risk.Expiring, risk.ProjectedBalance)
+			}
+			if risk.AtRisk != tt.atRisk || risk.Shortfall != tt.shortfall {
+				t.Errorf("got at_risk=%t shortfall=%d; want %t, %d", risk.AtRisk, risk.Shortfall, tt.atRisk, tt.shortfall)
+			}
+		})
+	}
+}
+
+func TestMultiplyBonusBase(t *testing.T) {
+	now := time.Now()
+	// База бонуса - все активные записи, независимо от того, когда они сгорят
+	entries := []*data.BonusEntry{
+		{Amount: 100, CreatedAt: now, LifetimeDays: 5},
+		{Amount: 50, CreatedAt: now.AddDate(0, 0, -300), LifetimeDays: 365},
+	}
+
+	bonus, clamped, err := multiplyBonus(entries, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bonus != 15 || clamped {
+		t.Errorf("got bonus %d clamped %t; want 15, false", bonus, clamped)
+	}
+}
+
+func TestMultiplyBonusLifetime(t *testing.T) {
+	cfg := testConfig()
+	cfg.multiply.bonusLifetimeDays = 7
+	app := newTestApplication(t, cfg, nil)
+
+	explicit := 12
+	tests := []struct {
+		name     string
+		explicit *int
+		want     int
+	}{
+		{name: "configured bonus lifetime", want: 7},
+		{name: "explicit lifetime_days", explicit: &explicit, want: 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := app.lifetimeDays(context.Background(), uuid.New(), typeMultiplyPercent, "", tt.explicit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d days; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiplyTransaction(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.multiply.bonusLifetimeDays = 7
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	insertEntry(t, app, userId, 100, time.Now(), 5)
+	insertEntry(t, app, userId, 50, time.Now().AddDate(0, 0, -300), 365)
+
+	var response struct {
+		ProcessedAmount int `json:"processed_amount"`
+		Balance         int `json:"balance"`
+	}
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 10, "type": "multiply_percent"}, &response)
+
+	if response.ProcessedAmount != 15 || response.Balance != 165 {
+		t.Errorf("got processed_amount=%d balance=%d; want 15, 165", response.ProcessedAmount, response.Balance)
+	}
+
+	var bonus *entryResponse
+	for _, entry := range listEntries(t, ts, userId) {
+		if entry.Amount == 15 {
+			bonus = &entry
+		}
+	}
+	if bonus == nil {
+		t.Fatal("got no bonus entry")
+	}
+	if lifetime := bonus.ExpiresAt.Sub(bonus.CreatedAt); lifetime != 7*24*time.Hour {
+		t.Errorf("got bonus lifetime %v; want 7 days", lifetime)
+	}
+}
+
+func TestBalanceExpiryGranularity(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	// Две записи сгорают через три дня в 11:00 и 13:00 UTC - в один день при любом часовом поясе БД
+	// от UTC-11 до UTC+10
+	userId := uuid.New()
+	now := time.Now().UTC()
+	morning := time.Date(now.Year(), now.Month(), now.Day(), 11, 0, 0, 0, time.UTC).AddDate(0, 0, -27)
+	insertEntry(t, app, userId, 10, morning, 30)
+	insertEntry(t, app, userId, 20, morning.Add(2*time.Hour), 30)
+
+	var byDay balanceResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/balance", userId), &byDay)
+	if len(byDay.Expiring) != 1 || byDay.Expiring[0].Amount != 30 {
+		t.Errorf("day granularity: got %+v; want one day with 30 points", byDay.Expiring)
+	}
+
+	var byTimestamp balanceResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/balance?granularity=timestamp", userId), &byTimestamp)
+	if len(byTimestamp.Expiring) != 2 {
+		t.Fatalf("timestamp granularity: got %+v; want two expiries", byTimestamp.Expiring)
+	}
+	for i, amount := range []data.Points{10, 20} {
+		item := byTimestamp.Expiring[i]
+		if item.Amount != amount {
+			t.Errorf("expiring[%d]: got %d points; want %d", i, item.Amount, amount)
+		}
+		if _, err := time.Parse(time.RFC3339, item.Date); err != nil {
+			t.Errorf("expiring[%d]: got date %q; want RFC3339: %v", i, item.Date, err)
+		}
+	}
+}
+
+func TestValidateTransactionMinDeposit(t *testing.T) {
+	cfg := testConfig()
+	cfg.limits.minDeposit = 10
+	app := newTestApplication(t, cfg, nil)
+
+	tests := []struct {
+		name   string
+		typ    string
+		amount int
+		valid  bool
+	}{
+		{"deposit below minimum", "deposit", 5, false},
+		{"deposit at minimum", "deposit", 10, true},
+		{"withdrawal below minimum", "withdrawal", 5, true},
+		{"multiply below minimum", "multiply_percent", 5, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			app.validateTransaction(v, &transactionIn{UserId: uuid.NewString(), Amount: tt.amount, Type: tt.typ})
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid=%t (%v); want %t", v.Valid(), v.Errors, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMinDeposit(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.limits.minDeposit = 10
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	status, body := ts.postJSON(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 5, "type": "deposit"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("deposit of 5: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+
+	// Бонус умножения меньше min-deposit все равно начисляется
+	deposit(t, ts, userId, 50)
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 10, "type": "multiply_percent"}, nil)
+
+	if balance := balanceOf(t, app, userId); balance != 55 {
+		t.Errorf("got balance %d; want 55", balance)
+	}
+}
+
+func TestExpiryForecast(t *testing.T) {
+	db := newTestDB(t)
+	// С кэшем балансов: прогноз не должен брать из него баланс
+	cfg := testConfig()
+	cfg.balanceCache = true
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	// Полдень по UTC, чтобы дата сгорания не зависела от часового пояса сессии БД
+	y, m, d := time.Now().UTC().AddDate(0, 0, -1).Date()
+	base := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	day := func(lifetimeDays int) string {
+		return base.AddDate(0, 0, lifetimeDays).Format("2006-01-02")
+	}
+
+	userId := uuid.New()
+	insertEntry(t, app, userId, 30, base, 11)
+	// Кэш запоминает баланс 30, следующие записи добавляются в обход него, как с другой реплики
+	if balance, err := app.balances.get(context.Background(), userId); err != nil || balance != 30 {
+		t.Fatalf("got balance %d, error %v; want 30", balance, err)
+	}
+	insertEntry(t, app, userId, 10, base, 3)
+	insertEntry(t, app, userId, 20, base, 6)
+	insertEntry(t, app, userId, 5, base.AddDate(0, 0, -10), 5) // уже сгорело
+
+	var response struct {
+		Balance  int                  `json:"balance"`
+		Forecast []expiryForecastItem `json:"forecast"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/expiry-forecast", userId), &response)
+
+	want := []expiryForecastItem{
+		{Date: day(3), Amount: 10, Cumulative: 10, Remaining: 50},
+		{Date: day(6), Amount: 20, Cumulative: 30, Remaining: 30},
+		{Date: day(11), Amount: 30, Cumulative: 60, Remaining: 0},
+	}
+
+	if response.Balance != 60 {
+		t.Errorf("got balance %d; want 60", response.Balance)
+	}
+	if len(response.Forecast) != len(want) {
+		t.Fatalf("got %d days; want %d: %+v", len(response.Forecast), len(want), response.Forecast)
+	}
+	for i := range want {
+		if response.Forecast[i] != want[i] {
+			t.Errorf("day %d: got %+v; want %+v", i, response.Forecast[i], want[i])
+		}
+	}
+}
+
+func TestOldestGrants(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	now := time.Now()
+	var entries []*data.BonusEntry
+	for i, amount := range []int{10, 20, 30, 40} {
+		entries = append(entries, insertEntry(t, app, userId, amount, now.AddDate(0, 0, i-10), 30))
+	}
+
+	var response struct {
+		Balance int                  `json:"balance"`
+		Target  int                  `json:"target"`
+		Covered int                  `json:"covered"`
+		Grants  []data.SpendPlanItem `json:"grants"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/oldest-grants?percent=45", userId), &response)
+
+	// 45% от 100 - это 45, первые два начисления дают только 30
+	if response.Balance != 100 || response.Target != 45 || response.Covered != 60 {
+		t.Errorf("got balance=%d target=%d covered=%d; want 100, 45, 60", response.Balance, response.Target, response.Covered)
+	}
+	if len(response.Grants) != 3 {
+		t.Fatalf("got %d grants; want 3", len(response.Grants))
+	}
+	for i, grant := range response.Grants {
+		if grant.EntryId != entries[i].Id {
+			t.Errorf("grants[%d]: got entry %s; want %s", i, grant.EntryId, entries[i].Id)
+		}
+	}
+}
+
+func TestFragmentPolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantBalance int
+		wantJournal []string
+	}{
+		{policy: "keep", wantBalance: 1, wantJournal: []string{"deposit", "withdrawal"}},
+		{policy: "forfeit", wantBalance: 0, wantJournal: []string{"deposit", "withdrawal", "fragment_forfeit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			db := newTestDB(t)
+			cfg := testConfig()
+			cfg.fragments.minAmount = 5
+			cfg.fragments.policy = tt.policy
+			// Релей не запускается, события только копятся в outbox
+			cfg.outbox.webhookURL = "http://127.0.0.1:0/events"
+			app := newTestApplication(t, cfg, db)
+			ts := newTestServer(t, app.routes())
+
+			userId := uuid.New()
+			deposit(t, ts, userId, 10)
+			withdraw(t, ts, userId, 9)
+
+			if balance := balanceOf(t, app, userId); balance != tt.wantBalance {
+				t.Errorf("got balance %d; want %d", balance, tt.wantBalance)
+			}
+
+			var ledger ledgerResponse
+			ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger", userId), &ledger)
+			if len(ledger.Entries) != len(tt.wantJournal) {
+				t.Fatalf("got %d journal rows; want %v", len(ledger.Entries), tt.wantJournal)
+			}
+			for i, row := range ledger.Entries {
+				if row.Type != tt.wantJournal[i] {
+					t.Errorf("row %d: got type %s; want %s", i, row.Type, tt.wantJournal[i])
+				}
+			}
+			if tt.policy == "forfeit" {
+				row := ledger.Entries[2]
+				if row.Amount != 1 || row.Delta != -1 || row.ResultingBalance == nil || *row.ResultingBalance != 0 {
+					t.Errorf("got forfeit amount=%d delta=%d resulting_balance=%v; want 1, -1, 0", row.Amount, row.Delta, row.ResultingBalance)
+				}
+			}
+
+			// Каждая запись журнала, включая сгорание остатка, публикуется через outbox
+			rows, err := db.Query(`SELECT payload FROM outbox ORDER BY created_at`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			var published []string
+			for rows.Next() {
+				var payload []byte
+				if err = rows.Scan(&payload); err != nil {
+					t.Fatal(err)
+				}
+				var trx data.Transaction
+				decodeJSON(t, payload, &trx)
+				published = append(published, trx.Type)
+			}
+			if err = rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if len(published) != len(tt.wantJournal) {
+				t.Errorf("got outbox events %v; want %v", published, tt.wantJournal)
+			}
+		})
+	}
+}
+
+func TestValidateTransactionMaxWithdrawal(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxWithdrawal int
+		typ           string
+		amount        int
+		valid         bool
+	}{
+		{"above cap", 1000, "withdrawal", 1500, false},
+		{"below cap", 1000, "withdrawal", 900, true},
+		{"at cap", 1000, "withdrawal", 1000, true},
+		{"deposit above cap", 1000, "deposit", 1500, true},
+		{"no cap", 0, "withdrawal", 1500, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.limits.maxWithdrawal = tt.maxWithdrawal
+			app := newTestApplication(t, cfg, nil)
+
+			v := validator.New()
+			app.validateTransaction(v, &transactionIn{UserId: uuid.NewString(), Amount: tt.amount, Type: tt.typ})
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid=%t (%v); want %t", v.Valid(), v.Errors, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMaxWithdrawal(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.limits.maxWithdrawal = 1000
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 2000)
+
+	status, body := ts.postJSON(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 1500, "type": "withdrawal"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("withdrawal of 1500: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+	withdraw(t, ts, userId, 900)
+
+	if balance := balanceOf(t, app, userId); balance != 1100 {
+		t.Errorf("got balance %d; want 1100", balance)
+	}
+}
+
+func TestMultiplyBonusClamp(t *testing.T) {
+	entries := []*data.BonusEntry{{Amount: 1000}, {Amount: 500}}
+
+	tests := []struct {
+		name        string
+		percent     int
+		maxBonus    int
+		wantBonus   int
+		wantClamped bool
+	}{
+		{name: "no cap", percent: 10, maxBonus: 0, wantBonus: 150},
+		{name: "below cap", percent: 10, maxBonus: 200, wantBonus: 150},
+		{name: "at cap", percent: 10, maxBonus: 150, wantBonus: 150},
+		{name: "above cap", percent: 50, maxBonus: 200, wantBonus: 200, wantClamped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bonus, clamped, err := multiplyBonus(entries, tt.percent, tt.maxBonus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bonus != tt.wantBonus || clamped != tt.wantClamped {
+				t.Errorf("got bonus %d clamped %t; want %d, %t", bonus, clamped, tt.wantBonus, tt.wantClamped)
+			}
+		})
+	}
+}
+
+func TestMultiplyClampedResponse(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.multiply.maxBonus = 200
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 1500)
+
+	var response struct {
+		RequestedPercent int  `json:"requested_percent"`
+		Granted          int  `json:"granted"`
+		Clamped          bool `json:"clamped"`
+		Balance          int  `json:"balance"`
+	}
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 50, "type": "multiply_percent"}, &response)
+
+	if response.RequestedPercent != 50 || response.Granted != 200 || !response.Clamped || response.Balance != 1700 {
+		t.Errorf("got %+v; want requested_percent 50, granted 200, clamped, balance 1700", response)
+	}
+}
+
+func TestStrictAmounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		amount string
+		valid  bool
+	}{
+		{name: "strict above int32", strict: true, amount: "2147483648", valid: false},
+		{name: "strict at int32", strict: true, amount: "2147483647", valid: true},
+		{name: "lenient above int32", strict: false, amount: "2147483648", valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.strictAmounts = tt.strict
+			app := newTestApplication(t, cfg, nil)
+
+			v := validator.New()
+			var trxIn transactionIn
+			decodeJSON(t, []byte(`{"user_id": "`+uuid.NewString()+`", "type": "deposit", "amount": `+tt.amount+`}`), &trxIn)
+			app.validateTransaction(v, &trxIn)
+
+			if v.Valid() != tt.valid {
+				t.Fatalf("got valid=%t (%v); want %t", v.Valid(), v.Errors, tt.valid)
+			}
+			if !v.Valid() && v.Errors["amount"] != "must not be more than 2147483647" {
+				t.Errorf("got amount error %q", v.Errors["amount"])
+			}
+		})
+	}
+
+	// Через API сумма больше int32 в строгом режиме отклоняется до обращения к БД
+	cfg := testConfig()
+	cfg.strictAmounts = true
+	ts := newTestServer(t, newTestApplication(t, cfg, nil).routes())
+
+	status, body := ts.postJSON(t, "/v1/transactions", `{"user_id": "`+uuid.NewString()+`", "type": "deposit", "amount": 2147483648}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
+
+// TestMultiplyInterleavedWithWithdrawal выполняет умножения и списания одного пользователя
+// одновременно и проверяет по журналу, что операции выполнились строго друг за другом:
+// каждый бонус посчитан от баланса после предыдущей операции
+func TestMultiplyInterleavedWithWithdrawal(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 1000)
+
+	const rounds = 5
+	var wg sync.WaitGroup
+	for range rounds {
+		for _, body := range []map[string]any{
+			{"user_id": userId, "amount": 10, "type": "multiply_percent"},
+			{"user_id": userId, "amount": 100, "type": "withdrawal"},
+		} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, _, respBody, err := ts.send(http.MethodPost, "/v1/transactions", body, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if status != http.StatusOK {
+					t.Errorf("%s: got status %d: %s", body["type"], status, respBody)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	var ledger ledgerResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger?limit=100", userId), &ledger)
+	if len(ledger.Entries) != 2*rounds+1 {
+		t.Fatalf("got %d journal rows; want %d", len(ledger.Entries), 2*rounds+1)
+	}
+
+	var balance data.Points
+	for i, row := range ledger.Entries {
+		switch row.Type {
+		case "multiply_percent":
+			if want := balance * 10 / 100; row.Delta != want {
+				t.Errorf("row %d: got bonus %d on balance %d; want %d", i, row.Delta, balance, want)
+			}
+		case "withdrawal":
+			if row.Delta != -100 {
+				t.Errorf("row %d: got withdrawal delta %d; want -100", i, row.Delta)
+			}
+		}
+		balance += row.Delta
+		if row.ResultingBalance == nil || *row.ResultingBalance != balance {
+			t.Errorf("row %d: got resulting_balance %v; want %d", i, row.ResultingBalance, balance)
+		}
+	}
+
+	if stored := balanceOf(t, app, userId); data.Points(stored) != balance {
+		t.Errorf("got balance %d; want %d from the journal", stored, balance)
+	}
+}
+
+func TestBalanceVersions(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 40)
+	url := fmt.Sprintf("/v1/users/%s/balance", userId)
+
+	balance := func(version string) (int, http.Header, []byte) {
+		t.Helper()
+		header := http.Header{}
+		if version != "" {
+			header.Set("Accept-Version", version)
+		}
+		return ts.request(t, http.MethodGet, url, nil, header)
+	}
+
+	for _, version := range []string{"", "v1"} {
+		status, header, body := balance(version)
+		if status != http.StatusOK {
+			t.Fatalf("version %q: got status %d: %s", version, status, body)
+		}
+		var v1 balanceResponse
+		decodeJSON(t, body, &v1)
+		if v1.UserId != userId || v1.Balance != 40 {
+			t.Errorf("version %q: got %+v; want the flat balance of 40", version, v1)
+		}
+		if header.Get("Vary") != "Accept-Version" {
+			t.Errorf("version %q: got Vary %q", version, header.Get("Vary"))
+		}
+	}
+
+	status, _, body := balance("v2")
+	if status != http.StatusOK {
+		t.Fatalf("version 2: got status %d: %s", status, body)
+	}
+	var v2 struct {
+		Version int              `json:"version"`
+		Data    *balanceResponse `json:"data"`
+		Balance *int             `json:"balance"`
+	}
+	decodeJSON(t, body, &v2)
+	if v2.Version != 2 || v2.Data == nil || v2.Data.Balance != 40 || v2.Balance != nil {
+		t.Errorf("version 2: got %s; want the balance nested under data", body)
+	}
+
+	if status, _, body = balance("v3"); status != http.StatusBadRequest {
+		t.Errorf("version 3: got status %d; want %d: %s", status, http.StatusBadRequest, body)
+	}
+}
+
+func TestToTarget(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 100)
+
+	tests := []struct {
+		name    string
+		target  int
+		needed  int
+		reached bool
+	}{
+		{name: "below target", target: 150, needed: 50, reached: false},
+		{name: "at target", target: 100, needed: 0, reached: true},
+		{name: "above target", target: 60, needed: 0, reached: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Balance int  `json:"balance"`
+				Needed  int  `json:"needed"`
+				Reached bool `json:"reached"`
+			}
+			ts.mustGet(t, fmt.Sprintf("/v1/users/%s/to-target?target=%d", userId, tt.target), &response)
+
+			if response.Balance != 100 || response.Needed != tt.needed || response.Reached != tt.reached {
+				t.Errorf("got %+v; want balance 100, needed %d, reached %t", response, tt.needed, tt.reached)
+			}
+		})
+	}
+
+	if status, body := ts.get(t, fmt.Sprintf("/v1/users/%s/to-target?target=0", userId)); status != http.StatusUnprocessableEntity {
+		t.Errorf("zero target: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
+
+func TestValidateTransactionLifetime(t *testing.T) {
+	tests := []struct {
+		name       string
+		lifetime   string
+		rejectNull bool
+		valid      bool
+	}{
+		{name: "omitted", lifetime: "", valid: true},
+		{name: "explicit null", lifetime: `, "lifetime_days": null`, valid: true},
+		{name: "explicit null rejected", lifetime: `, "lifetime_days": null`, rejectNull: true, valid: false},
+		{name: "omitted with reject-null", lifetime: "", rejectNull: true, valid: true},
+		{name: "positive", lifetime: `, "lifetime_days": 10`, valid: true},
+		{name: "zero", lifetime: `, "lifetime_days": 0`, valid: false},
+		{name: "negative", lifetime: `, "lifetime_days": -5`, valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.rejectNullLifetime = tt.rejectNull
+			app := newTestApplication(t, cfg, nil)
+
+			var trxIn transactionIn
+			decodeJSON(t, []byte(`{"user_id": "`+uuid.NewString()+`", "type": "deposit", "amount": 10`+tt.lifetime+`}`), &trxIn)
+
+			v := validator.New()
+			app.validateTransaction(v, &trxIn)
+
+			if v.Valid() != tt.valid {
+				t.Fatalf("got valid=%t (%v); want %t", v.Valid(), v.Errors, tt.valid)
+			}
+			if !tt.valid {
+				if _, ok := v.Errors["lifetime_days"]; !ok {
+					t.Errorf("got errors %v; want an error for lifetime_days", v.Errors)
+				}
+			}
+		})
+	}
+}
+
+func TestNullLifetimeUsesDefault(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	ts.mustPost(t, "/v1/transactions", `{"user_id": "`+userId.String()+`", "type": "deposit", "amount": 10, "lifetime_days": null}`, nil)
+
+	entries := listEntries(t, ts, userId)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries; want 1", len(entries))
+	}
+	if lifetime := entries[0].ExpiresAt.Sub(entries[0].CreatedAt); lifetime != 30*24*time.Hour {
+		t.Errorf("got lifetime %v; want the default of 30 days", lifetime)
+	}
+}
+
+func TestExpiryPreviewMatchesDeposit(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	status, _, body := ts.request(t, http.MethodPut, fmt.Sprintf("/v1/admin/users/%s/settings", userId), map[string]any{"default_lifetime_days": 90}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("update settings: got status %d: %s", status, body)
+	}
+
+	var preview struct {
+		LifetimeDays int       `json:"lifetime_days"`
+		ExpiresAt    time.Time `json:"expires_at"`
+	}
+	ts.mustGet(t, "/v1/expiry-preview?user_id="+userId.String(), &preview)
+	if preview.LifetimeDays != 90 {
+		t.Errorf("got previewed lifetime %d; want the user override of 90", preview.LifetimeDays)
+	}
+
+	deposit(t, ts, userId, 10)
+	entries := listEntries(t, ts, userId)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries; want 1", len(entries))
+	}
+
+	// Предпросмотр и начисление сделаны в разные моменты, поэтому допускается разница в пару секунд
+	if diff := entries[0].ExpiresAt.Sub(preview.ExpiresAt); diff < 0 || diff > 2*time.Second {
+		t.Errorf("got deposit expiry %v; want the previewed %v", entries[0].ExpiresAt, preview.ExpiresAt)
+	}
+}
+
+func TestMultiplyPercentGrowsBalance(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 200)
+
+	var response struct {
+		ProcessedAmount int `json:"processed_amount"`
+		Balance         int `json:"balance"`
+	}
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 50, "type": "multiply_percent"}, &response)
+
+	if response.ProcessedAmount != 100 || response.Balance != 300 {
+		t.Errorf("got processed_amount=%d balance=%d; want 100, 300", response.ProcessedAmount, response.Balance)
+	}
+	if balance := balanceOf(t, app, userId); balance != 300 {
+		t.Errorf("got stored balance %d; want 300", balance)
+	}
+
+	// Единственное имя типа - multiply_percent, старое имя multiply отклоняется, а не игнорируется
+	status, body := ts.postJSON(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 50, "type": "multiply"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("type multiply: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
+
+func TestDepositResponseBalance(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	// Просроченная, но еще не сожженная запись в баланс не входит
+	insertEntry(t, app, userId, 5, time.Now().AddDate(0, 0, -2), 1)
+
+	var response struct {
+		Balance int `json:"balance"`
+	}
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 10, "type": "deposit", "lifetime_days": 1}, &response)
+	if response.Balance != 10 {
+		t.Errorf("got response balance %d; want 10 including the deposit", response.Balance)
+	}
+
+	// Сгорание после начисления не затрагивает только что начисленные баллы
+	if _, _, err := app.sweeper.sweep(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if balance := balanceOf(t, app, userId); balance != response.Balance {
+		t.Errorf("got balance %d after the sweep; want %d", balance, response.Balance)
+	}
+
+	var ledger ledgerResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger", userId), &ledger)
+	if len(ledger.Entries) != 1 || ledger.Entries[0].ResultingBalance == nil || *ledger.Entries[0].ResultingBalance != data.Points(response.Balance) {
+		t.Errorf("got journal %+v; want one deposit with resulting_balance %d", ledger.Entries, response.Balance)
+	}
+}
+
+func TestBonusShare(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 200)
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 10, "type": "multiply_percent"}, nil)
+	// Начисление без связи с журналом, как у записей до появления transaction_id
+	insertEntry(t, app, userId, 30, time.Now(), 30)
+
+	var response struct {
+		Balance       int     `json:"balance"`
+		Multiply      int     `json:"multiply"`
+		Organic       int     `json:"organic"`
+		Unattributed  int     `json:"unattributed"`
+		MultiplyShare float64 `json:"multiply_share"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/bonus-share", userId), &response)
+
+	if response.Balance != 250 {
+		t.Errorf("got balance %d; want 250", response.Balance)
+	}
+	if response.Multiply != 20 {
+		t.Errorf("got multiply %d; want 20", response.Multiply)
+	}
+	if response.Organic != 200 {
+		t.Errorf("got organic %d; want 200", response.Organic)
+	}
+	if response.Unattributed != 30 {
+		t.Errorf("got unattributed %d; want 30", response.Unattributed)
+	}
+	if response.MultiplyShare != 8 {
+		t.Errorf("got multiply_share %v; want 8", response.MultiplyShare)
+	}
+}
+
+func TestSourcePolicyLifetime(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.request(t, http.MethodPut, "/v1/admin/source-policies/promo", map[string]any{"default_lifetime_days": 14}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("put policy: got status %d; want %d: %s", status, http.StatusOK, body)
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		lifetime int
+		wantDays int
+	}{
+		{name: "source with a policy", source: "promo", wantDays: 14},
+		{name: "source without a policy", source: "purchase", wantDays: 30},
+		{name: "no source", wantDays: 30},
+		{name: "explicit lifetime wins", source: "promo", lifetime: 5, wantDays: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userId := uuid.New()
+			input := map[string]any{"user_id": userId, "amount": 10, "type": "deposit"}
+			if tt.source != "" {
+				input["source"] = tt.source
+			}
+			if tt.lifetime != 0 {
+				input["lifetime_days"] = tt.lifetime
+			}
+			ts.mustPost(t, "/v1/transactions", input, nil)
+
+			entries := listEntries(t, ts, userId)
+			if len(entries) != 1 {
+				t.Fatalf("got %d entries; want 1", len(entries))
+			}
+			lifetime := entries[0].ExpiresAt.Sub(entries[0].CreatedAt)
+			if want := time.Duration(tt.wantDays) * 24 * time.Hour; lifetime != want {
+				t.Errorf("got lifetime %v; want %v", lifetime, want)
+			}
+		})
+	}
+}
+
+func TestTransferCorrelation(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	sender, recipient := uuid.New(), uuid.New()
+	deposit(t, ts, sender, 100)
+
+	var transfer struct {
+		CorrelationId uuid.UUID `json:"correlation_id"`
+	}
+	ts.mustPost(t, "/v1/transactions", map[string]any{
+		"user_id":    sender,
+		"to_user_id": recipient,
+		"amount":     40,
+		"type":       "transfer",
+	}, &transfer)
+
+	var group struct {
+		Transactions []data.Transaction `json:"transactions"`
+	}
+	ts.mustGet(t, "/v1/transactions?correlation_id="+transfer.CorrelationId.String(), &group)
+
+	deltas := map[uuid.UUID]data.Points{}
+	for _, trx := range group.Transactions {
+		if trx.CorrelationId == nil || *trx.CorrelationId != transfer.CorrelationId {
+			t.Errorf("got transaction %s with correlation id %v; want %s", trx.Id, trx.CorrelationId, transfer.CorrelationId)
+		}
+		deltas[trx.UserId] += trx.Delta
+	}
+	if len(group.Transactions) != 2 {
+		t.Fatalf("got %d transactions in the group; want 2", len(group.Transactions))
+	}
+	if deltas[sender] != -40 || deltas[recipient] != 40 {
+		t.Errorf("got deltas sender %d, recipient %d; want -40, 40", deltas[sender], deltas[recipient])
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "invalid id", query: "correlation_id=abc", wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown id", query: "correlation_id=" + uuid.NewString(), wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := ts.get(t, "/v1/transactions?"+tt.query); status != tt.wantStatus {
+				t.Errorf("got status %d; want %d: %s", status, tt.wantStatus, body)
+			}
+		})
+	}
+}
+
+func TestMultiplyPreview(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.multiply.bonusLifetimeDays = 7
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	deposit(t, ts, userId, 200)
+
+	var preview struct {
+		Base           int64     `json:"base"`
+		Bonus          int       `json:"bonus"`
+		LifetimeDays   int       `json:"lifetime_days"`
+		BonusExpiresAt time.Time `json:"bonus_expires_at"`
+		OutlivesBase   bool      `json:"outlives_base"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/multiply-preview?percent=10", userId), &preview)
+
+	if preview.Base != 200 || preview.Bonus != 20 || preview.LifetimeDays != 7 {
+		t.Errorf("got base %d, bonus %d, lifetime %d; want 200, 20, 7", preview.Base, preview.Bonus, preview.LifetimeDays)
+	}
+	// Бонус на 7 дней сгорает раньше исходных баллов на 30 дней
+	if preview.OutlivesBase {
+		t.Error("got outlives_base true; want false")
+	}
+	// Предпросмотр ничего не начисляет
+	if entries := listEntries(t, ts, userId); len(entries) != 1 {
+		t.Fatalf("got %d entries after the preview; want 1", len(entries))
+	}
+
+	var multiply struct {
+		Granted int `json:"granted"`
+	}
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 10, "type": "multiply_percent"}, &multiply)
+	if multiply.Granted != preview.Bonus {
+		t.Errorf("got granted %d; want the previewed %d", multiply.Granted, preview.Bonus)
+	}
+
+	var bonus *entryResponse
+	for _, entry := range listEntries(t, ts, userId) {
+		if int(entry.Amount) == multiply.Granted {
+			bonus = &entry
+		}
+	}
+	if bonus == nil {
+		t.Fatal("got no bonus entry after the multiply")
+	}
+	// Предпросмотр и начисление выполняются в разные секунды
+	if diff := bonus.ExpiresAt.Sub(preview.BonusExpiresAt); diff < 0 || diff > 5*time.Second {
+		t.Errorf("got bonus expiry %v; want the previewed %v", bonus.ExpiresAt, preview.BonusExpiresAt)
+	}
+}
+
+func TestBalanceExpiringSorted(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	// Полдень по UTC, чтобы дата сгорания не зависела от часового пояса сессии БД
+	y, m, d := time.Now().UTC().AddDate(0, 0, -1).Date()
+	base := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	day := func(lifetimeDays int) string {
+		return base.AddDate(0, 0, lifetimeDays).Format("2006-01-02")
+	}
+
+	userId := uuid.New()
+	// Записи добавляются не в порядке сгорания
+	insertEntry(t, app, userId, 5, base, 6)
+	insertEntry(t, app, userId, 10, base, 3)
+	insertEntry(t, app, userId, 7, base, 7)
+	insertEntry(t, app, userId, 3, base, 3)
+
+	want := []data.ExpiringTotal{
+		{Date: day(3), Amount: 13},
+		{Date: day(6), Amount: 5},
+		{Date: day(7), Amount: 7},
+	}
+
+	for i := range 3 {
+		var response balanceResponse
+		ts.mustGet(t, fmt.Sprintf("/v1/users/%s/balance", userId), &response)
+
+		if len(response.Expiring) != len(want) {
+			t.Fatalf("request %d: got %d expiring days; want %d: %+v", i, len(response.Expiring), len(want), response.Expiring)
+		}
+		for j, w := range want {
+			if response.Expiring[j] != w {
+				t.Errorf("request %d: expiring[%d]: got %+v; want %+v", i, j, response.Expiring[j], w)
+			}
+		}
+	}
+}
+
+func TestDuplicateReference(t *testing.T) {
+	db := newTestDB(t)
+
+	tests := []struct {
+		policy     string
+		wantStatus int
+	}{
+		{policy: "skip", wantStatus: http.StatusOK},
+		{policy: "reject", wantStatus: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.duplicateReferencePolicy = tt.policy
+			app := newTestApplication(t, cfg, db)
+			ts := newTestServer(t, app.routes())
+
+			userId := uuid.New()
+			grant := map[string]any{
+				"user_id":            userId,
+				"amount":             100,
+				"type":               "deposit",
+				"source":             "partner",
+				"external_reference": "grant-1",
+			}
+			ts.mustPost(t, "/v1/transactions", grant, nil)
+
+			status, body := ts.postJSON(t, "/v1/transactions", grant)
+			if status != tt.wantStatus {
+				t.Fatalf("repeated import: got status %d; want %d: %s", status, tt.wantStatus, body)
+			}
+			if status == http.StatusOK {
+				var report struct {
+					Skipped         bool `json:"skipped"`
+					ProcessedAmount int  `json:"processed_amount"`
+					Balance         int  `json:"balance"`
+				}
+				decodeJSON(t, body, &report)
+				if !report.Skipped || report.ProcessedAmount != 0 || report.Balance != 100 {
+					t.Errorf("got report %+v; want skipped with processed_amount 0 and balance 100", report)
+				}
+			}
+
+			if entries := listEntries(t, ts, userId); len(entries) != 1 {
+				t.Errorf("got %d entries; want 1", len(entries))
+			}
+
+			// Тот же external_reference из другого источника - другое начисление
+			grant["source"] = "promo"
+			ts.mustPost(t, "/v1/transactions", grant, nil)
+			if balance := balanceOf(t, app, userId); balance != 200 {
+				t.Errorf("got balance %d; want 200", balance)
+			}
+		})
+	}
+}
+
+func TestMultiplyBonusOverflow(t *testing.T) {
+	tests := []struct {
+		name      string
+		amounts   []int
+		percent   int
+		maxBonus  int
+		wantBonus int
+		wantErr   error
+	}{
+		{name: "largest bonus that fits", amounts: []int{math.MaxInt32}, percent: 100, wantBonus: math.MaxInt32},
+		{name: "bonus above int32", amounts: []int{math.MaxInt32, math.MaxInt32}, percent: 100, wantErr: errMultiplyOverflow},
+		{name: "total overflows", amounts: []int{math.MaxInt, math.MaxInt}, percent: 100, wantErr: errMultiplyOverflow},
+		{name: "product overflows", amounts: []int{math.MaxInt32}, percent: math.MaxInt, wantErr: errMultiplyOverflow},
+		{name: "cap keeps the bonus in range", amounts: []int{math.MaxInt32, math.MaxInt32}, percent: 100, maxBonus: 1000, wantBonus: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []*data.BonusEntry
+			for _, amount := range tt.amounts {
+				entries = append(entries, &data.BonusEntry{Amount: data.Points(amount)})
+			}
+
+			bonus, _, err := multiplyBonus(entries, tt.percent, tt.maxBonus)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if bonus != tt.wantBonus {
+				t.Errorf("got bonus %d; want %d", bonus, tt.wantBonus)
+			}
+		})
+	}
+}
+
+func TestMultiplyOverflowResponse(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	insertEntry(t, app, userId, math.MaxInt32, time.Now(), 30)
+	insertEntry(t, app, userId, math.MaxInt32, time.Now(), 30)
+
+	status, body := ts.postJSON(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 100, "type": "multiply_percent"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+	if entries := listEntries(t, ts, userId); len(entries) != 2 {
+		t.Errorf("got %d entries; want 2 without a bonus", len(entries))
+	}
+}
+
+func TestOldestGrantsSelection(t *testing.T) {
+	now := time.Now()
+	entries := []*data.BonusEntry{
+		{Id: uuid.New(), Amount: 40, CreatedAt: now.AddDate(0, 0, -4), LifetimeDays: 30},
+		{Id: uuid.New(), Amount: 30, CreatedAt: now.AddDate(0, 0, -3), LifetimeDays: 30},
+		{Id: uuid.New(), Amount: 20, CreatedAt: now.AddDate(0, 0, -2), LifetimeDays: 30},
+		{Id: uuid.New(), Amount: 10, CreatedAt: now.AddDate(0, 0, -1), LifetimeDays: 30},
+	}
+
+	tests := []struct {
+		name        string
+		percent     int
+		wantTarget  int
+		wantCovered int
+		wantGrants  int
+	}{
+		{name: "exactly the oldest grant", percent: 40, wantTarget: 40, wantCovered: 40, wantGrants: 1},
+		{name: "grants expire whole", percent: 50, wantTarget: 50, wantCovered: 70, wantGrants: 2},
+		{name: "target rounds up", percent: 1, wantTarget: 1, wantCovered: 40, wantGrants: 1},
+		{name: "everything", percent: 100, wantTarget: 100, wantCovered: 100, wantGrants: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			balance, target, covered, plan := oldestGrants(entries, tt.percent)
+			if balance != 100 || target != tt.wantTarget || covered != tt.wantCovered {
+				t.Errorf("got balance %d, target %d, covered %d; want 100, %d, %d", balance, target, covered, tt.wantTarget, tt.wantCovered)
+			}
+			if len(plan) != tt.wantGrants {
+				t.Fatalf("got %d grants; want %d", len(plan), tt.wantGrants)
+			}
+
+			sum := 0
+			for i, item := range plan {
+				if item.EntryId != entries[i].Id {
+					t.Errorf("grants[%d]: got entry %s; want %s in FIFO order", i, item.EntryId, entries[i].Id)
+				}
+				sum += int(item.Amount)
+			}
+			if sum != covered {
+				t.Errorf("got grants summing to %d; want %d", sum, covered)
+			}
+		})
+	}
+}
+
+func TestExpirySimulation(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	oldest := insertEntry(t, app, userId, 40, time.Now().AddDate(0, 0, -3), 30)
+	older := insertEntry(t, app, userId, 30, time.Now().AddDate(0, 0, -2), 30)
+	insertEntry(t, app, userId, 30, time.Now().AddDate(0, 0, -1), 30)
+
+	var response struct {
+		Balance          int                  `json:"balance"`
+		Target           int                  `json:"target"`
+		Expiring         int                  `json:"expiring"`
+		ProjectedBalance int                  `json:"projected_balance"`
+		ReducedPercent   float64              `json:"reduced_percent"`
+		Grants           []data.SpendPlanItem `json:"grants"`
+	}
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/expiry-simulation?percent=50", userId), &response)
+
+	if response.Balance != 100 || response.Target != 50 || response.Expiring != 70 || response.ProjectedBalance != 30 {
+		t.Errorf("got %+v; want balance 100, target 50, expiring 70, projected_balance 30", response)
+	}
+	if response.ReducedPercent != 70 {
+		t.Errorf("got reduced_percent %v; want 70", response.ReducedPercent)
+	}
+	if len(response.Grants) != 2 || response.Grants[0].EntryId != oldest.Id || response.Grants[1].EntryId != older.Id {
+		t.Errorf("got grants %+v; want the two oldest", response.Grants)
+	}
+
+	// Моделирование ничего не меняет
+	if balance := balanceOf(t, app, userId); balance != 100 {
+		t.Errorf("got balance %d after the simulation; want 100", balance)
+	}
+
+	if status, body := ts.get(t, fmt.Sprintf("/v1/users/%s/expiry-simulation?percent=101", userId)); status != http.StatusUnprocessableEntity {
+		t.Errorf("percent 101: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
+
+func TestRiskBreakdown(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	now := time.Now()
+	userId := uuid.New()
+	soonest := insertEntry(t, app, userId, 10, now.AddDate(0, 0, -25), 30) // через 5 дней
+	insertEntry(t, app, userId, 20, now.AddDate(0, 0, -10), 30)            // через 20 дней
+	insertEntry(t, app, userId, 30, now, 60)                               // через 60 дней
+	insertEntry(t, app, userId, 40, now.AddDate(0, 0, -40), 30)            // уже сгорело
+
+	tests := []struct {
+		name         string
+		userId       uuid.UUID
+		days         int
+		wantAtRisk   int
+		wantSafe     int
+		wantEarliest bool
+	}{
+		{name: "default window", userId: userId, days: 30, wantAtRisk: 30, wantSafe: 30, wantEarliest: true},
+		{name: "short window", userId: userId, days: 10, wantAtRisk: 10, wantSafe: 50, wantEarliest: true},
+		{name: "nothing at risk", userId: userId, days: 1, wantAtRisk: 0, wantSafe: 60},
+		{name: "empty balance", userId: uuid.New(), days: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Balance        int        `json:"balance"`
+				AtRisk         int        `json:"at_risk"`
+				Safe           int        `json:"safe"`
+				EarliestAtRisk *time.Time `json:"earliest_at_risk"`
+			}
+			ts.mustGet(t, fmt.Sprintf("/v1/users/%s/risk-breakdown?days=%d", tt.userId, tt.days), &response)
+
+			if response.AtRisk != tt.wantAtRisk || response.Safe != tt.wantSafe || response.Balance != tt.wantAtRisk+tt.wantSafe {
+				t.Errorf("got at_risk %d, safe %d, balance %d; want %d, %d, %d",
+					response.AtRisk, response.Safe, response.Balance, tt.wantAtRisk, tt.wantSafe, tt.wantAtRisk+tt.wantSafe)
+			}
+
+			switch {
+			case !tt.wantEarliest && response.EarliestAtRisk != nil:
+				t.Errorf("got earliest_at_risk %v; want null", response.EarliestAtRisk)
+			case tt.wantEarliest && response.EarliestAtRisk == nil:
+				t.Errorf("got no earliest_at_risk; want %v", soonest.ExpiresAt())
+			case tt.wantEarliest:
+				// Время начисления хранится в БД с точностью до секунды
+				if diff := response.EarliestAtRisk.Sub(soonest.ExpiresAt()); diff < -time.Second || diff > time.Second {
+					t.Errorf("got earliest_at_risk %v; want %v", response.EarliestAtRisk, soonest.ExpiresAt())
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	variants := []string{"promo", "Promo", "promo ", " PROMO "}
+
+	for _, mode := range []string{"strict", "lenient"} {
+		for _, variant := range variants {
+			t.Run(fmt.Sprintf("%s %q", mode, variant), func(t *testing.T) {
+				cfg := testConfig()
+				cfg.sourceValidation = mode
+				app := newTestApplication(t, cfg, nil)
+
+				source := variant
+				v := validator.New()
+				app.checkSource(v, "source", &source)
+
+				// В строгом режиме допустимо только нормализованное значение, в мягком любое приводится к нему
+				wantValid := mode == "lenient" || variant == "promo"
+				if v.Valid() != wantValid {
+					t.Errorf("got valid %t; want %t: %v", v.Valid(), wantValid, v.Errors)
+				}
+
+				wantSource := "promo"
+				if mode == "strict" {
+					wantSource = variant
+				}
+				if source != wantSource {
+					t.Errorf("got source %q; want %q", source, wantSource)
+				}
+			})
+		}
+	}
+}
+
+func TestStrictSourceRequests(t *testing.T) {
+	cfg := testConfig()
+	cfg.sourceValidation = "strict"
+	// Ненормализованный источник отклоняется до обращения к БД
+	app := newTestApplication(t, cfg, nil)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+	}{
+		{
+			name:   "deposit",
+			method: http.MethodPost,
+			path:   "/v1/transactions",
+			body:   map[string]any{"user_id": userId, "amount": 10, "type": "deposit", "source": "Promo"},
+		},
+		{
+			name:   "multiply preview",
+			method: http.MethodGet,
+			path:   fmt.Sprintf("/v1/users/%s/multiply-preview?percent=10&source=promo%%20", userId),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, body := ts.request(t, tt.method, tt.path, tt.body, nil)
+			if status != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+			}
+		})
+	}
+}
+
+func TestTransferProvenance(t *testing.T) {
+	db := newTestDB(t)
+
+	// sourcedEntry - начисление получателя в порядке сгорания
+	type sourcedEntry struct {
+		amount    int
+		source    string
+		expiresAt time.Time
+	}
+	entriesOf := func(t *testing.T, userId uuid.UUID) []sourcedEntry {
+		t.Helper()
+
+		rows, err := db.Query(`SELECT amount, source, expires_at FROM bonus_entries WHERE user_id = $1 AND status = 'active' ORDER BY expires_at`, userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var entries []sourcedEntry
+		for rows.Next() {
+			var entry sourcedEntry
+			if err := rows.Scan(&entry.amount, &entry.source, &entry.expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		return entries
+	}
+
+	tests := []struct {
+		provenance string
+		// inherit - ожидаются записи со сроками записей отправителя, иначе одна запись на 30 дней
+		inherit    bool
+		wantSource []string
+		wantAmount []int
+	}{
+		{provenance: "request", wantSource: []string{"gift"}, wantAmount: []int{40}},
+		{provenance: "transfer", wantSource: []string{"transfer"}, wantAmount: []int{40}},
+		{provenance: "inherit", inherit: true, wantSource: []string{"referral", "promo"}, wantAmount: []int{30, 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provenance, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.transfer.provenance = tt.provenance
+			app := newTestApplication(t, cfg, db)
+			ts := newTestServer(t, app.routes())
+
+			sender, recipient := uuid.New(), uuid.New()
+			for _, grant := range []struct {
+				amount   int
+				ageDays  int
+				lifetime int
+				source   string
+			}{
+				{30, 5, 10, "referral"},
+				{50, 1, 60, "promo"},
+			} {
+				entry := insertEntry(t, app, sender, grant.amount, time.Now().AddDate(0, 0, -grant.ageDays), grant.lifetime)
+				if _, err := db.Exec(`UPDATE bonus_entries SET source = $2 WHERE id = $1`, entry.Id, grant.source); err != nil {
+					t.Fatal(err)
+				}
+			}
+			senderEntries := entriesOf(t, sender)
+
+			ts.mustPost(t, "/v1/transactions", map[string]any{
+				"user_id":    sender,
+				"to_user_id": recipient,
+				"amount":     40,
+				"type":       "transfer",
+				"source":     "gift",
+			}, nil)
+
+			got := entriesOf(t, recipient)
+			if len(got) != len(tt.wantAmount) {
+				t.Fatalf("got %d recipient entries; want %d: %+v", len(got), len(tt.wantAmount), got)
+			}
+			for i, entry := range got {
+				if entry.amount != tt.wantAmount[i] || entry.source != tt.wantSource[i] {
+					t.Errorf("entries[%d]: got %d from %q; want %d from %q", i, entry.amount, entry.source, tt.wantAmount[i], tt.wantSource[i])
+				}
+
+				wantExpiry := time.Now().AddDate(0, 0, 30)
+				if tt.inherit {
+					wantExpiry = senderEntries[i].expiresAt
+				}
+				// Время начисления хранится с точностью до секунды, а новая запись создается позже wantExpiry
+				if diff := entry.expiresAt.Sub(wantExpiry); diff < -5*time.Second || diff > 5*time.Second {
+					t.Errorf("entries[%d]: got expiry %v; want %v", i, entry.expiresAt, wantExpiry)
+				}
+			}
+		})
+	}
+}
+
+func TestBalanceCategory(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	for _, grant := range []struct {
+		amount       int
+		lifetimeDays int
+		category     string
+	}{
+		{amount: 100, lifetimeDays: 3, category: "promo"},
+		{amount: 50, lifetimeDays: 5, category: ""},
+		{amount: 20, lifetimeDays: 60, category: "promo"},
+	} {
+		ts.mustPost(t, "/v1/transactions", map[string]any{
+			"user_id":       userId,
+			"amount":        grant.amount,
+			"type":          "deposit",
+			"lifetime_days": grant.lifetimeDays,
+			"category":      grant.category,
+		}, nil)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		balance  data.Points
+		expiring data.Points
+	}{
+		{name: "all categories", query: "", balance: 170, expiring: 150},
+		{name: "promo", query: "?category=promo", balance: 120, expiring: 100},
+		{name: "default", query: "?category=default", balance: 50, expiring: 50},
+		{name: "empty category", query: "?category=gift", balance: 0, expiring: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response balanceResponse
+			ts.mustGet(t, fmt.Sprintf("/v1/users/%s/balance%s", userId, tt.query), &response)
+
+			var expiring data.Points
+			for _, item := range response.Expiring {
+				expiring += item.Amount
+			}
+
+			if response.Balance != tt.balance {
+				t.Errorf("got balance %d; want %d", response.Balance, tt.balance)
+			}
+			if expiring != tt.expiring {
+				t.Errorf("got %d points expiring; want %d: %+v", expiring, tt.expiring, response.Expiring)
+			}
+			if expiring > response.Balance {
+				t.Errorf("got %d points expiring out of a balance of %d", expiring, response.Balance)
+			}
+		})
+	}
+}
+
+func TestToleratedFields(t *testing.T) {
+	db := newTestDB(t)
+	var log lockedBuffer
+	cfg := testConfig()
+	cfg.toleratedFields = "promo_code,channel"
+	app := newTestApplication(t, cfg, db)
+	app.logger = jsonlog.New(&log, jsonlog.LevelInfo)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	ts.mustPost(t, "/v1/transactions", map[string]any{
+		"user_id":    userId,
+		"amount":     100,
+		"type":       "deposit",
+		"promo_code": "spring",
+	}, nil)
+
+	if got := balanceOf(t, app, userId); got != 100 {
+		t.Errorf("got balance %d; want 100", got)
+	}
+	if !strings.Contains(log.String(), "deprecation notice") || !strings.Contains(log.String(), `"field":"promo_code"`) {
+		t.Errorf("got log %q; want a deprecation notice for promo_code", log.String())
+	}
+
+	status, body := ts.postJSON(t, "/v1/transactions", map[string]any{
+		"user_id": userId,
+		"amount":  100,
+		"type":    "deposit",
+		"bogus":   1,
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("got status %d; want %d: %s", status, http.StatusBadRequest, body)
+	}
+}
+
+func TestDepositIncludeEntry(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApplication(t, testConfig(), db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	grant := map[string]any{"user_id": userId, "amount": 100, "type": "deposit", "lifetime_days": 10}
+
+	var response struct {
+		Balance int            `json:"balance"`
+		Entry   *grantResponse `json:"entry"`
+	}
+	ts.mustPost(t, "/v1/transactions?include=entry", grant, &response)
+
+	if response.Entry == nil {
+		t.Fatal("got no entry with include=entry")
+	}
+	entries := listEntries(t, ts, userId)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries; want 1", len(entries))
+	}
+	if response.Entry.Id != entries[0].Id || response.Entry.LifetimeDays != 10 {
+		t.Errorf("got entry %+v; want id %s and lifetime 10", response.Entry, entries[0].Id)
+	}
+	// Время начисления хранится в БД с точностью до секунды
+	if diff := response.Entry.ExpiresAt.Sub(entries[0].ExpiresAt); diff < -time.Second || diff > time.Second {
+		t.Errorf("got expires_at %v; want %v", response.Entry.ExpiresAt, entries[0].ExpiresAt)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body map[string]any
+	}{
+		{name: "deposit by default", path: "/v1/transactions", body: grant},
+		{name: "withdrawal creates no entry", path: "/v1/transactions?include=entry", body: map[string]any{"user_id": userId, "amount": 10, "type": "withdrawal"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]any
+			ts.mustPost(t, tt.path, tt.body, &body)
+			if _, ok := body["entry"]; ok {
+				t.Errorf("got entry in %v; want it omitted", body)
+			}
+		})
+	}
+
+	if status, body := ts.postJSON(t, "/v1/transactions?include=balance", grant); status != http.StatusUnprocessableEntity {
+		t.Errorf("include=balance: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+}
+
+func TestSpendPreviewLimit(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.limits.spendPreviewEntries = 5
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	// 20 начислений по одному баллу, по одному в минуту
+	userId := uuid.New()
+	_, err := db.Exec(`
+		INSERT INTO bonus_entries (user_id, amount, created_at, expires_at, lifetime_days)
+		SELECT $1, 1, NOW() - i * INTERVAL '1 minute', NOW() - i * INTERVAL '1 minute' + INTERVAL '30 days', 30
+		FROM generate_series(1, 20) AS i`, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		wantEntries   int
+		wantTruncated bool
+	}{
+		{name: "default limit", query: "amount=20", wantEntries: 5, wantTruncated: true},
+		{name: "smaller limit", query: "amount=20&limit=3", wantEntries: 3, wantTruncated: true},
+		{name: "plan within the limit", query: "amount=4", wantEntries: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var plan spendPlanResponse
+			ts.mustGet(t, fmt.Sprintf("/v1/users/%s/spend-plan?%s", userId, tt.query), &plan)
+
+			if len(plan.Plan) != tt.wantEntries || plan.Truncated != tt.wantTruncated {
+				t.Errorf("got %d entries, truncated %t; want %d, %t", len(plan.Plan), plan.Truncated, tt.wantEntries, tt.wantTruncated)
+			}
+			if plan.Available != 20 {
+				t.Errorf("got available %d; want 20 from all entries", plan.Available)
+			}
+		})
+	}
+
+	if status, body := ts.get(t, fmt.Sprintf("/v1/users/%s/spend-plan?amount=20&limit=6", userId)); status != http.StatusUnprocessableEntity {
+		t.Errorf("limit above the maximum: got status %d; want %d: %s", status, http.StatusUnprocessableEntity, body)
+	}
+
+	// Предпросмотр списания видит все записи, но показывает только первые limit
+	var preview struct {
+		Sufficient bool                 `json:"sufficient"`
+		Entries    []data.SpendPlanItem `json:"entries"`
+		Truncated  bool                 `json:"truncated"`
+	}
+	ts.mustPost(t, "/v1/transactions/preview", map[string]any{"user_id": userId, "amount": 20, "type": "withdrawal"}, &preview)
+	if !preview.Sufficient || len(preview.Entries) != 5 || !preview.Truncated {
+		t.Errorf("got preview sufficient %t with %d entries, truncated %t; want true, 5, true", preview.Sufficient, len(preview.Entries), preview.Truncated)
+	}
+
+	// Страница чтения не ограничивает списание: оно расходует все 20 записей
+	withdraw(t, ts, userId, 20)
+	if balance := balanceOf(t, app, userId); balance != 0 {
+		t.Errorf("got balance %d after spending everything; want 0", balance)
+	}
+	entries, err := app.models.BonusEntries.GetActiveEntries(context.Background(), userId, "", data.AllEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d active entries; want 0", len(entries))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Встроенные типы транзакций. Эти же строки принимаются в поле type и пишутся в журнал,
+// поэтому проверка и обработка транзакций должны использовать только эти константы
+const (
+	typeDeposit         = "deposit"
+	typeWithdrawal      = "withdrawal"
+	typeMultiplyPercent = "multiply_percent"
+	typeTransfer        = "transfer"
+)
+
+// transactionTypes сопоставляет каждому типу транзакции базовое поведение:
+// deposit, withdrawal, multiply_percent или transfer
+type transactionTypes map[string]string
+
+// customTypeBehaviors - поведение, которое можно назначить пользовательскому типу
+var customTypeBehaviors = map[string]string{
+	"credit": typeDeposit,
+	"debit":  typeWithdrawal,
+}
+
+// newTransactionTypes создает реестр из встроенных типов и пользовательских типов из
+// конфигурации в формате "referral_bonus=credit,chargeback=debit"
+func newTransactionTypes(custom string) (transactionTypes, error) {
+	types := transactionTypes{
+		typeDeposit:         typeDeposit,
+		typeWithdrawal:      typeWithdrawal,
+		typeMultiplyPercent: typeMultiplyPercent,
+		typeTransfer:        typeTransfer,
+	}
+
+	if custom == "" {
+		return types, nil
+	}
+
+	for _, item := range strings.Split(custom, ",") {
+		name, behavior, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("custom type %q must be in name=behavior format", item)
+		}
+
+		base, ok := customTypeBehaviors[behavior]
+		if !ok {
+			return nil, fmt.Errorf("custom type %q: behavior must be credit or debit", name)
+		}
+		if _, exists := types[name]; exists {
+			return nil, fmt.Errorf("custom type %q is already defined", name)
+		}
+
+		types[name] = base
+	}
+
+	return types, nil
+}
+
+// names возвращает отсортированный список всех типов
+func (t transactionTypes) names() []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// withBase возвращает отсортированный список типов с базовым поведением base
+func (t transactionTypes) withBase(base string) []string {
+	var names []string
+	for _, name := range t.names() {
+		if t[name] == base {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"simple-ledger.itmo.ru/internal/data"
+)
+
+func TestNewTransactionTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		custom  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "built-in only", custom: "", want: map[string]string{"deposit": typeDeposit, "transfer": typeTransfer}},
+		{
+			name:   "custom credit and debit",
+			custom: "referral_bonus=credit, chargeback=debit",
+			want:   map[string]string{"referral_bonus": typeDeposit, "chargeback": typeWithdrawal, "deposit": typeDeposit},
+		},
+		{name: "missing behavior", custom: "referral_bonus", wantErr: true},
+		{name: "unknown behavior", custom: "referral_bonus=bonus", wantErr: true},
+		{name: "redefines built-in", custom: "deposit=debit", wantErr: true},
+		{name: "duplicate custom", custom: "gift=credit,gift=credit", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			types, err := newTransactionTypes(tt.custom)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got no error for %q", tt.custom)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, base := range tt.want {
+				if types[name] != base {
+					t.Errorf("%s: got base %q; want %q", name, types[name], base)
+				}
+			}
+		})
+	}
+}
+
+func TestCustomTransactionTypes(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testConfig()
+	cfg.customTypes = "referral_bonus=credit,chargeback=debit"
+	app := newTestApplication(t, cfg, db)
+	ts := newTestServer(t, app.routes())
+
+	userId := uuid.New()
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 50, "type": "referral_bonus"}, nil)
+	ts.mustPost(t, "/v1/transactions", map[string]any{"user_id": userId, "amount": 20, "type": "chargeback"}, nil)
+
+	if balance := balanceOf(t, app, userId); balance != 30 {
+		t.Errorf("got balance %d; want 30", balance)
+	}
+
+	var ledger ledgerResponse
+	ts.mustGet(t, fmt.Sprintf("/v1/users/%s/ledger", userId), &ledger)
+
+	want := []struct {
+		txType string
+		delta  data.Points
+	}{
+		{"referral_bonus", 50},
+		{"chargeback", -20},
+	}
+	if len(ledger.Entries) != len(want) {
+		t.Fatalf("got %d journal rows; want %d", len(ledger.Entries), len(want))
+	}
+	for i, w := range want {
+		if row := ledger.Entries[i]; row.Type != w.txType || row.Delta != w.delta {
+			t.Errorf("row %d: got %s delta=%d; want %s delta=%d", i, row.Type, row.Delta, w.txType, w.delta)
+		}
+	}
+}
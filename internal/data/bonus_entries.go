@@ -3,9 +3,15 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type BonusEntryStatus string
@@ -14,16 +20,33 @@ const (
 	BonusEntryStatusActive  BonusEntryStatus = "active"
 	BonusEntryStatusExpired BonusEntryStatus = "expired"
 	BonusEntryStatusSpent   BonusEntryStatus = "spent"
+	// BonusEntryStatusVoid - начисление отменено сторнированием создавшей его операции
+	BonusEntryStatusVoid BonusEntryStatus = "void"
 )
 
+// DefaultCategory - категория начислений, для которых она не указана
+const DefaultCategory = "default"
+
 type BonusEntry struct {
 	Id           uuid.UUID        `json:"id"`
 	UserId       uuid.UUID        `json:"user_id"`
-	Amount       int              `json:"amount"`
+	Amount       Points           `json:"amount"`
 	CreatedAt    time.Time        `json:"created_at"`
 	LifetimeDays int              `json:"lifetime_days"`
 	Status       BonusEntryStatus `json:"status"`
 	SpentAt      *time.Time       `json:"spent_at,omitempty"`
+	ExpiredAt    *time.Time       `json:"expired_at,omitempty"`
+	// TransactionId - операция журнала, создавшая начисление (nil для старых записей)
+	TransactionId *uuid.UUID `json:"transaction_id,omitempty"`
+	// Source - источник начисления, пустая строка - источник не указан
+	Source string `json:"source,omitempty"`
+	// ExternalReference - id начисления во внешней системе, пустая строка - не указан.
+	// Остаток частично списанной записи его не наследует, чтобы не нарушить уникальность
+	ExternalReference string `json:"external_reference,omitempty"`
+	// Category - категория баллов, например промо или заработанные, по умолчанию DefaultCategory
+	Category string `json:"category"`
+	// Seq - монотонный номер записи, по которому продолжается выгрузка. Заполняется только GetActiveEntriesPage
+	Seq int64 `json:"-"`
 }
 
 // ExpiresAt вычисляет дату истечения на основе CreatedAt и LifetimeDays
@@ -31,18 +54,31 @@ func (e *BonusEntry) ExpiresAt() time.Time {
 	return e.CreatedAt.AddDate(0, 0, e.LifetimeDays)
 }
 
+// FragmentPolicy определяет, что делать с остатком частично списанной записи,
+// если он меньше MinAmount: при Forfeit остаток сгорает сразу, иначе остается активным
+type FragmentPolicy struct {
+	MinAmount int
+	Forfeit   bool
+}
+
 type BonusEntryModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Fragments    FragmentPolicy
 }
 
 // Insert создает новую запись о начислении баллов
-func (m BonusEntryModel) Insert(entry *BonusEntry) error {
+func (m BonusEntryModel) Insert(ctx context.Context, entry *BonusEntry) error {
 	expiresAt := entry.ExpiresAt()
 	query := `
-		INSERT INTO bonus_entries (id, user_id, amount, created_at, expires_at, lifetime_days, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO bonus_entries (id, user_id, amount, created_at, expires_at, lifetime_days, status, transaction_id, source, category)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		RETURNING id, created_at`
 
+	if entry.Category == "" {
+		entry.Category = DefaultCategory
+	}
+
 	args := []any{
 		entry.Id,
 		entry.UserId,
@@ -51,9 +87,12 @@ func (m BonusEntryModel) Insert(entry *BonusEntry) error {
 		expiresAt,
 		entry.LifetimeDays,
 		entry.Status,
+		entry.TransactionId,
+		entry.Source,
+		entry.Category,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -61,28 +100,160 @@ func (m BonusEntryModel) Insert(entry *BonusEntry) error {
 		&entry.CreatedAt,
 	)
 	if err != nil {
-		return err
+		return queryError(ctx, err)
 	}
 
 	return nil
 }
 
-// GetActiveEntries возвращает все активные записи баллов пользователя, отсортированные по дате создания (FIFO)
-func (m BonusEntryModel) GetActiveEntries(userId uuid.UUID) ([]*BonusEntry, error) {
+// AllEntries - страница без ограничения: GetActiveEntries вернет все записи
+var AllEntries = Filters{}
+
+// GetActiveEntries возвращает активные записи баллов пользователя, отсортированные по дате создания (FIFO).
+// Непустой category оставляет только записи этой категории, как при списании из категории.
+// Для предпросмотров только для чтения выборку можно ограничить страницей filters, с AllEntries
+// возвращаются все записи. Списание читает записи через GetActiveEntriesForUpdate, которая видит все
+func (m BonusEntryModel) GetActiveEntries(ctx context.Context, userId uuid.UUID, category string, filters Filters) ([]*BonusEntry, error) {
 	query := `
 		SELECT id, user_id, amount, created_at, lifetime_days, status, spent_at
 		FROM bonus_entries
 		WHERE user_id = $1 
 			AND status = 'active' 
 			AND expires_at > NOW()
-		ORDER BY created_at ASC`
+			AND ($4 = '' OR category = $4)
+		ORDER BY created_at ASC
+		LIMIT NULLIF($2, 0) OFFSET $3`
+
+	offset := 0
+	if filters.PageSize > 0 {
+		offset = filters.offset()
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userId)
+	rows, err := m.DB.QueryContext(ctx, query, userId, filters.limit(), offset, category)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var entries []*BonusEntry
+	for rows.Next() {
+		var entry BonusEntry
+		err := rows.Scan(
+			&entry.Id,
+			&entry.UserId,
+			&entry.Amount,
+			&entry.CreatedAt,
+			&entry.LifetimeDays,
+			&entry.Status,
+			&entry.SpentAt,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return entries, nil
+}
+
+// LockUser блокирует баллы пользователя до конца транзакции tx. FOR UPDATE блокирует только
+// существующие записи: остаток, созданный частичным списанием, или новое начисление другой
+// транзакции не попадают в уже прочитанный снимок, и, например, бонус multiply_percent мог бы
+// считаться от неполного баланса. Поэтому все изменяющие баланс операции сначала берут
+// advisory-блокировку пользователя и выполняются для него строго по очереди
+func (m BonusEntryModel) LockUser(ctx context.Context, tx *sql.Tx, userId uuid.UUID) error {
+	ctx, span := startSpan(ctx, "BonusEntryModel.LockUser", attribute.String("user_id", userId.String()))
+	defer span.End()
+
+	query := `SELECT pg_advisory_xact_lock(hashtext($1::text))`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, query, userId)
+	return queryError(ctx, err)
+}
+
+// EntryFilter ограничивает выборку записей пользователя. Пустой Status - записи в любом статусе
+type EntryFilter struct {
+	Status BonusEntryStatus
+}
+
+// GetEntries возвращает страницу записей пользователя в порядке создания и метаданные страницы
+func (m BonusEntryModel) GetEntries(ctx context.Context, userId uuid.UUID, filter EntryFilter, filters Filters) ([]*BonusEntry, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, user_id, amount, created_at, lifetime_days, status, spent_at, expired_at, transaction_id, source, category
+		FROM bonus_entries
+		WHERE user_id = $1
+			AND ($2 = '' OR status::text = $2)
+		ORDER BY created_at, id
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, string(filter.Status), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*BonusEntry{}
+	for rows.Next() {
+		var entry BonusEntry
+		err := rows.Scan(
+			&totalRecords,
+			&entry.Id,
+			&entry.UserId,
+			&entry.Amount,
+			&entry.CreatedAt,
+			&entry.LifetimeDays,
+			&entry.Status,
+			&entry.SpentAt,
+			&entry.ExpiredAt,
+			&entry.TransactionId,
+			&entry.Source,
+			&entry.Category,
+		)
+		if err != nil {
+			return nil, Metadata{}, queryError(ctx, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, queryError(ctx, err)
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// GetActiveEntriesPage возвращает до limit активных записей всех пользователей с номером Seq больше after
+// в порядке возрастания номера (keyset-пагинация для выгрузки всей программы)
+func (m BonusEntryModel) GetActiveEntriesPage(ctx context.Context, after int64, limit int) ([]*BonusEntry, error) {
+	query := `
+		SELECT seq, id, user_id, amount, created_at, lifetime_days, status, spent_at
+		FROM bonus_entries
+		WHERE status = 'active'
+			AND expires_at > NOW()
+			AND seq > $1
+		ORDER BY seq
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
 	if err != nil {
-		return nil, err
+		return nil, queryError(ctx, err)
 	}
 	defer rows.Close()
 
@@ -90,6 +261,7 @@ func (m BonusEntryModel) GetActiveEntries(userId uuid.UUID) ([]*BonusEntry, erro
 	for rows.Next() {
 		var entry BonusEntry
 		err := rows.Scan(
+			&entry.Seq,
 			&entry.Id,
 			&entry.UserId,
 			&entry.Amount,
@@ -99,22 +271,25 @@ func (m BonusEntryModel) GetActiveEntries(userId uuid.UUID) ([]*BonusEntry, erro
 			&entry.SpentAt,
 		)
 		if err != nil {
-			return nil, err
+			return nil, queryError(ctx, err)
 		}
 		entries = append(entries, &entry)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, queryError(ctx, err)
 	}
 
 	return entries, nil
 }
 
 // GetActiveEntriesForUpdate возвращает активные записи с блокировкой для транзакций (SELECT FOR UPDATE)
-func (m BonusEntryModel) GetActiveEntriesForUpdate(tx *sql.Tx, userId uuid.UUID) ([]*BonusEntry, error) {
+func (m BonusEntryModel) GetActiveEntriesForUpdate(ctx context.Context, tx *sql.Tx, userId uuid.UUID) ([]*BonusEntry, error) {
+	ctx, span := startSpan(ctx, "BonusEntryModel.GetActiveEntriesForUpdate", attribute.String("user_id", userId.String()))
+	defer span.End()
+
 	query := `
-		SELECT id, user_id, amount, created_at, lifetime_days, status, spent_at
+		SELECT id, user_id, amount, created_at, lifetime_days, status, spent_at, transaction_id, source, category
 		FROM bonus_entries
 		WHERE user_id = $1 
 			AND status = 'active' 
@@ -122,12 +297,59 @@ func (m BonusEntryModel) GetActiveEntriesForUpdate(tx *sql.Tx, userId uuid.UUID)
 		ORDER BY created_at ASC
 		FOR UPDATE`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	rows, err := tx.QueryContext(ctx, query, userId)
 	if err != nil {
-		return nil, err
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var entries []*BonusEntry
+	for rows.Next() {
+		var entry BonusEntry
+		err := rows.Scan(
+			&entry.Id,
+			&entry.UserId,
+			&entry.Amount,
+			&entry.CreatedAt,
+			&entry.LifetimeDays,
+			&entry.Status,
+			&entry.SpentAt,
+			&entry.TransactionId,
+			&entry.Source,
+			&entry.Category,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return entries, nil
+}
+
+// GetByTransactionForUpdate возвращает все записи, созданные операцией журнала transactionId,
+// в любом статусе, включая остатки частично списанных записей, и блокирует их
+func (m BonusEntryModel) GetByTransactionForUpdate(ctx context.Context, tx *sql.Tx, transactionId uuid.UUID) ([]*BonusEntry, error) {
+	query := `
+		SELECT id, user_id, amount, created_at, lifetime_days, status, spent_at, transaction_id, source
+		FROM bonus_entries
+		WHERE transaction_id = $1
+		ORDER BY created_at ASC
+		FOR UPDATE`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := tx.QueryContext(ctx, query, transactionId)
+	if err != nil {
+		return nil, queryError(ctx, err)
 	}
 	defer rows.Close()
 
@@ -142,42 +364,125 @@ func (m BonusEntryModel) GetActiveEntriesForUpdate(tx *sql.Tx, userId uuid.UUID)
 			&entry.LifetimeDays,
 			&entry.Status,
 			&entry.SpentAt,
+			&entry.TransactionId,
+			&entry.Source,
 		)
 		if err != nil {
-			return nil, err
+			return nil, queryError(ctx, err)
 		}
 		entries = append(entries, &entry)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, queryError(ctx, err)
 	}
 
 	return entries, nil
 }
 
-// SpendEntries списывает баллы по принципу FIFO в рамках транзакции
-// Возвращает список записей, которые были использованы для списания
-func (m BonusEntryModel) SpendEntries(tx *sql.Tx, userId uuid.UUID, amount int) ([]*BonusEntry, error) {
+// VoidEntries помечает активные записи отмененными, после чего они не входят в баланс
+func (m BonusEntryModel) VoidEntries(ctx context.Context, tx *sql.Tx, ids []string) error {
+	query := `
+		UPDATE bonus_entries
+		SET status = 'void'
+		WHERE id = ANY($1) AND status = 'active'`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, query, pq.StringArray(ids))
+	return queryError(ctx, err)
+}
+
+// SpendEntries списывает баллы по принципу FIFO в рамках транзакции. Непустой category
+// ограничивает списание записями этой категории, пустой - списание из всех категорий.
+// Возвращает список записей, которые были использованы для списания, и сгоревший остаток
+// частично списанной записи (см. spendLocked), который вызывающий код записывает в журнал
+func (m BonusEntryModel) SpendEntries(ctx context.Context, tx *sql.Tx, userId uuid.UUID, amount int, category string) ([]*BonusEntry, int, error) {
+	ctx, span := startSpan(ctx, "BonusEntryModel.SpendEntries",
+		attribute.String("user_id", userId.String()),
+		attribute.Int("amount", amount),
+		attribute.String("category", category),
+	)
+	defer span.End()
+
 	// Получаем активные записи с блокировкой
-	entries, err := m.GetActiveEntriesForUpdate(tx, userId)
+	entries, err := m.GetActiveEntriesForUpdate(ctx, tx, userId)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
+	entries = FilterCategory(entries, category)
+
 	// Рассчитываем доступный баланс
 	availableBalance := 0
 	for _, entry := range entries {
-		availableBalance += entry.Amount
+		availableBalance += int(entry.Amount)
 	}
 
 	if availableBalance < amount {
-		return nil, ErrInsufficientFunds
+		return nil, 0, ErrInsufficientFunds
+	}
+
+	return m.spendLocked(ctx, tx, entries, amount)
+}
+
+// SpendEntriesUpTo списывает по принципу FIFO не больше amount баллов (режим up_to):
+// если баллов не хватает, списывается весь доступный баланс. Категория ограничивает списание
+// так же, как в SpendEntries: пустой category - списание из всех категорий.
+// Возвращает использованные записи, фактически списанную сумму и сгоревший остаток, как SpendEntries
+func (m BonusEntryModel) SpendEntriesUpTo(ctx context.Context, tx *sql.Tx, userId uuid.UUID, amount int, category string) ([]*BonusEntry, int, int, error) {
+	ctx, span := startSpan(ctx, "BonusEntryModel.SpendEntriesUpTo",
+		attribute.String("user_id", userId.String()),
+		attribute.Int("amount", amount),
+		attribute.String("category", category),
+	)
+	defer span.End()
+
+	entries, err := m.GetActiveEntriesForUpdate(ctx, tx, userId)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	entries = FilterCategory(entries, category)
+
+	availableBalance := 0
+	for _, entry := range entries {
+		availableBalance += int(entry.Amount)
+	}
+
+	amount = min(amount, availableBalance)
+	spentEntries, forfeited, err := m.spendLocked(ctx, tx, entries, amount)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return spentEntries, amount, forfeited, nil
+}
+
+// FilterCategory оставляет из entries записи категории category, пустой category оставляет все.
+// Так списание и его предпросмотры выбирают записи одинаково
+func FilterCategory(entries []*BonusEntry, category string) []*BonusEntry {
+	if category == "" {
+		return entries
 	}
 
+	return slices.DeleteFunc(entries, func(entry *BonusEntry) bool {
+		return entry.Category != category
+	})
+}
+
+// spendLocked списывает amount баллов из заблокированных записей entries по принципу FIFO.
+// Вызывающий код должен убедиться, что баллов достаточно. Полностью израсходованные записи
+// закрываются одним запросом, отдельно обрабатывается только последняя, частично списанная запись.
+// Остаток меньше Fragments.MinAmount при Fragments.Forfeit сгорает, его сумма возвращается вместе
+// с использованными записями
+func (m BonusEntryModel) spendLocked(ctx context.Context, tx *sql.Tx, entries []*BonusEntry, amount int) ([]*BonusEntry, int, error) {
 	// Списываем по принципу FIFO
 	remainingAmount := amount
 	var spentEntries []*BonusEntry
+	var spentIds []string
+	var partial *BonusEntry
+	partialSpent := 0
 	now := time.Now()
 
 	for _, entry := range entries {
@@ -185,146 +490,969 @@ func (m BonusEntryModel) SpendEntries(tx *sql.Tx, userId uuid.UUID, amount int)
 			break
 		}
 
-		spentAmount := entry.Amount
-		if remainingAmount < entry.Amount {
-			spentAmount = remainingAmount
-			// Частичное списание - создаем новую запись с остатком
-			remainingEntry := &BonusEntry{
-				Id:           uuid.New(),
-				UserId:       entry.UserId,
-				Amount:       entry.Amount - spentAmount,
-				CreatedAt:    entry.CreatedAt,
-				LifetimeDays: entry.LifetimeDays,
-				Status:       BonusEntryStatusActive,
-			}
-
-			insertQuery := `
-				INSERT INTO bonus_entries (id, user_id, amount, created_at, expires_at, lifetime_days, status)
-				VALUES ($1, $2, $3, $4, $5, $6, $7)`
-
-			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			_, err := tx.ExecContext(ctx, insertQuery,
-				remainingEntry.Id,
-				remainingEntry.UserId,
-				remainingEntry.Amount,
-				remainingEntry.CreatedAt,
-				remainingEntry.ExpiresAt(),
-				remainingEntry.LifetimeDays,
-				remainingEntry.Status,
-			)
-			cancel()
-			if err != nil {
-				return nil, err
-			}
+		if remainingAmount < int(entry.Amount) {
+			partial = entry
+			partialSpent = remainingAmount
+			break
 		}
 
-		// Обновляем статус записи на 'spent'
+		spentIds = append(spentIds, entry.Id.String())
+		spentEntries = append(spentEntries, entry)
+		remainingAmount -= int(entry.Amount)
+	}
+
+	// Закрываем полностью израсходованные записи одним запросом
+	if len(spentIds) > 0 {
 		updateQuery := `
 			UPDATE bonus_entries
-			SET status = 'spent', spent_at = $1, amount = $2
-			WHERE id = $3`
+			SET status = 'spent', spent_at = $1
+			WHERE id = ANY($2::uuid[])`
 
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		_, err := tx.ExecContext(ctx, updateQuery, now, spentAmount, entry.Id)
+		ctx, span := startSpan(ctx, "BonusEntryModel.markSpent", attribute.Int("entries", len(spentIds)))
+		ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+		_, err := tx.ExecContext(ctx, updateQuery, now, pq.StringArray(spentIds))
 		cancel()
+		span.End()
+		if err != nil {
+			return nil, 0, queryError(ctx, err)
+		}
+	}
+
+	forfeited := 0
+	if partial != nil {
+		var err error
+		forfeited, err = m.splitPartial(ctx, tx, partial, partialSpent, now)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
+		spentEntries = append(spentEntries, partial)
+	}
 
+	for _, entry := range spentEntries {
 		entry.Status = BonusEntryStatusSpent
 		entry.SpentAt = &now
-		entry.Amount = spentAmount
-		spentEntries = append(spentEntries, entry)
+	}
+
+	return spentEntries, forfeited, nil
+}
+
+// splitPartial списывает spentAmount баллов из записи entry: запись закрывается на списанную сумму,
+// а остаток сохраняется отдельной записью с той же датой начисления и сроком жизни.
+// Возвращает сумму остатка, если он сразу сгорел, иначе 0
+func (m BonusEntryModel) splitPartial(ctx context.Context, tx *sql.Tx, entry *BonusEntry, spentAmount int, now time.Time) (int, error) {
+	ctx, span := startSpan(ctx, "BonusEntryModel.splitPartial",
+		attribute.String("user_id", entry.UserId.String()),
+		attribute.Int("amount", spentAmount),
+	)
+	defer span.End()
+
+	// Частичное списание - создаем новую запись с остатком
+	remainingEntry := &BonusEntry{
+		Id:            uuid.New(),
+		UserId:        entry.UserId,
+		Amount:        entry.Amount - Points(spentAmount),
+		CreatedAt:     entry.CreatedAt,
+		LifetimeDays:  entry.LifetimeDays,
+		Status:        BonusEntryStatusActive,
+		TransactionId: entry.TransactionId,
+		Source:        entry.Source,
+		Category:      entry.Category,
+	}
+
+	// Слишком маленький остаток по политике программы сгорает сразу
+	forfeit := m.Fragments.Forfeit && int(remainingEntry.Amount) < m.Fragments.MinAmount
+	if forfeit {
+		remainingEntry.Status = BonusEntryStatusExpired
+		remainingEntry.ExpiredAt = &now
+	}
+
+	insertQuery := `
+		INSERT INTO bonus_entries (id, user_id, amount, created_at, expires_at, lifetime_days, status, expired_at, transaction_id, source, category)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	qctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	_, err := tx.ExecContext(qctx, insertQuery,
+		remainingEntry.Id,
+		remainingEntry.UserId,
+		remainingEntry.Amount,
+		remainingEntry.CreatedAt,
+		remainingEntry.ExpiresAt(),
+		remainingEntry.LifetimeDays,
+		remainingEntry.Status,
+		remainingEntry.ExpiredAt,
+		remainingEntry.TransactionId,
+		remainingEntry.Source,
+		remainingEntry.Category,
+	)
+	cancel()
+	if err != nil {
+		return 0, queryError(qctx, err)
+	}
+
+	updateQuery := `
+		UPDATE bonus_entries
+		SET status = 'spent', spent_at = $1, amount = $2
+		WHERE id = $3`
+
+	qctx, cancel = context.WithTimeout(ctx, m.QueryTimeout)
+	_, err = tx.ExecContext(qctx, updateQuery, now, spentAmount, entry.Id)
+	cancel()
+	if err != nil {
+		return 0, queryError(qctx, err)
+	}
+
+	entry.Amount = Points(spentAmount)
+	if forfeit {
+		return int(remainingEntry.Amount), nil
+	}
+	return 0, nil
+}
+
+// SpendPlanItem описывает часть записи баллов, которая будет использована при списании
+type SpendPlanItem struct {
+	EntryId   uuid.UUID `json:"entry_id"`
+	Amount    Points    `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PlanSpend строит план списания по принципу FIFO, не изменяя записи.
+// Если доступных баллов меньше запрошенного, план покрывает только доступную сумму (режим up_to).
+// Возвращает план и фактическую сумму списания
+func PlanSpend(entries []*BonusEntry, amount int) ([]SpendPlanItem, int) {
+	plan := []SpendPlanItem{}
+	remainingAmount := amount
+
+	for _, entry := range entries {
+		if remainingAmount <= 0 {
+			break
+		}
+
+		spentAmount := min(int(entry.Amount), remainingAmount)
+		plan = append(plan, SpendPlanItem{
+			EntryId:   entry.Id,
+			Amount:    Points(spentAmount),
+			CreatedAt: entry.CreatedAt,
+			ExpiresAt: entry.ExpiresAt(),
+		})
 
 		remainingAmount -= spentAmount
 	}
 
-	return spentEntries, nil
+	return plan, amount - remainingAmount
+}
+
+// OldestCovering возвращает минимальный префикс записей в порядке FIFO, сумма которого
+// достигает target или превышает его, и эту сумму
+func OldestCovering(entries []*BonusEntry, target int) ([]*BonusEntry, int) {
+	covered := 0
+	for i, entry := range entries {
+		if covered >= target {
+			return entries[:i], covered
+		}
+		covered += int(entry.Amount)
+	}
+
+	return entries, covered
+}
+
+// totalBalanceQuery - баланс активных баллов пользователя
+const totalBalanceQuery = `
+	SELECT COALESCE(SUM(amount), 0)
+	FROM bonus_entries
+	WHERE user_id = $1 
+		AND status = 'active' 
+		AND expires_at > NOW()`
+
+// GetTotalBalance вычисляет баланс активных баллов пользователя: общий при пустом category,
+// иначе только баллов этой категории
+func (m BonusEntryModel) GetTotalBalance(ctx context.Context, userId uuid.UUID, category string) (int, error) {
+	query := totalBalanceQuery + `
+		AND ($2 = '' OR category = $2)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var balance int
+	err := m.DB.QueryRowContext(ctx, query, userId, category).Scan(&balance)
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+
+	return balance, nil
+}
+
+// GetTotalBalanceTx вычисляет баланс внутри транзакции tx, учитывая ее собственные изменения.
+// NOW() в транзакции - время ее начала, поэтому только что сделанные начисления всегда учитываются,
+// а сгорание, выполненное параллельно после изменения, на результат не влияет
+func (m BonusEntryModel) GetTotalBalanceTx(ctx context.Context, tx *sql.Tx, userId uuid.UUID) (int, error) {
+	ctx, span := startSpan(ctx, "BonusEntryModel.GetTotalBalanceTx", attribute.String("user_id", userId.String()))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var balance int
+	err := tx.QueryRowContext(ctx, totalBalanceQuery, userId).Scan(&balance)
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+
+	return balance, nil
+}
+
+// ActiveBalance - активный баланс пользователя и ближайший момент сгорания его записей
+// (nil, если активных записей нет). До NextExpiry баланс может измениться только операциями
+type ActiveBalance struct {
+	UserId     uuid.UUID
+	Balance    int
+	NextExpiry *time.Time
 }
 
-// GetTotalBalance вычисляет общий баланс активных баллов пользователя
-func (m BonusEntryModel) GetTotalBalance(userId uuid.UUID) (int, error) {
+// GetActiveBalance возвращает активный баланс пользователя вместе с ближайшим сгоранием
+func (m BonusEntryModel) GetActiveBalance(ctx context.Context, userId uuid.UUID) (*ActiveBalance, error) {
 	query := `
-		SELECT COALESCE(SUM(amount), 0)
+		SELECT COALESCE(SUM(amount), 0), MIN(expires_at)
 		FROM bonus_entries
-		WHERE user_id = $1 
-			AND status = 'active' 
+		WHERE user_id = $1
+			AND status = 'active'
 			AND expires_at > NOW()`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	var balance int
-	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&balance)
+	balance := ActiveBalance{UserId: userId}
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&balance.Balance, &balance.NextExpiry)
 	if err != nil {
-		return 0, err
+		return nil, queryError(ctx, err)
 	}
 
-	return balance, nil
+	return &balance, nil
 }
 
-// GetExpiringEntries возвращает информацию о баллах, которые сгорят в ближайшие дни
-// days - количество дней для анализа
-func (m BonusEntryModel) GetExpiringEntries(userId uuid.UUID, days int) (map[string]int, error) {
+// GetAllActiveBalances возвращает активные балансы всех пользователей, у которых они есть
+func (m BonusEntryModel) GetAllActiveBalances(ctx context.Context) ([]*ActiveBalance, error) {
 	query := `
-		SELECT 
-			DATE(expires_at) as expire_date,
-			SUM(amount) as total_amount
+		SELECT user_id, SUM(amount), MIN(expires_at)
 		FROM bonus_entries
-		WHERE user_id = $1 
-			AND status = 'active' 
+		WHERE status = 'active'
 			AND expires_at > NOW()
-			AND expires_at <= NOW() + INTERVAL '1 day' * $2
-		GROUP BY DATE(expires_at)
-		ORDER BY expire_date ASC`
+		GROUP BY user_id`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userId, days)
+	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, queryError(ctx, err)
 	}
 	defer rows.Close()
 
-	result := make(map[string]int)
+	balances := []*ActiveBalance{}
 	for rows.Next() {
-		var expireDate time.Time
-		var totalAmount int
-		err := rows.Scan(&expireDate, &totalAmount)
+		var balance ActiveBalance
+		err := rows.Scan(&balance.UserId, &balance.Balance, &balance.NextExpiry)
 		if err != nil {
-			return nil, err
+			return nil, queryError(ctx, err)
 		}
-		result[expireDate.Format("2006-01-02")] = totalAmount
+		balances = append(balances, &balance)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, queryError(ctx, err)
 	}
 
-	return result, nil
+	return balances, nil
 }
 
-// UpdateExpiredEntries обновляет статус просроченных записей на 'expired'
-func (m BonusEntryModel) UpdateExpiredEntries() (int64, error) {
+// TypeBalance - часть активного баланса, начисленная операциями одного типа
+type TypeBalance struct {
+	Type   string `json:"type"`
+	Amount Points `json:"amount"`
+}
+
+// GetBalanceByType разбивает активный баланс пользователя по типам операций, создавших начисления.
+// Начисления без связи с журналом попадают в строку с пустым типом
+func (m BonusEntryModel) GetBalanceByType(ctx context.Context, userId uuid.UUID) ([]TypeBalance, error) {
 	query := `
-		UPDATE bonus_entries
-		SET status = 'expired'
-		WHERE status = 'active' 
-			AND expires_at <= NOW()`
+		SELECT COALESCE(t.type, ''), SUM(e.amount)
+		FROM bonus_entries e
+		LEFT JOIN transactions t ON t.id = e.transaction_id
+		WHERE e.user_id = $1
+			AND e.status = 'active'
+			AND e.expires_at > NOW()
+		GROUP BY 1
+		ORDER BY 1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, userId)
 	if err != nil {
-		return 0, err
+		return nil, queryError(ctx, err)
 	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return 0, err
+	balances := []TypeBalance{}
+	for rows.Next() {
+		var balance TypeBalance
+		if err := rows.Scan(&balance.Type, &balance.Amount); err != nil {
+			return nil, queryError(ctx, err)
+		}
+		balances = append(balances, balance)
 	}
 
-	return rowsAffected, nil
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return balances, nil
+}
+
+// ExpiryGranularity задает, как группировать сгорающие баллы
+type ExpiryGranularity string
+
+const (
+	// ExpiryGranularityDay суммирует записи, сгорающие в один календарный день
+	ExpiryGranularityDay ExpiryGranularity = "day"
+	// ExpiryGranularityTimestamp группирует записи по точному моменту сгорания
+	ExpiryGranularityTimestamp ExpiryGranularity = "timestamp"
+)
+
+// GetActiveStats возвращает баланс и число активных записей пользователя
+func (m BonusEntryModel) GetActiveStats(ctx context.Context, userId uuid.UUID) (int, int, error) {
+	query := `
+		SELECT COALESCE(SUM(amount), 0), COUNT(*)
+		FROM bonus_entries
+		WHERE user_id = $1 
+			AND status = 'active' 
+			AND expires_at > NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var balance, entries int
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&balance, &entries)
+	if err != nil {
+		return 0, 0, queryError(ctx, err)
+	}
+
+	return balance, entries, nil
+}
+
+// GetExpiringEntries возвращает информацию о баллах, которые сгорят в ближайшие дни, по возрастанию даты.
+// Непустой category учитывает только баллы этой категории, как GetTotalBalance.
+// days - количество дней для анализа, granularity - ключ группировки (дата или точное время сгорания)
+func (m BonusEntryModel) GetExpiringEntries(ctx context.Context, userId uuid.UUID, category string, days int, granularity ExpiryGranularity) ([]ExpiringTotal, error) {
+	groupBy, layout := "DATE(expires_at)", "2006-01-02"
+	if granularity == ExpiryGranularityTimestamp {
+		groupBy, layout = "expires_at", time.RFC3339
+	}
+
+	query := fmt.Sprintf(`
+		SELECT 
+			%s as expire_date,
+			SUM(amount) as total_amount
+		FROM bonus_entries
+		WHERE user_id = $1 
+			AND status = 'active' 
+			AND expires_at > NOW()
+			AND expires_at <= NOW() + INTERVAL '1 day' * $2
+			AND ($3 = '' OR category = $3)
+		GROUP BY %s
+		ORDER BY expire_date ASC`, groupBy, groupBy)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, days, category)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	result := []ExpiringTotal{}
+	for rows.Next() {
+		var expireDate time.Time
+		var totalAmount int
+		err := rows.Scan(&expireDate, &totalAmount)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		result = append(result, ExpiringTotal{Date: expireDate.Format(layout), Amount: Points(totalAmount)})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return result, nil
+}
+
+// RiskBreakdown - активный баланс пользователя, разделенный по сроку сгорания
+type RiskBreakdown struct {
+	// AtRisk - баллы, которые сгорят в ближайшие дни, Safe - сгорят позже
+	AtRisk int
+	Safe   int
+	// EarliestAtRisk - ближайшее сгорание среди AtRisk, nil если таких баллов нет
+	EarliestAtRisk *time.Time
+}
+
+// GetRiskBreakdown делит активный баланс пользователя на баллы, сгорающие в ближайшие days дней, и остальные
+func (m BonusEntryModel) GetRiskBreakdown(ctx context.Context, userId uuid.UUID, days int) (*RiskBreakdown, error) {
+	query := `
+		SELECT
+			COALESCE(SUM(amount) FILTER (WHERE expires_at <= NOW() + INTERVAL '1 day' * $2), 0),
+			COALESCE(SUM(amount) FILTER (WHERE expires_at > NOW() + INTERVAL '1 day' * $2), 0),
+			MIN(expires_at) FILTER (WHERE expires_at <= NOW() + INTERVAL '1 day' * $2)
+		FROM bonus_entries
+		WHERE user_id = $1
+			AND status = 'active'
+			AND expires_at > NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var breakdown RiskBreakdown
+	var earliest sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query, userId, days).Scan(&breakdown.AtRisk, &breakdown.Safe, &earliest)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	if earliest.Valid {
+		breakdown.EarliestAtRisk = &earliest.Time
+	}
+
+	return &breakdown, nil
+}
+
+// ExpiringTotal - сумма баллов, сгорающих в определенный день
+type ExpiringTotal struct {
+	Date   string `json:"date"`
+	Amount Points `json:"amount"`
+}
+
+// GetProgramExpiring возвращает суммы баллов всех пользователей, сгорающих в каждый из ближайших days дней
+func (m BonusEntryModel) GetProgramExpiring(ctx context.Context, days int) ([]ExpiringTotal, error) {
+	query := `
+		SELECT 
+			DATE(expires_at) as expire_date,
+			SUM(amount) as total_amount
+		FROM bonus_entries
+		WHERE status = 'active' 
+			AND expires_at > NOW()
+			AND expires_at <= NOW() + INTERVAL '1 day' * $1
+		GROUP BY DATE(expires_at)
+		ORDER BY expire_date ASC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, days)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	totals := []ExpiringTotal{}
+	for rows.Next() {
+		var expireDate time.Time
+		var total ExpiringTotal
+		err := rows.Scan(&expireDate, &total.Amount)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		total.Date = expireDate.Format("2006-01-02")
+		totals = append(totals, total)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return totals, nil
+}
+
+// LifetimeImpact - сколько баллов программы сгорит в ближайшие дни при текущих сроках жизни
+// и при гипотетическом сроке жизни
+type LifetimeImpact struct {
+	Current   int `json:"current"`
+	Projected int `json:"projected"`
+	Entries   int `json:"entries"`
+}
+
+// GetLifetimeImpact пересчитывает даты сгорания активных записей так, как если бы их срок жизни
+// был lifetimeDays, и сравнивает суммы, сгорающие в ближайшие days дней. Если fromLifetimeDays
+// больше нуля, пересчитываются только записи с таким сроком жизни, остальные сохраняют свой.
+// Записи, которые при новом сроке уже должны были сгореть, попадают в прогноз
+func (m BonusEntryModel) GetLifetimeImpact(ctx context.Context, days int, lifetimeDays int, fromLifetimeDays int) (LifetimeImpact, error) {
+	query := `
+		SELECT
+			COALESCE(SUM(amount) FILTER (WHERE expires_at <= NOW() + INTERVAL '1 day' * $1), 0) AS current,
+			COALESCE(SUM(amount) FILTER (WHERE projected_expires_at <= NOW() + INTERVAL '1 day' * $1), 0) AS projected,
+			COUNT(*) FILTER (WHERE recomputed) AS entries
+		FROM (
+			SELECT amount, expires_at,
+				($3 = 0 OR lifetime_days = $3) AS recomputed,
+				CASE WHEN $3 = 0 OR lifetime_days = $3
+					THEN created_at + INTERVAL '1 day' * $2
+					ELSE expires_at
+				END AS projected_expires_at
+			FROM bonus_entries
+			WHERE status = 'active'
+				AND expires_at > NOW()
+		) e`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var impact LifetimeImpact
+	err := m.DB.QueryRowContext(ctx, query, days, lifetimeDays, fromLifetimeDays).Scan(
+		&impact.Current,
+		&impact.Projected,
+		&impact.Entries,
+	)
+	if err != nil {
+		return LifetimeImpact{}, queryError(ctx, err)
+	}
+
+	return impact, nil
+}
+
+// GetExpirySchedule возвращает все будущие сгорания баллов пользователя по дням в порядке возрастания даты
+func (m BonusEntryModel) GetExpirySchedule(ctx context.Context, userId uuid.UUID) ([]ExpiringTotal, error) {
+	query := `
+		SELECT 
+			DATE(expires_at) as expire_date,
+			SUM(amount) as total_amount
+		FROM bonus_entries
+		WHERE user_id = $1 
+			AND status = 'active' 
+			AND expires_at > NOW()
+		GROUP BY DATE(expires_at)
+		ORDER BY expire_date ASC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	schedule := []ExpiringTotal{}
+	for rows.Next() {
+		var expireDate time.Time
+		var total ExpiringTotal
+		err := rows.Scan(&expireDate, &total.Amount)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		total.Date = expireDate.Format("2006-01-02")
+		schedule = append(schedule, total)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return schedule, nil
+}
+
+// BalanceDistribution - распределение активных балансов пользователей программы
+type BalanceDistribution struct {
+	// Users - число пользователей с положительным активным балансом
+	Users int
+	// P50, P90, P99 и Mean - перцентили и среднее балансов, nil если таких пользователей нет
+	P50  *float64
+	P90  *float64
+	P99  *float64
+	Mean *float64
+}
+
+// GetBalanceDistribution считает медиану, 90-й и 99-й перцентили и среднее активных балансов.
+// Учитываются только пользователи, у которых есть активные несгоревшие баллы
+func (m BonusEntryModel) GetBalanceDistribution(ctx context.Context) (*BalanceDistribution, error) {
+	query := `
+		SELECT
+			COUNT(*),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY balance),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY balance),
+			percentile_cont(0.99) WITHIN GROUP (ORDER BY balance),
+			AVG(balance)::float8
+		FROM (
+			SELECT user_id, SUM(amount) AS balance
+			FROM bonus_entries
+			WHERE status = 'active'
+				AND expires_at > NOW()
+			GROUP BY user_id
+		) balances`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var distribution BalanceDistribution
+	var p50, p90, p99, mean sql.NullFloat64
+	err := m.DB.QueryRowContext(ctx, query).Scan(&distribution.Users, &p50, &p90, &p99, &mean)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	// На пустой программе агрегаты возвращают NULL
+	if distribution.Users > 0 {
+		distribution.P50 = &p50.Float64
+		distribution.P90 = &p90.Float64
+		distribution.P99 = &p99.Float64
+		distribution.Mean = &mean.Float64
+	}
+
+	return &distribution, nil
+}
+
+// UserEntryCount - число активных записей пользователя
+type UserEntryCount struct {
+	UserId  uuid.UUID `json:"user_id"`
+	Entries int       `json:"entries"`
+	Balance Points    `json:"balance"`
+}
+
+// GetFragmentedUsers возвращает пользователей, у которых больше minEntries активных записей,
+// в порядке убывания числа записей
+func (m BonusEntryModel) GetFragmentedUsers(ctx context.Context, minEntries int, limit int) ([]*UserEntryCount, error) {
+	query := `
+		SELECT user_id, COUNT(*) AS entries, SUM(amount) AS balance
+		FROM bonus_entries
+		WHERE status = 'active' 
+			AND expires_at > NOW()
+		GROUP BY user_id
+		HAVING COUNT(*) > $1
+		ORDER BY entries DESC, user_id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, minEntries, limit)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	users := []*UserEntryCount{}
+	for rows.Next() {
+		var user UserEntryCount
+		err := rows.Scan(&user.UserId, &user.Entries, &user.Balance)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return users, nil
+}
+
+// UserOldestGrant - самое старое активное начисление пользователя
+type UserOldestGrant struct {
+	UserId      uuid.UUID `json:"user_id"`
+	OldestGrant time.Time `json:"oldest_grant"`
+	AgeDays     int       `json:"age_days"`
+	Balance     Points    `json:"balance"`
+}
+
+// GetUsersWithOldGrants возвращает пользователей, у которых самое старое активное начисление
+// старше minAgeDays дней, начиная с самых старых
+func (m BonusEntryModel) GetUsersWithOldGrants(ctx context.Context, minAgeDays int, limit int) ([]*UserOldestGrant, error) {
+	query := `
+		SELECT user_id, MIN(created_at) AS oldest_grant,
+			EXTRACT(DAY FROM NOW() - MIN(created_at))::int AS age_days,
+			SUM(amount) AS balance
+		FROM bonus_entries
+		WHERE status = 'active'
+			AND expires_at > NOW()
+		GROUP BY user_id
+		HAVING MIN(created_at) < NOW() - $1 * INTERVAL '1 day'
+		ORDER BY oldest_grant, user_id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, minAgeDays, limit)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	users := []*UserOldestGrant{}
+	for rows.Next() {
+		var user UserOldestGrant
+		err := rows.Scan(&user.UserId, &user.OldestGrant, &user.AgeDays, &user.Balance)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return users, nil
+}
+
+// ExpiredEntry - сгоревшая запись с датой начисления и моментом сгорания
+type ExpiredEntry struct {
+	Id        uuid.UUID `json:"id"`
+	Amount    Points    `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+// GetRecentlyExpired возвращает записи пользователя, переведенные в статус 'expired' за последние days дней
+func (m BonusEntryModel) GetRecentlyExpired(ctx context.Context, userId uuid.UUID, days int) ([]*ExpiredEntry, error) {
+	query := `
+		SELECT id, amount, created_at, expires_at, expired_at
+		FROM bonus_entries
+		WHERE user_id = $1 
+			AND status = 'expired' 
+			AND expired_at >= NOW() - INTERVAL '1 day' * $2
+		ORDER BY expired_at DESC, created_at DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, days)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	entries := []*ExpiredEntry{}
+	for rows.Next() {
+		var entry ExpiredEntry
+		err := rows.Scan(
+			&entry.Id,
+			&entry.Amount,
+			&entry.CreatedAt,
+			&entry.ExpiresAt,
+			&entry.ExpiredAt,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return entries, nil
+}
+
+// GetExpiredBetween возвращает записи пользователя, сгоревшие с from по to включительно (даты в UTC),
+// в хронологическом порядке сгорания
+func (m BonusEntryModel) GetExpiredBetween(ctx context.Context, userId uuid.UUID, from time.Time, to time.Time) ([]*ExpiredEntry, error) {
+	query := `
+		SELECT id, amount, created_at, expires_at, expired_at
+		FROM bonus_entries
+		WHERE user_id = $1
+			AND status = 'expired'
+			AND expired_at >= $2
+			AND expired_at < $3 + INTERVAL '1 day'
+		ORDER BY expired_at, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, from, to)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	entries := []*ExpiredEntry{}
+	for rows.Next() {
+		var entry ExpiredEntry
+		err := rows.Scan(
+			&entry.Id,
+			&entry.Amount,
+			&entry.CreatedAt,
+			&entry.ExpiresAt,
+			&entry.ExpiredAt,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return entries, nil
+}
+
+// UpdateExpiredEntries обновляет статус просроченных записей на 'expired'
+func (m BonusEntryModel) UpdateExpiredEntries(ctx context.Context) (int64, error) {
+	query := `
+		UPDATE bonus_entries
+		SET status = 'expired', expired_at = NOW()
+		WHERE status = 'active' 
+			AND expires_at <= NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+
+	return rowsAffected, nil
+}
+
+// ExtendedEntry - запись, срок жизни которой был продлен
+type ExtendedEntry struct {
+	Id           uuid.UUID `json:"id"`
+	UserId       uuid.UUID `json:"user_id"`
+	Amount       Points    `json:"amount"`
+	LifetimeDays int       `json:"lifetime_days"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// ExtendFilter ограничивает набор записей для продления.
+// UserIds - только записи этих пользователей (пустой список - все пользователи),
+// ExpiringWithinDays - только записи, сгорающие в ближайшие N дней (0 - без ограничения),
+// Source - только записи из этого источника (пустая строка - все источники)
+type ExtendFilter struct {
+	UserIds            []uuid.UUID
+	ExpiringWithinDays int
+	Source             string
+}
+
+// ExtendActiveEntries продлевает на days дней срок жизни следующей пачки активных записей
+// с id больше after, но не дальше maxLifetimeDays от даты начисления. Записи, уже достигшие
+// предела, пропускаются. Записи обходятся по id, поэтому пачки можно обрабатывать
+// в отдельных транзакциях, передавая id последней обработанной записи
+func (m BonusEntryModel) ExtendActiveEntries(ctx context.Context, tx *sql.Tx, after uuid.UUID, filter ExtendFilter, days int, maxLifetimeDays int, limit int) ([]*ExtendedEntry, error) {
+	query := `
+		UPDATE bonus_entries
+		SET lifetime_days = LEAST(lifetime_days + $1, $2),
+			expires_at = created_at + LEAST(lifetime_days + $1, $2) * INTERVAL '1 day'
+		WHERE id IN (
+			SELECT id
+			FROM bonus_entries
+			WHERE status = 'active'
+				AND expires_at > NOW()
+				AND lifetime_days < $2
+				AND id > $3
+				AND ($4::uuid[] IS NULL OR user_id = ANY($4::uuid[]))
+				AND ($5 = 0 OR expires_at <= NOW() + $5 * INTERVAL '1 day')
+				AND ($7 = '' OR source = $7)
+			ORDER BY id
+			LIMIT $6
+			FOR UPDATE)
+		RETURNING id, user_id, amount, lifetime_days, expires_at`
+
+	var userIds pq.StringArray
+	for _, id := range filter.UserIds {
+		userIds = append(userIds, id.String())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := tx.QueryContext(ctx, query, days, maxLifetimeDays, after, userIds, filter.ExpiringWithinDays, limit, filter.Source)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var entries []*ExtendedEntry
+	for rows.Next() {
+		var entry ExtendedEntry
+		err := rows.Scan(
+			&entry.Id,
+			&entry.UserId,
+			&entry.Amount,
+			&entry.LifetimeDays,
+			&entry.ExpiresAt,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	// UPDATE ... RETURNING не сохраняет порядок подзапроса
+	slices.SortFunc(entries, func(a, b *ExtendedEntry) int {
+		return strings.Compare(a.Id.String(), b.Id.String())
+	})
+
+	return entries, nil
+}
+
+// Extend продлевает срок жизни одной записи id на extraDays дней: новый срок сгорания считается
+// от даты начисления. Продлить можно только активную несгоревшую запись (иначе ErrEntryNotActive)
+// и не дальше maxLifetimeDays от даты начисления (иначе ErrLifetimeTooLong)
+func (m BonusEntryModel) Extend(ctx context.Context, tx *sql.Tx, id uuid.UUID, extraDays int, maxLifetimeDays int) (*ExtendedEntry, error) {
+	selectQuery := `
+		SELECT user_id, amount, lifetime_days, status, expires_at > NOW()
+		FROM bonus_entries
+		WHERE id = $1
+		FOR UPDATE`
+
+	updateQuery := `
+		UPDATE bonus_entries
+		SET lifetime_days = $2,
+			expires_at = created_at + $2 * INTERVAL '1 day'
+		WHERE id = $1
+		RETURNING expires_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	entry := ExtendedEntry{Id: id}
+	var status BonusEntryStatus
+	var unexpired bool
+	err := tx.QueryRowContext(ctx, selectQuery, id).Scan(&entry.UserId, &entry.Amount, &entry.LifetimeDays, &status, &unexpired)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrRecordNotFound
+	case err != nil:
+		return nil, queryError(ctx, err)
+	}
+
+	if status != BonusEntryStatusActive || !unexpired {
+		return nil, ErrEntryNotActive
+	}
+	if entry.LifetimeDays+extraDays > maxLifetimeDays {
+		return nil, ErrLifetimeTooLong
+	}
+
+	entry.LifetimeDays += extraDays
+	err = tx.QueryRowContext(ctx, updateQuery, id, entry.LifetimeDays).Scan(&entry.ExpiresAt)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return &entry, nil
 }
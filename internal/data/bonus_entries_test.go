@@ -0,0 +1,334 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPlanSpend(t *testing.T) {
+	now := time.Now()
+	entries := []*BonusEntry{
+		{Id: uuid.New(), Amount: 10, CreatedAt: now.AddDate(0, 0, -2), LifetimeDays: 30},
+		{Id: uuid.New(), Amount: 20, CreatedAt: now.AddDate(0, 0, -1), LifetimeDays: 30},
+	}
+
+	tests := []struct {
+		name    string
+		amount  int
+		planned int
+		amounts []Points
+	}{
+		{name: "more than available", amount: 100, planned: 30, amounts: []Points{10, 20}},
+		{name: "within the first entry", amount: 4, planned: 4, amounts: []Points{4}},
+		{name: "partial second entry", amount: 15, planned: 15, amounts: []Points{10, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, planned := PlanSpend(entries, tt.amount)
+
+			if planned != tt.planned {
+				t.Errorf("got planned %d; want %d", planned, tt.planned)
+			}
+			if len(plan) != len(tt.amounts) {
+				t.Fatalf("got %d plan items; want %d", len(plan), len(tt.amounts))
+			}
+			for i, item := range plan {
+				if item.EntryId != entries[i].Id || item.Amount != tt.amounts[i] {
+					t.Errorf("plan[%d]: got entry %s amount %d; want entry %s amount %d", i, item.EntryId, item.Amount, entries[i].Id, tt.amounts[i])
+				}
+				if !item.ExpiresAt.Equal(entries[i].ExpiresAt()) {
+					t.Errorf("plan[%d]: got expires_at %v; want %v", i, item.ExpiresAt, entries[i].ExpiresAt())
+				}
+			}
+		})
+	}
+}
+
+func TestOldestCovering(t *testing.T) {
+	entries := []*BonusEntry{
+		{Id: uuid.New(), Amount: 10},
+		{Id: uuid.New(), Amount: 20},
+		{Id: uuid.New(), Amount: 30},
+		{Id: uuid.New(), Amount: 40},
+	}
+
+	tests := []struct {
+		name    string
+		target  int
+		count   int
+		covered int
+	}{
+		{name: "zero target", target: 0, count: 0, covered: 0},
+		{name: "first entry exactly", target: 10, count: 1, covered: 10},
+		{name: "just over the first entry", target: 11, count: 2, covered: 30},
+		{name: "whole balance", target: 100, count: 4, covered: 100},
+		{name: "more than the balance", target: 150, count: 4, covered: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grants, covered := OldestCovering(entries, tt.target)
+
+			if covered != tt.covered {
+				t.Errorf("got covered %d; want %d", covered, tt.covered)
+			}
+			if len(grants) != tt.count {
+				t.Fatalf("got %d grants; want %d", len(grants), tt.count)
+			}
+			for i, grant := range grants {
+				if grant != entries[i] {
+					t.Errorf("grants[%d]: got entry %s; want the FIFO prefix entry %s", i, grant.Id, entries[i].Id)
+				}
+			}
+		})
+	}
+}
+
+func TestGetActiveEntriesPage(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, 3*time.Second)
+	ctx := context.Background()
+
+	// 20 начислений по одному баллу, по одному в минуту, от старых к новым
+	userId := uuid.New()
+	_, err := db.Exec(`
+		INSERT INTO bonus_entries (user_id, amount, created_at, expires_at, lifetime_days)
+		SELECT $1, 1, NOW() - (21 - i) * INTERVAL '1 minute', NOW() - (21 - i) * INTERVAL '1 minute' + INTERVAL '30 days', 30
+		FROM generate_series(1, 20) AS i`, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := models.BonusEntries.GetActiveEntries(ctx, userId, "", AllEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 20 {
+		t.Fatalf("got %d entries without a page; want 20", len(all))
+	}
+
+	tests := []struct {
+		name      string
+		filters   Filters
+		wantFirst int
+		wantLen   int
+	}{
+		{name: "first page", filters: Filters{Page: 1, PageSize: 5}, wantFirst: 0, wantLen: 5},
+		{name: "second page", filters: Filters{Page: 2, PageSize: 5}, wantFirst: 5, wantLen: 5},
+		{name: "last partial page", filters: Filters{Page: 3, PageSize: 8}, wantFirst: 16, wantLen: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := models.BonusEntries.GetActiveEntries(ctx, userId, "", tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != tt.wantLen {
+				t.Fatalf("got %d entries; want %d", len(page), tt.wantLen)
+			}
+			for i, entry := range page {
+				if want := all[tt.wantFirst+i]; entry.Id != want.Id {
+					t.Errorf("page[%d]: got entry %s; want %s in FIFO order", i, entry.Id, want.Id)
+				}
+			}
+		})
+	}
+
+	// Путь списания не ограничен страницей и блокирует все записи
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	locked, err := models.BonusEntries.GetActiveEntriesForUpdate(ctx, tx, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 20 {
+		t.Errorf("got %d entries on the spend path; want 20", len(locked))
+	}
+}
+
+func TestSpendEntries(t *testing.T) {
+	db := newCountingTestDB(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		fragments FragmentPolicy
+		amount    int
+		// spent - списанные суммы записей в порядке FIFO
+		spent []Points
+		// remainder - остаток частично списанной записи, 0 - остатка нет
+		remainder       Points
+		remainderStatus BonusEntryStatus
+		forfeited       int
+		statements      int64
+	}{
+		{name: "full close", amount: 30, spent: []Points{10, 20}, statements: 2},
+		{name: "boundary split", amount: 15, spent: []Points{10, 5}, remainder: 15, remainderStatus: BonusEntryStatusActive, statements: 4},
+		{name: "split of the oldest entry", amount: 4, spent: []Points{4}, remainder: 6, remainderStatus: BonusEntryStatusActive, statements: 3},
+		{name: "kept fragment", fragments: FragmentPolicy{MinAmount: 10}, amount: 25, spent: []Points{10, 15}, remainder: 5, remainderStatus: BonusEntryStatusActive, statements: 4},
+		{name: "forfeited fragment", fragments: FragmentPolicy{MinAmount: 10, Forfeit: true}, amount: 25, spent: []Points{10, 15}, remainder: 5, remainderStatus: BonusEntryStatusExpired, forfeited: 5, statements: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			models := NewModels(db, 3*time.Second)
+			models.BonusEntries.Fragments = tt.fragments
+
+			// Более новая запись вставляется первой: порядок списания задает created_at, а не порядок вставки
+			userId := uuid.New()
+			now := time.Now()
+			older := &BonusEntry{Id: uuid.New(), UserId: userId, Amount: 10, CreatedAt: now.AddDate(0, 0, -2), LifetimeDays: 30, Status: BonusEntryStatusActive}
+			newer := &BonusEntry{Id: uuid.New(), UserId: userId, Amount: 20, CreatedAt: now.AddDate(0, 0, -1), LifetimeDays: 30, Status: BonusEntryStatusActive}
+			for _, entry := range []*BonusEntry{newer, older} {
+				if err := models.BonusEntries.Insert(ctx, entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entries := []*BonusEntry{older, newer}
+
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			before := statements.Load()
+			spent, forfeited, err := models.BonusEntries.SpendEntries(ctx, tx, userId, tt.amount, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := statements.Load() - before; got != tt.statements {
+				t.Errorf("got %d statements; want %d", got, tt.statements)
+			}
+			if err = tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if forfeited != tt.forfeited {
+				t.Errorf("got forfeited %d; want %d", forfeited, tt.forfeited)
+			}
+			if len(spent) != len(tt.spent) {
+				t.Fatalf("got %d spent entries; want %d", len(spent), len(tt.spent))
+			}
+			for i, entry := range spent {
+				if entry.Id != entries[i].Id || entry.Amount != tt.spent[i] {
+					t.Errorf("spent[%d]: got entry %s amount %d; want entry %s amount %d", i, entry.Id, entry.Amount, entries[i].Id, tt.spent[i])
+				}
+			}
+
+			// Записи в БД: списанные закрыты на списанную сумму, остальные не тронуты
+			for i, entry := range entries {
+				wantAmount, wantStatus := entry.Amount, BonusEntryStatusActive
+				if i < len(tt.spent) {
+					wantAmount, wantStatus = tt.spent[i], BonusEntryStatusSpent
+				}
+
+				var amount Points
+				var status BonusEntryStatus
+				err := db.QueryRow(`SELECT amount, status FROM bonus_entries WHERE id = $1`, entry.Id).Scan(&amount, &status)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if amount != wantAmount || status != wantStatus {
+					t.Errorf("entry %d: got amount %d status %s; want amount %d status %s", i, amount, status, wantAmount, wantStatus)
+				}
+			}
+
+			// Остаток - новая запись с датой начисления частично списанной записи
+			rows, err := db.Query(`
+				SELECT amount, status, created_at, lifetime_days
+				FROM bonus_entries
+				WHERE user_id = $1 AND id <> $2 AND id <> $3`, userId, older.Id, newer.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			var remainders []*BonusEntry
+			for rows.Next() {
+				var entry BonusEntry
+				if err := rows.Scan(&entry.Amount, &entry.Status, &entry.CreatedAt, &entry.LifetimeDays); err != nil {
+					t.Fatal(err)
+				}
+				remainders = append(remainders, &entry)
+			}
+			if err = rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.remainder == 0 {
+				if len(remainders) != 0 {
+					t.Errorf("got %d remainder entries; want none", len(remainders))
+				}
+				return
+			}
+			if len(remainders) != 1 {
+				t.Fatalf("got %d remainder entries; want 1", len(remainders))
+			}
+
+			remainder, partial := remainders[0], entries[len(tt.spent)-1]
+			if remainder.Amount != tt.remainder || remainder.Status != tt.remainderStatus {
+				t.Errorf("got remainder %d %s; want %d %s", remainder.Amount, remainder.Status, tt.remainder, tt.remainderStatus)
+			}
+			if !remainder.CreatedAt.Equal(partial.CreatedAt) || remainder.LifetimeDays != partial.LifetimeDays {
+				t.Errorf("got remainder created_at %v lifetime %d; want %v lifetime %d", remainder.CreatedAt, remainder.LifetimeDays, partial.CreatedAt, partial.LifetimeDays)
+			}
+		})
+	}
+}
+
+// BenchmarkSpendEntries списывает 999 баллов из 500 записей по 2 балла: 499 записей закрываются
+// полностью, последняя делится на границе. Отчет stmts/op показывает, что число запросов
+// не зависит от числа записей, в отличие от прежнего UPDATE на каждую закрытую запись
+func BenchmarkSpendEntries(b *testing.B) {
+	const entries = 500
+
+	db := newCountingTestDB(b)
+	models := NewModels(db, 10*time.Second)
+	ctx := context.Background()
+
+	var total int64
+	for range b.N {
+		b.StopTimer()
+		userId := uuid.New()
+		_, err := db.Exec(`
+			INSERT INTO bonus_entries (user_id, amount, created_at, expires_at, lifetime_days)
+			SELECT $1, 2, NOW() - i * INTERVAL '1 minute', NOW() - i * INTERVAL '1 minute' + INTERVAL '30 days', 30
+			FROM generate_series(1, $2::int) AS i`, userId, entries)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		before := statements.Load()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		spent, _, err := models.BonusEntries.SpendEntries(ctx, tx, userId, 2*entries-1, "")
+		if err != nil {
+			tx.Rollback()
+			b.Fatal(err)
+		}
+		if err = tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+		total += statements.Load() - before
+
+		if len(spent) != entries {
+			b.Fatalf("got %d spent entries; want %d", len(spent), entries)
+		}
+	}
+
+	b.ReportMetric(float64(total)/float64(b.N), "stmts/op")
+	b.ReportMetric(entries, "entries/op")
+}
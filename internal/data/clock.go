@@ -0,0 +1,31 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ClockModel читает время БД: сгорание баллов сравнивается с NOW() на стороне PostgreSQL,
+// а группировка по дням использует часовой пояс сессии БД
+type ClockModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// Now возвращает текущее время БД и часовой пояс сессии
+func (m ClockModel) Now(ctx context.Context) (time.Time, string, error) {
+	query := `SELECT NOW(), current_setting('TimeZone')`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var now time.Time
+	var timezone string
+	err := m.DB.QueryRowContext(ctx, query).Scan(&now, &timezone)
+	if err != nil {
+		return time.Time{}, "", queryError(ctx, err)
+	}
+
+	return now, timezone, nil
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor - позиция для keyset-пагинации по паре (created_at, id)
+type Cursor struct {
+	CreatedAt time.Time
+	Id        uuid.UUID
+}
+
+// Encode кодирует курсор в непрозрачную строку для передачи клиенту
+func (c Cursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.Id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor разбирает строку, полученную из Cursor.Encode
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	createdAt, id, found := strings.Cut(string(raw), "|")
+	if !found {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var c Cursor
+	c.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	c.Id, err = uuid.Parse(id)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
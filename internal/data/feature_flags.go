@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type FeatureFlag struct {
+	Key       string    `json:"key"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type FlagModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// GetAll возвращает все сохраненные флаги
+func (m FlagModel) GetAll(ctx context.Context) ([]*FeatureFlag, error) {
+	query := `
+		SELECT key, enabled, updated_at
+		FROM feature_flags
+		ORDER BY key`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	flags := []*FeatureFlag{}
+	for rows.Next() {
+		var flag FeatureFlag
+		err := rows.Scan(&flag.Key, &flag.Enabled, &flag.UpdatedAt)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		flags = append(flags, &flag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return flags, nil
+}
+
+// Set создает или обновляет значение флага
+func (m FlagModel) Set(ctx context.Context, flag *FeatureFlag) error {
+	query := `
+		INSERT INTO feature_flags (key, enabled, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (key) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, flag.Key, flag.Enabled).Scan(&flag.UpdatedAt)
+	return queryError(ctx, err)
+}
@@ -0,0 +1,56 @@
+package data
+
+import (
+	"math"
+
+	"simple-ledger.itmo.ru/internal/validator"
+)
+
+// MaxPageSize - наибольший размер страницы списков
+const MaxPageSize = 500
+
+// Filters - номер и размер страницы для постраничной выдачи списков
+type Filters struct {
+	Page     int
+	PageSize int
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= MaxPageSize, "page_size", "must be a maximum of 500")
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+// Metadata - сведения о странице списка: текущая страница, ее размер, всего записей и последняя страница
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records"`
+}
+
+// calculateMetadata считает метаданные страницы по общему числу записей. Для пустого списка
+// возвращаются только нулевые total_records
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey - ответ, сохраненный для ключа идемпотентности пользователя.
+// RequestHash позволяет отличить повтор запроса от другого запроса с тем же ключом
+type IdempotencyKey struct {
+	Key         string
+	UserId      uuid.UUID
+	RequestHash string
+	Status      int
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// IdempotencyKeyModel хранит ключи идемпотентности. Ключи старше TTL считаются истекшими
+type IdempotencyKeyModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	TTL          time.Duration
+}
+
+// GetTx возвращает неистекший ключ пользователя или ErrRecordNotFound.
+// Вызывается под блокировкой пользователя, поэтому параллельный запрос с тем же ключом
+// дождется коммита первого и получит его ответ
+func (m IdempotencyKeyModel) GetTx(ctx context.Context, tx *sql.Tx, key string, userId uuid.UUID) (*IdempotencyKey, error) {
+	query := `
+		SELECT key, user_id, request_hash, status, response, created_at
+		FROM idempotency_keys
+		WHERE key = $1
+			AND user_id = $2
+			AND created_at > NOW() - make_interval(secs => $3)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var k IdempotencyKey
+	err := tx.QueryRowContext(ctx, query, key, userId, m.TTL.Seconds()).Scan(
+		&k.Key,
+		&k.UserId,
+		&k.RequestHash,
+		&k.Status,
+		&k.Response,
+		&k.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, queryError(ctx, err)
+		}
+	}
+
+	return &k, nil
+}
+
+// InsertTx сохраняет ответ в той же транзакции, что и операция. Истекший ключ с тем же
+// значением, который еще не удален, перезаписывается
+func (m IdempotencyKeyModel) InsertTx(ctx context.Context, tx *sql.Tx, k *IdempotencyKey) error {
+	query := `
+		INSERT INTO idempotency_keys (key, user_id, request_hash, status, response)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key, user_id) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash,
+			status = EXCLUDED.status,
+			response = EXCLUDED.response,
+			created_at = NOW()
+		RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := tx.QueryRowContext(ctx, query, k.Key, k.UserId, k.RequestHash, k.Status, k.Response).Scan(&k.CreatedAt)
+	return queryError(ctx, err)
+}
+
+// DeleteExpired удаляет ключи старше TTL и возвращает их количество
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE created_at <= NOW() - make_interval(secs => $1)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, m.TTL.Seconds())
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+
+	return result.RowsAffected()
+}
@@ -1,21 +1,70 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer открывает спаны запросов моделей. Пока провайдер трассировок не настроен, спаны не записываются
+var tracer = otel.Tracer("simple-ledger.itmo.ru/internal/data")
+
+// startSpan открывает спан операции модели; вызывающий закрывает его через span.End
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
 var (
-	ErrRecordNotFound    = errors.New("record not found")
-	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrRecordNotFound     = errors.New("record not found")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrQueryTimeout       = errors.New("query timed out")
+	ErrDuplicateReference = errors.New("entry with this source and external_reference already exists")
+	ErrEntryNotActive     = errors.New("only active, unexpired entries can be extended")
+	ErrLifetimeTooLong    = errors.New("the extended lifetime exceeds the maximum lifetime")
 )
 
 type Models struct {
-	BonusEntries BonusEntryModel
+	BonusEntries    BonusEntryModel
+	Transactions    TransactionModel
+	Flags           FlagModel
+	UserSettings    UserSettingsModel
+	SourcePolicies  SourcePolicyModel
+	IdempotencyKeys IdempotencyKeyModel
+	Clock           ClockModel
+	Outbox          OutboxModel
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels создает модели; queryTimeout ограничивает время выполнения каждого запроса
+func NewModels(db *sql.DB, queryTimeout time.Duration) Models {
 	return Models{
-		BonusEntries: BonusEntryModel{DB: db},
+		BonusEntries:    BonusEntryModel{DB: db, QueryTimeout: queryTimeout},
+		Transactions:    TransactionModel{DB: db, QueryTimeout: queryTimeout},
+		Flags:           FlagModel{DB: db, QueryTimeout: queryTimeout},
+		UserSettings:    UserSettingsModel{DB: db, QueryTimeout: queryTimeout},
+		SourcePolicies:  SourcePolicyModel{DB: db, QueryTimeout: queryTimeout},
+		IdempotencyKeys: IdempotencyKeyModel{DB: db, QueryTimeout: queryTimeout},
+		Clock:           ClockModel{DB: db, QueryTimeout: queryTimeout},
+		Outbox:          OutboxModel{DB: db, QueryTimeout: queryTimeout},
 	}
 }
+
+// queryError заменяет ошибку запроса на ErrQueryTimeout, если запрос прерван по таймауту
+func queryError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return err
+}
+
+// IsDeadlock сообщает, что Postgres прервал транзакцию из-за взаимоблокировки (код 40P01).
+// Такую транзакцию можно безопасно повторить целиком
+func IsDeadlock(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40P01"
+}
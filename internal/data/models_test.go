@@ -0,0 +1,115 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+func TestQueryError(t *testing.T) {
+	queryErr := errors.New("pq: canceling statement due to user request")
+
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-expired.Done()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want error
+	}{
+		{"deadline exceeded", expired, queryErr, ErrQueryTimeout},
+		{"no error after deadline", expired, nil, nil},
+		{"canceled by client", canceled, queryErr, queryErr},
+		{"live context", context.Background(), queryErr, queryErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryError(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestQueryCanceled отменяет контекст запроса, пока запрос ждет блокировку пользователя,
+// и проверяет, что запрос прерывается сразу, а не по таймауту модели
+func TestQueryCanceled(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, 10*time.Second)
+	userId := uuid.New()
+
+	holder, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback()
+	if err = models.BonusEntries.LockUser(context.Background(), holder, userId); err != nil {
+		t.Fatal(err)
+	}
+
+	waiter, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiter.Rollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = models.BonusEntries.LockUser(ctx, waiter, userId)
+	if err == nil {
+		t.Fatal("got no error for a canceled query")
+	}
+	if errors.Is(err, ErrQueryTimeout) {
+		t.Errorf("got %v; want a cancellation error, not a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("got the query running for %v after cancellation", elapsed)
+	}
+
+	// Блокировка по-прежнему принадлежит первой транзакции, отмененный запрос ее не получил
+	var waiting int
+	err = db.QueryRow(`SELECT count(*) FROM pg_locks WHERE locktype = 'advisory' AND NOT granted`).Scan(&waiting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waiting != 0 {
+		t.Errorf("got %d transactions still waiting for the lock; want 0", waiting)
+	}
+}
+
+func TestIsDeadlock(t *testing.T) {
+	deadlock := &pq.Error{Code: "40P01"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"deadlock", deadlock, true},
+		{"wrapped deadlock", fmt.Errorf("transfer: %w", deadlock), true},
+		{"serialization failure", &pq.Error{Code: "40001"}, false},
+		{"other error", errors.New("connection refused"), false},
+		{"no error", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsDeadlock(tt.err); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
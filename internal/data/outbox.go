@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// OutboxEvent - событие, ожидающее доставки подписчику. Payload доставляется в том виде,
+// в котором был записан
+type OutboxEvent struct {
+	Id        uuid.UUID
+	EventType string
+	Payload   []byte
+	CreatedAt time.Time
+	Attempts  int
+}
+
+type OutboxModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// InsertTx записывает событие в той же транзакции, что и изменение, о котором оно сообщает
+func (m OutboxModel) InsertTx(ctx context.Context, tx *sql.Tx, event *OutboxEvent) error {
+	query := `
+		INSERT INTO outbox (id, event_type, payload)
+		VALUES ($1, $2, $3)
+		RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := tx.QueryRowContext(ctx, query, event.Id, event.EventType, event.Payload).Scan(&event.CreatedAt)
+	return queryError(ctx, err)
+}
+
+// ClaimPending забирает до limit недоставленных событий в порядке записи на срок lease и возвращает их.
+// Забранные события не блокируются: запрос коммитится сразу, а другие реплики пропускают их до конца
+// срока. Если релей не отметит событие до истечения срока, оно будет забрано и доставлено повторно
+func (m OutboxModel) ClaimPending(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE outbox
+			SET claimed_until = NOW() + $2 * INTERVAL '1 millisecond'
+			WHERE id IN (
+				SELECT id
+				FROM outbox
+				WHERE sent_at IS NULL
+					AND (claimed_until IS NULL OR claimed_until < NOW())
+				ORDER BY created_at, id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED)
+			RETURNING id, event_type, payload, created_at, attempts)
+		SELECT id, event_type, payload, created_at, attempts
+		FROM claimed
+		ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	events := []*OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		err := rows.Scan(&event.Id, &event.EventType, &event.Payload, &event.CreatedAt, &event.Attempts)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return events, nil
+}
+
+// MarkSent отмечает событие доставленным
+func (m OutboxModel) MarkSent(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE outbox
+		SET sent_at = NOW(), attempts = attempts + 1, last_error = NULL, claimed_until = NULL
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return queryError(ctx, err)
+}
+
+// MarkFailed записывает неудачную попытку доставки; событие возвращается в очередь
+func (m OutboxModel) MarkFailed(ctx context.Context, id uuid.UUID, deliveryErr string) error {
+	query := `
+		UPDATE outbox
+		SET attempts = attempts + 1, last_error = $2, claimed_until = NULL
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, deliveryErr)
+	return queryError(ctx, err)
+}
+
+// Release возвращает в очередь забранные, но не доставленные события ids
+func (m OutboxModel) Release(ctx context.Context, ids []string) error {
+	query := `
+		UPDATE outbox
+		SET claimed_until = NULL
+		WHERE id = ANY($1) AND sent_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.StringArray(ids))
+	return queryError(ctx, err)
+}
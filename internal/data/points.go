@@ -0,0 +1,53 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// pointsAsStrings включает сериализацию сумм баллов строками (-amounts-as-strings)
+var pointsAsStrings atomic.Bool
+
+// SetPointsAsStrings задает, как Points сериализуются в JSON: строками ("150") или числами (150).
+// Настройка действует на весь процесс, ее задают один раз при запуске
+func SetPointsAsStrings(enabled bool) {
+	pointsAsStrings.Store(enabled)
+}
+
+// Points - сумма баллов в ответах API и событиях. В JSON это число или, при -amounts-as-strings,
+// строка с десятичной записью числа, чтобы клиентам не приходилось беспокоиться о точности чисел
+type Points int
+
+func (p Points) MarshalJSON() ([]byte, error) {
+	js := strconv.AppendInt(nil, int64(p), 10)
+	if pointsAsStrings.Load() {
+		js = strconv.AppendQuote(nil, string(js))
+	}
+	return js, nil
+}
+
+// UnmarshalJSON принимает сумму в обоих видах, числом и строкой
+func (p *Points) UnmarshalJSON(js []byte) error {
+	if bytes.Equal(js, []byte("null")) {
+		return nil
+	}
+
+	if len(js) > 0 && js[0] == '"' {
+		var s string
+		if err := json.Unmarshal(js, &s); err != nil {
+			return err
+		}
+		js = []byte(s)
+	}
+
+	n, err := strconv.Atoi(string(js))
+	if err != nil {
+		return fmt.Errorf("invalid points amount %s", js)
+	}
+
+	*p = Points(n)
+	return nil
+}
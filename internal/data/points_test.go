@@ -0,0 +1,52 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPointsJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		asStrings bool
+		want      string
+	}{
+		{name: "numbers", want: `{"amount":9007199254740993,"delta":-5}`},
+		{name: "strings", asStrings: true, want: `{"amount":"9007199254740993","delta":"-5"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetPointsAsStrings(tt.asStrings)
+			t.Cleanup(func() { SetPointsAsStrings(false) })
+
+			in := struct {
+				Amount Points `json:"amount"`
+				Delta  Points `json:"delta"`
+			}{Amount: 9007199254740993, Delta: -5}
+
+			js, err := json.Marshal(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(js) != tt.want {
+				t.Errorf("got %s; want %s", js, tt.want)
+			}
+
+			// Обратно сумма читается в любом виде
+			out := in
+			out.Amount, out.Delta = 0, 0
+			if err = json.Unmarshal(js, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out != in {
+				t.Errorf("got %+v after a round trip; want %+v", out, in)
+			}
+		})
+	}
+
+	var p Points
+	if err := json.Unmarshal([]byte(`"1.5"`), &p); err == nil {
+		t.Errorf("got %d from a fractional amount; want an error", p)
+	}
+}
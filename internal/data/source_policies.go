@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SourcePolicy - срок жизни по умолчанию для начислений из источника Source
+type SourcePolicy struct {
+	Source              string    `json:"source"`
+	DefaultLifetimeDays int       `json:"default_lifetime_days"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+type SourcePolicyModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// Get возвращает политику источника или ErrRecordNotFound, если она не задана
+func (m SourcePolicyModel) Get(ctx context.Context, source string) (*SourcePolicy, error) {
+	query := `
+		SELECT source, default_lifetime_days, updated_at
+		FROM source_policies
+		WHERE source = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var policy SourcePolicy
+	err := m.DB.QueryRowContext(ctx, query, source).Scan(
+		&policy.Source,
+		&policy.DefaultLifetimeDays,
+		&policy.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, queryError(ctx, err)
+		}
+	}
+
+	return &policy, nil
+}
+
+// GetAll возвращает все политики источников
+func (m SourcePolicyModel) GetAll(ctx context.Context) ([]*SourcePolicy, error) {
+	query := `
+		SELECT source, default_lifetime_days, updated_at
+		FROM source_policies
+		ORDER BY source`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	policies := []*SourcePolicy{}
+	for rows.Next() {
+		var policy SourcePolicy
+		if err := rows.Scan(&policy.Source, &policy.DefaultLifetimeDays, &policy.UpdatedAt); err != nil {
+			return nil, queryError(ctx, err)
+		}
+		policies = append(policies, &policy)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return policies, nil
+}
+
+// Upsert создает или обновляет политику источника
+func (m SourcePolicyModel) Upsert(ctx context.Context, policy *SourcePolicy) error {
+	query := `
+		INSERT INTO source_policies (source, default_lifetime_days, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (source) DO UPDATE
+			SET default_lifetime_days = EXCLUDED.default_lifetime_days, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, policy.Source, policy.DefaultLifetimeDays).Scan(&policy.UpdatedAt)
+	return queryError(ctx, err)
+}
+
+// Delete удаляет политику источника или возвращает ErrRecordNotFound, если ее нет
+func (m SourcePolicyModel) Delete(ctx context.Context, source string) error {
+	query := `
+		DELETE FROM source_policies
+		WHERE source = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, source)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
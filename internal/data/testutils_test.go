@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// testDSNEnv - переменная окружения с DSN тестовой PostgreSQL. Тесты, которым нужна БД,
+// без нее пропускаются
+const testDSNEnv = "LEDGER_TEST_DSN"
+
+// testSchema - схема тестовой БД этого пакета, отдельная от схемы cmd/api
+const testSchema = "ledger_data_test"
+
+// countingDriverName - драйвер pq, который считает отправленные запросы в statements
+const countingDriverName = "postgres-counting"
+
+// statements - число запросов, отправленных через countingDriverName
+var statements atomic.Int64
+
+func init() {
+	sql.Register(countingDriverName, countingDriver{})
+}
+
+type countingDriver struct{}
+
+func (countingDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := pq.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn}, nil
+}
+
+// countingConn передает запросы соединению pq и считает каждый из них
+type countingConn struct {
+	driver.Conn
+}
+
+func (c countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	statements.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	statements.Add(1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+// newTestDB открывает тестовую БД из LEDGER_TEST_DSN и создает в ней пустую схему по всем миграциям
+func newTestDB(t testing.TB) *sql.DB {
+	return openTestDB(t, "postgres")
+}
+
+// newCountingTestDB открывает тестовую БД, как newTestDB, но запросы к ней считаются в statements
+func newCountingTestDB(t testing.TB) *sql.DB {
+	return openTestDB(t, countingDriverName)
+}
+
+func openTestDB(t testing.TB, driverName string) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " search_path=" + testSchema
+	case strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + testSchema
+	default:
+		dsn += "?search_path=" + testSchema
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %[1]s CASCADE; CREATE SCHEMA %[1]s", testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range migrations {
+		script, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(string(script)); err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+	}
+
+	return db
+}
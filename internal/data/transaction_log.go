@@ -0,0 +1,597 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Transaction - запись журнала операций.
+// Amount - обработанная сумма операции, Delta - изменение баланса со знаком.
+// CorrelationId объединяет операции, созданные одной логической операцией,
+// ResultingBalance - баланс сразу после операции (nil, если он не записывался)
+type Transaction struct {
+	Id               uuid.UUID  `json:"id"`
+	UserId           uuid.UUID  `json:"user_id"`
+	Type             string     `json:"type"`
+	Amount           Points     `json:"amount"`
+	Delta            Points     `json:"delta"`
+	ResultingBalance *Points    `json:"resulting_balance"`
+	CorrelationId    *uuid.UUID `json:"correlation_id"`
+	// ReversedTransactionId - операция, которую отменяет это сторно
+	ReversedTransactionId *uuid.UUID `json:"reversed_transaction_id,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+}
+
+// LedgerRow - запись журнала с балансом после операции
+type LedgerRow struct {
+	Transaction
+	RunningBalance Points `json:"running_balance"`
+}
+
+type TransactionModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// Insert записывает операцию в журнал в рамках транзакции, в которой меняются баллы
+func (m TransactionModel) Insert(ctx context.Context, tx *sql.Tx, trx *Transaction) error {
+	ctx, span := startSpan(ctx, "TransactionModel.Insert",
+		attribute.String("user_id", trx.UserId.String()),
+		attribute.String("type", trx.Type),
+		attribute.Int("amount", int(trx.Amount)),
+	)
+	defer span.End()
+
+	query := `
+		INSERT INTO transactions (id, user_id, type, amount, delta, resulting_balance, correlation_id, reversed_transaction_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	args := []any{
+		trx.Id,
+		trx.UserId,
+		trx.Type,
+		trx.Amount,
+		trx.Delta,
+		trx.ResultingBalance,
+		trx.CorrelationId,
+		trx.ReversedTransactionId,
+		trx.CreatedAt,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return queryError(ctx, err)
+}
+
+// ListByUser возвращает страницу операций пользователя от новых к старым и метаданные страницы.
+// before - курсор последней полученной записи (nil для первой страницы); с курсором страницы
+// и total_records считаются только по операциям старше него
+func (m TransactionModel) ListByUser(ctx context.Context, userId uuid.UUID, before *Cursor, filters Filters) ([]*Transaction, Metadata, error) {
+	query := `
+		SELECT id, user_id, type, amount, delta, resulting_balance, correlation_id, reversed_transaction_id, created_at
+		FROM transactions
+		WHERE user_id = $1
+			AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4 OFFSET $5`
+
+	countQuery := `
+		SELECT COUNT(*)
+		FROM transactions
+		WHERE user_id = $1
+			AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))`
+
+	var beforeCreatedAt *time.Time
+	beforeId := uuid.Nil
+	if before != nil {
+		beforeCreatedAt = &before.CreatedAt
+		beforeId = before.Id
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, beforeCreatedAt, beforeId, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	transactions, err := scanTransactions(ctx, rows)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Число записей считается отдельным запросом, чтобы не расширять общий для выборок операций scanTransactions
+	var totalRecords int
+	err = m.DB.QueryRowContext(ctx, countQuery, userId, beforeCreatedAt, beforeId).Scan(&totalRecords)
+	if err != nil {
+		return nil, Metadata{}, queryError(ctx, err)
+	}
+
+	return transactions, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// ListAll возвращает операции всех пользователей от новых к старым.
+// before - курсор последней полученной записи (nil для первой страницы). Keyset-пагинация
+// не пропускает и не повторяет записи, даже если между запросами появились новые операции
+func (m TransactionModel) ListAll(ctx context.Context, before *Cursor, limit int) ([]*Transaction, error) {
+	query := `
+		SELECT id, user_id, type, amount, delta, resulting_balance, correlation_id, reversed_transaction_id, created_at
+		FROM transactions
+		WHERE $1::timestamptz IS NULL OR (created_at, id) < ($1, $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+
+	var beforeCreatedAt *time.Time
+	beforeId := uuid.Nil
+	if before != nil {
+		beforeCreatedAt = &before.CreatedAt
+		beforeId = before.Id
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, beforeCreatedAt, beforeId, limit)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	return scanTransactions(ctx, rows)
+}
+
+// Get возвращает операцию журнала по id или ErrRecordNotFound
+func (m TransactionModel) Get(ctx context.Context, id uuid.UUID) (*Transaction, error) {
+	query := `
+		SELECT id, user_id, type, amount, delta, resulting_balance, correlation_id, reversed_transaction_id, created_at
+		FROM transactions
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	transactions, err := scanTransactions(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(transactions) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return transactions[0], nil
+}
+
+// IsReversedTx сообщает, отменена ли уже операция id. Вызывается под блокировкой пользователя
+func (m TransactionModel) IsReversedTx(ctx context.Context, tx *sql.Tx, id uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM transactions WHERE reversed_transaction_id = $1)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var reversed bool
+	err := tx.QueryRowContext(ctx, query, id).Scan(&reversed)
+	if err != nil {
+		return false, queryError(ctx, err)
+	}
+
+	return reversed, nil
+}
+
+// GetByCorrelationId возвращает все операции, созданные одной логической операцией, в хронологическом порядке
+func (m TransactionModel) GetByCorrelationId(ctx context.Context, correlationId uuid.UUID) ([]*Transaction, error) {
+	query := `
+		SELECT id, user_id, type, amount, delta, resulting_balance, correlation_id, reversed_transaction_id, created_at
+		FROM transactions
+		WHERE correlation_id = $1
+		ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, correlationId)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	return scanTransactions(ctx, rows)
+}
+
+func scanTransactions(ctx context.Context, rows *sql.Rows) ([]*Transaction, error) {
+	transactions := []*Transaction{}
+	for rows.Next() {
+		var trx Transaction
+		err := rows.Scan(
+			&trx.Id,
+			&trx.UserId,
+			&trx.Type,
+			&trx.Amount,
+			&trx.Delta,
+			&trx.ResultingBalance,
+			&trx.CorrelationId,
+			&trx.ReversedTransactionId,
+			&trx.CreatedAt,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		transactions = append(transactions, &trx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return transactions, nil
+}
+
+// GetLedger возвращает операции пользователя в хронологическом порядке с накопительным балансом.
+// Баланс считается по всему журналу, поэтому он корректен на любой странице.
+// after - курсор последней полученной записи (nil для первой страницы)
+func (m TransactionModel) GetLedger(ctx context.Context, userId uuid.UUID, after *Cursor, limit int) ([]*LedgerRow, error) {
+	query := `
+		SELECT id, user_id, type, amount, delta, resulting_balance, correlation_id, created_at, running_balance
+		FROM (
+			SELECT id, user_id, type, amount, delta, resulting_balance, correlation_id, created_at,
+				SUM(delta) OVER (ORDER BY created_at, id) AS running_balance
+			FROM transactions
+			WHERE user_id = $1
+		) ledger
+		WHERE $2::timestamptz IS NULL OR (created_at, id) > ($2, $3)
+		ORDER BY created_at, id
+		LIMIT $4`
+
+	var afterCreatedAt *time.Time
+	afterId := uuid.Nil
+	if after != nil {
+		afterCreatedAt = &after.CreatedAt
+		afterId = after.Id
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, afterCreatedAt, afterId, limit)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	ledger := []*LedgerRow{}
+	for rows.Next() {
+		var row LedgerRow
+		err := rows.Scan(
+			&row.Id,
+			&row.UserId,
+			&row.Type,
+			&row.Amount,
+			&row.Delta,
+			&row.ResultingBalance,
+			&row.CorrelationId,
+			&row.CreatedAt,
+			&row.RunningBalance,
+		)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		ledger = append(ledger, &row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return ledger, nil
+}
+
+// GetActivityStats возвращает время последней операции пользователя (nil, если операций не было)
+// и сумму всех начислений за все время
+func (m TransactionModel) GetActivityStats(ctx context.Context, userId uuid.UUID) (*time.Time, int, error) {
+	query := `
+		SELECT MAX(created_at), COALESCE(SUM(delta) FILTER (WHERE delta > 0), 0)
+		FROM transactions
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var lastActivity *time.Time
+	var earned int
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(&lastActivity, &earned)
+	if err != nil {
+		return nil, 0, queryError(ctx, err)
+	}
+
+	return lastActivity, earned, nil
+}
+
+// TypeVolume - число и сумма операций одного типа за день
+type TypeVolume struct {
+	Date   string `json:"date"`
+	Type   string `json:"type"`
+	Count  int    `json:"count"`
+	Amount Points `json:"amount"`
+}
+
+// GetDailyVolume возвращает число и сумму операций по дням и типам за период [from, to] (даты включительно)
+func (m TransactionModel) GetDailyVolume(ctx context.Context, from, to time.Time) ([]*TypeVolume, error) {
+	query := `
+		SELECT DATE(created_at) AS day, type, COUNT(*), COALESCE(SUM(amount), 0)
+		FROM transactions
+		WHERE created_at >= $1 
+			AND created_at < $2::date + 1
+		GROUP BY DATE(created_at), type
+		ORDER BY day, type`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	volumes := []*TypeVolume{}
+	for rows.Next() {
+		var day time.Time
+		var volume TypeVolume
+		err := rows.Scan(&day, &volume.Type, &volume.Count, &volume.Amount)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		volume.Date = day.Format("2006-01-02")
+		volumes = append(volumes, &volume)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return volumes, nil
+}
+
+// DormantUser - пользователь с активным балансом и без недавних операций.
+// LastTransactionAt равен nil, если в журнале нет ни одной операции пользователя
+type DormantUser struct {
+	UserId            uuid.UUID  `json:"user_id"`
+	Balance           Points     `json:"balance"`
+	LastTransactionAt *time.Time `json:"last_transaction_at"`
+}
+
+// GetDormantUsers возвращает пользователей с активным балансом, последняя операция которых
+// старше inactiveDays дней, начиная с наибольшего баланса. Служебные записи журнала
+// (продление сроков, сгорание остатков) активностью не считаются
+func (m TransactionModel) GetDormantUsers(ctx context.Context, inactiveDays int, limit int) ([]*DormantUser, error) {
+	query := `
+		SELECT b.user_id, b.balance, t.last_at
+		FROM (
+			SELECT user_id, SUM(amount) AS balance
+			FROM bonus_entries
+			WHERE status = 'active'
+				AND expires_at > NOW()
+			GROUP BY user_id
+		) b
+		LEFT JOIN (
+			SELECT user_id, MAX(created_at) AS last_at
+			FROM transactions
+			WHERE type NOT IN ('lifetime_extension', 'fragment_forfeit')
+			GROUP BY user_id
+		) t ON t.user_id = b.user_id
+		WHERE t.last_at IS NULL OR t.last_at < NOW() - $1 * INTERVAL '1 day'
+		ORDER BY b.balance DESC, b.user_id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, inactiveDays, limit)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	users := []*DormantUser{}
+	for rows.Next() {
+		var user DormantUser
+		err := rows.Scan(&user.UserId, &user.Balance, &user.LastTransactionAt)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return users, nil
+}
+
+// SuspectedUser - пользователь, операции которого похожи на злоупотребление
+type SuspectedUser struct {
+	UserId uuid.UUID `json:"user_id"`
+	Count  int       `json:"count"`
+	Amount Points    `json:"amount"`
+	LastAt time.Time `json:"last_at"`
+}
+
+// GetRapidCycles возвращает пользователей, у которых с момента since не меньше minCycles списаний
+// (типы debitTypes) последовали за начислением (типы creditTypes) в пределах window.
+// Amount - сумма таких списаний
+func (m TransactionModel) GetRapidCycles(ctx context.Context, creditTypes, debitTypes []string, window time.Duration, minCycles int, since time.Time) ([]*SuspectedUser, error) {
+	query := `
+		SELECT w.user_id, COUNT(*), SUM(w.amount), MAX(w.created_at)
+		FROM transactions w
+		WHERE w.type = ANY($2)
+			AND w.created_at >= $4
+			AND EXISTS (
+				SELECT 1
+				FROM transactions d
+				WHERE d.user_id = w.user_id
+					AND d.type = ANY($1)
+					AND d.created_at <= w.created_at
+					AND d.created_at >= w.created_at - $3 * INTERVAL '1 second')
+		GROUP BY w.user_id
+		HAVING COUNT(*) >= $5
+		ORDER BY COUNT(*) DESC, w.user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.StringArray(creditTypes), pq.StringArray(debitTypes), window.Seconds(), since, minCycles)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	return scanSuspectedUsers(ctx, rows)
+}
+
+// GetOperationBursts возвращает пользователей, у которых с момента since хотя бы в одном окне длиной window
+// было не меньше minCount операций типов types. Count и Amount - число и сумма операций в самом
+// загруженном окне, LastAt - последняя операция этого окна
+func (m TransactionModel) GetOperationBursts(ctx context.Context, types []string, window time.Duration, minCount int, since time.Time) ([]*SuspectedUser, error) {
+	query := `
+		SELECT user_id, count, amount, created_at
+		FROM (
+			SELECT DISTINCT ON (t.user_id) t.user_id, b.count, b.amount, t.created_at
+			FROM transactions t
+			CROSS JOIN LATERAL (
+				SELECT COUNT(*) AS count, SUM(o.amount) AS amount
+				FROM transactions o
+				WHERE o.user_id = t.user_id
+					AND o.type = ANY($1)
+					AND o.created_at >= $3
+					AND o.created_at <= t.created_at
+					AND o.created_at > t.created_at - $2 * INTERVAL '1 second') b
+			WHERE t.type = ANY($1)
+				AND t.created_at >= $3
+				AND b.count >= $4
+			ORDER BY t.user_id, b.count DESC, t.created_at DESC) bursts
+		ORDER BY count DESC, user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.StringArray(types), window.Seconds(), since, minCount)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	return scanSuspectedUsers(ctx, rows)
+}
+
+// TransferCycle - цепочка переводов, по которой баллы вернулись к первому участнику
+type TransferCycle struct {
+	// Users - участники по порядку переводов, начиная с участника с наименьшим id
+	Users     []uuid.UUID `json:"users"`
+	Transfers int         `json:"transfers"`
+	Amount    Points      `json:"amount"`
+	LastAt    time.Time   `json:"last_at"`
+}
+
+// GetTransferCycles находит циклы переводов (типы transferTypes) длиной не больше maxLength участников
+// с момента since. Перевод - пара записей журнала с общим correlation_id: списание у отправителя и
+// начисление получателю. Transfers и Amount - число и сумма переводов по всем звеньям цикла
+func (m TransactionModel) GetTransferCycles(ctx context.Context, transferTypes []string, maxLength int, since time.Time) ([]*TransferCycle, error) {
+	query := `
+		WITH RECURSIVE edges AS (
+			SELECT s.user_id AS from_user, r.user_id AS to_user,
+				COUNT(*) AS transfers, SUM(r.amount) AS amount, MAX(r.created_at) AS last_at
+			FROM transactions s
+			JOIN transactions r ON r.correlation_id = s.correlation_id
+			WHERE s.type = ANY($1)
+				AND r.type = ANY($1)
+				AND s.delta < 0
+				AND r.delta > 0
+				AND s.user_id <> r.user_id
+				AND s.created_at >= $3
+			GROUP BY s.user_id, r.user_id
+		), paths AS (
+			SELECT from_user AS start_user, to_user, ARRAY[from_user] AS path, transfers, amount, last_at
+			FROM edges
+			UNION ALL
+			SELECT p.start_user, e.to_user, p.path || e.from_user,
+				p.transfers + e.transfers, p.amount + e.amount, GREATEST(p.last_at, e.last_at)
+			FROM paths p
+			JOIN edges e ON e.from_user = p.to_user
+			WHERE p.to_user <> p.start_user
+				AND cardinality(p.path) < $2
+				AND (e.to_user = p.start_user OR NOT e.to_user = ANY(p.path))
+		)
+		SELECT path::text[], transfers, amount, last_at
+		FROM paths p
+		WHERE to_user = start_user
+			AND NOT EXISTS (SELECT 1 FROM unnest(p.path) AS member WHERE member < p.start_user)
+		ORDER BY last_at DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.StringArray(transferTypes), maxLength, since)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	cycles := []*TransferCycle{}
+	for rows.Next() {
+		var cycle TransferCycle
+		var users []string
+		err := rows.Scan(pq.Array(&users), &cycle.Transfers, &cycle.Amount, &cycle.LastAt)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+
+		for _, user := range users {
+			userId, err := uuid.Parse(user)
+			if err != nil {
+				return nil, err
+			}
+			cycle.Users = append(cycle.Users, userId)
+		}
+		cycles = append(cycles, &cycle)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return cycles, nil
+}
+
+func scanSuspectedUsers(ctx context.Context, rows *sql.Rows) ([]*SuspectedUser, error) {
+	users := []*SuspectedUser{}
+	for rows.Next() {
+		var user SuspectedUser
+		err := rows.Scan(&user.UserId, &user.Count, &user.Amount, &user.LastAt)
+		if err != nil {
+			return nil, queryError(ctx, err)
+		}
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	return users, nil
+}
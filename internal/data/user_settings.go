@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UserSettings struct {
+	UserId              uuid.UUID `json:"user_id"`
+	DefaultLifetimeDays *int      `json:"default_lifetime_days"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+type UserSettingsModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// Get возвращает настройки пользователя или ErrRecordNotFound, если они не заданы
+func (m UserSettingsModel) Get(ctx context.Context, userId uuid.UUID) (*UserSettings, error) {
+	query := `
+		SELECT user_id, default_lifetime_days, updated_at
+		FROM user_settings
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var settings UserSettings
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(
+		&settings.UserId,
+		&settings.DefaultLifetimeDays,
+		&settings.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, queryError(ctx, err)
+		}
+	}
+
+	return &settings, nil
+}
+
+// Upsert создает или обновляет настройки пользователя
+func (m UserSettingsModel) Upsert(ctx context.Context, settings *UserSettings) error {
+	query := `
+		INSERT INTO user_settings (user_id, default_lifetime_days, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (user_id) DO UPDATE
+			SET default_lifetime_days = EXCLUDED.default_lifetime_days, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, settings.UserId, settings.DefaultLifetimeDays).Scan(&settings.UpdatedAt)
+	return queryError(ctx, err)
+}
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_transactions_user_created;
+
+DROP TABLE IF EXISTS transactions;
@@ -0,0 +1,13 @@
+-- Журнал операций по баллам пользователей
+-- created_at хранится с полной точностью, чтобы сохранять порядок операций внутри одной секунды
+CREATE TABLE IF NOT EXISTS transactions (
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL,
+    type text NOT NULL,
+    amount int NOT NULL CHECK (amount >= 0),
+    delta int NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+-- Индекс для выборки журнала пользователя в хронологическом порядке (keyset-пагинация)
+CREATE INDEX idx_transactions_user_created ON transactions(user_id, created_at, id);
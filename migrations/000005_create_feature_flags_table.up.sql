@@ -0,0 +1,6 @@
+-- Флаги для переключения поведения сервиса без перезапуска
+CREATE TABLE IF NOT EXISTS feature_flags (
+    key text PRIMARY KEY,
+    enabled boolean NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_bonus_entries_user_expired_at;
+
+ALTER TABLE bonus_entries DROP COLUMN IF EXISTS expired_at;
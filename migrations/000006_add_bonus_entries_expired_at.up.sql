@@ -0,0 +1,6 @@
+-- Момент, когда запись была переведена в статус 'expired'
+ALTER TABLE bonus_entries ADD COLUMN IF NOT EXISTS expired_at timestamp(0) with time zone;
+
+-- Индекс для выборки недавно сгоревших записей пользователя
+CREATE INDEX IF NOT EXISTS idx_bonus_entries_user_expired_at ON bonus_entries(user_id, expired_at)
+    WHERE status = 'expired';
@@ -0,0 +1,6 @@
+-- Персональные настройки пользователей
+CREATE TABLE IF NOT EXISTS user_settings (
+    user_id uuid PRIMARY KEY,
+    default_lifetime_days int CHECK (default_lifetime_days > 0),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
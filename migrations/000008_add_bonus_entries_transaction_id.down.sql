@@ -0,0 +1 @@
+ALTER TABLE bonus_entries DROP COLUMN IF EXISTS transaction_id;
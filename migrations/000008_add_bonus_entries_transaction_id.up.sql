@@ -0,0 +1,3 @@
+-- Операция журнала, которая создала начисление (NULL для начислений, созданных до появления связи).
+-- Остаток частично списанной записи сохраняет связь с исходной операцией
+ALTER TABLE bonus_entries ADD COLUMN IF NOT EXISTS transaction_id uuid;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS source_policies;
+
+ALTER TABLE bonus_entries DROP COLUMN IF EXISTS source;
@@ -0,0 +1,9 @@
+-- Источник начисления (например, promo или purchase), пустая строка - источник не указан
+ALTER TABLE bonus_entries ADD COLUMN IF NOT EXISTS source text NOT NULL DEFAULT '';
+
+-- Срок жизни по умолчанию для начислений из определенного источника
+CREATE TABLE IF NOT EXISTS source_policies (
+    source text PRIMARY KEY,
+    default_lifetime_days int NOT NULL CHECK (default_lifetime_days > 0),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_transactions_correlation_id;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS correlation_id;
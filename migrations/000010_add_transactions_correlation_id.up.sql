@@ -0,0 +1,5 @@
+-- Общий идентификатор всех операций журнала, созданных одной логической операцией
+-- (например, списание и сгорание его остатка). NULL для операций, записанных до появления связи
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS correlation_id uuid;
+
+CREATE INDEX IF NOT EXISTS idx_transactions_correlation_id ON transactions (correlation_id);
@@ -0,0 +1,3 @@
+-- Баланс пользователя сразу после операции, записывается в той же транзакции, что и сама операция.
+-- NULL для операций, записанных до появления столбца, и для служебных записей, баланс после которых не считается
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS resulting_balance int;
@@ -0,0 +1,14 @@
+-- Сохраненные ответы на запросы с заголовком Idempotency-Key. Повторный запрос с тем же ключом
+-- получает сохраненный ответ вместо повторного выполнения операции
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text NOT NULL,
+    user_id uuid NOT NULL,
+    request_hash text NOT NULL,
+    status int NOT NULL,
+    response jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (key, user_id)
+);
+
+-- Индекс для удаления ключей с истекшим сроком хранения
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_bonus_entries_external_reference;
+
+ALTER TABLE bonus_entries DROP COLUMN IF EXISTS external_reference;
@@ -0,0 +1,7 @@
+-- Идентификатор начисления во внешней системе, из которой оно импортировано.
+-- Одно и то же внешнее начисление не может быть импортировано пользователю дважды
+ALTER TABLE bonus_entries ADD COLUMN IF NOT EXISTS external_reference text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_bonus_entries_external_reference
+    ON bonus_entries (user_id, source, external_reference)
+    WHERE external_reference IS NOT NULL;
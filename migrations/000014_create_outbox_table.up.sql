@@ -0,0 +1,14 @@
+-- События об изменениях журнала, записанные в одной транзакции с самими изменениями.
+-- Фоновый релей доставляет их подписчику и отмечает sent_at, поэтому события не теряются при падении после коммита
+CREATE TABLE IF NOT EXISTS outbox (
+    id uuid PRIMARY KEY,
+    event_type text NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    sent_at timestamp with time zone,
+    attempts int NOT NULL DEFAULT 0,
+    last_error text
+);
+
+-- Индекс для выборки недоставленных событий в порядке записи
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (created_at) WHERE sent_at IS NULL;
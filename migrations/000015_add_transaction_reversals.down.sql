@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_transactions_reversed_transaction_id;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS reversed_transaction_id;
+
+-- Значение 'void' нельзя удалить из перечисления, поэтому отмененные начисления помечаются сгоревшими
+UPDATE bonus_entries SET status = 'expired', expired_at = NOW() WHERE status = 'void';
@@ -0,0 +1,9 @@
+-- Начисления, отмененные сторнированием операции, которая их создала
+ALTER TYPE bonus_entry_status ADD VALUE IF NOT EXISTS 'void';
+
+-- Сторно ссылается на отмененную операцию. Операцию можно отменить только один раз
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reversed_transaction_id uuid;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_reversed_transaction_id
+    ON transactions (reversed_transaction_id)
+    WHERE reversed_transaction_id IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Общая лента операций всех пользователей листается от новых к старым по (created_at, id)
+CREATE INDEX IF NOT EXISTS idx_transactions_created ON transactions (created_at, id);
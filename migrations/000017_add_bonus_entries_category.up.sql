@@ -0,0 +1,2 @@
+-- Категория баллов (например, промо или заработанные) для раздельных балансов и списаний
+ALTER TABLE bonus_entries ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT 'default';
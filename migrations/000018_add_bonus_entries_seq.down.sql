@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_bonus_entries_seq;
+
+ALTER TABLE bonus_entries DROP COLUMN IF EXISTS seq;
@@ -0,0 +1,5 @@
+-- Монотонный номер записи для инкрементальной выгрузки: id - случайный uuid, и новая запись
+-- может получить id меньше уже выгруженного, а номер каждой новой записи больше всех прежних
+ALTER TABLE bonus_entries ADD COLUMN IF NOT EXISTS seq bigserial;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_bonus_entries_seq ON bonus_entries (seq);
@@ -0,0 +1,3 @@
+-- jsonb переупорядочивает ключи и убирает пробелы, а json хранит текст payload без изменений,
+-- поэтому подписчик получает ровно те байты, которые записал сервис
+ALTER TABLE outbox ALTER COLUMN payload TYPE json USING payload::json;
@@ -0,0 +1,3 @@
+-- Срок, до которого событие забрано релеем. Релей доставляет события вне транзакции, а другие реплики
+-- пропускают забранные события, пока срок не истек; после падения релея события забираются заново
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS claimed_until timestamp with time zone;